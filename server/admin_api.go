@@ -0,0 +1,209 @@
+package main
+
+import (
+	"challenger/server/core"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	adminTokenHeader = "X-Admin-Token"
+	adminSessionKey  = "operator"
+)
+
+// registerAdminApi 管理端 websocket 命令的 http 版本，body 为 json
+// 先通过 /api/admin/login 得到 token，之后的请求在 X-Admin-Token 头中带上
+func registerAdminApi(ec *echo.Echo, srv *core.Srv) {
+	ec.Post("/api/admin/login", adminLogin(srv))
+	g := ec.Group("/api/admin", adminAuth(srv))
+	g.Post("/logout", func(c echo.Context) error {
+		srv.Logout(adminSession(c), "http", c.Request().RemoteAddress())
+		return c.JSON(http.StatusOK, map[string]string{"code": "0", "error": ""})
+	})
+	g.Get("/devices", adminHandler(srv, core.AdminOpDevices))
+	g.Post("/game_ctrl", adminHandler(srv, core.AdminOpGameCtrl))
+	g.Post("/event", adminHandler(srv, core.AdminOpEvent))
+	g.Post("/box/reset", adminHandler(srv, core.AdminOpResetBox))
+	g.Post("/session/reset", adminHandler(srv, core.AdminOpResetSession))
+	g.Post("/laser/start", adminHandler(srv, core.AdminOpLaserStart))
+	g.Post("/laser/stop", adminHandler(srv, core.AdminOpLaserStop))
+	g.Post("/outbox/drain", adminHandler(srv, core.AdminOpOutboxDrain))
+	g.Post("/backend/reload", adminHandler(srv, core.AdminOpBackendReload))
+	g.Post("/shows/reload", adminHandler(srv, core.AdminOpShowsReload))
+	g.Post("/team/add", adminHandler(srv, core.AdminOpTeamAdd))
+	g.Post("/queue/reset", adminHandler(srv, core.AdminOpQueueReset))
+	g.Get("/outbox", adminOutbox(srv))
+	g.Get("/incidents", adminIncidents(srv))
+	g.Get("/authority/decisions", adminAuthorityDecisions(srv))
+	g.Get("/audits", adminAudits(srv), adminManagerOnly)
+	g.Get("/operators", adminOperators(srv), adminManagerOnly)
+	g.Post("/operators", adminAddOperator(srv), adminManagerOnly)
+}
+
+func adminLogin(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params, err := adminBody(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		session, err := srv.Login(params["name"], params["password"], "http", c.Request().RemoteAddress())
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "data": session})
+	}
+}
+
+// adminAuth X-Admin-Token 为登录得到的 token，或者配置中的 adminApi.token
+// 配置的 token 没有操作员，只能查询和管理操作员，改变状态的操作必须登录
+func adminAuth(srv *core.Srv) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := c.Request().Header().Get(adminTokenHeader)
+			session := srv.OperatorSession(token)
+			if session == nil && token != "" && token == core.GetOptions().AdminApi.Token {
+				session = &core.OperatorSession{Role: core.OperatorRoleManager}
+			}
+			if session == nil {
+				srv.Audit(core.AdminAudit{
+					Source: "http",
+					Remote: c.Request().RemoteAddress(),
+					Op:     c.Request().URI(),
+					Result: "unauthorized",
+				})
+				return c.JSON(http.StatusUnauthorized, map[string]string{"code": "1", "error": "unauthorized"})
+			}
+			c.Set(adminSessionKey, session)
+			return next(c)
+		}
+	}
+}
+
+func adminManagerOnly(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !adminSession(c).IsManager() {
+			return c.JSON(http.StatusForbidden, map[string]string{"code": "1", "error": "manager only"})
+		}
+		return next(c)
+	}
+}
+
+func adminSession(c echo.Context) *core.OperatorSession {
+	return c.Get(adminSessionKey).(*core.OperatorSession)
+}
+
+// adminBody 把 json body 转换为字符串参数
+func adminBody(c echo.Context) (map[string]string, error) {
+	params := make(map[string]string)
+	body := make(map[string]interface{})
+	if err := c.Bind(&body); err != nil {
+		return nil, err
+	}
+	for k, v := range body {
+		params[k] = fmt.Sprint(v)
+	}
+	return params, nil
+}
+
+func adminHandler(srv *core.Srv, op string) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if core.AdminOpAudited(op) && adminSession(c).Operator == "" {
+			return c.JSON(http.StatusForbidden, map[string]string{"code": "1", "error": "operator login required"})
+		}
+		params := make(map[string]string)
+		if c.Request().Method() == echo.POST {
+			var err error
+			if params, err = adminBody(c); err != nil {
+				return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+			}
+		}
+		data, err := srv.Admin(core.AdminCommand{
+			Op:       op,
+			Params:   params,
+			Operator: adminSession(c).Operator,
+			Source:   "http",
+			Remote:   c.Request().RemoteAddress(),
+		})
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "data": data})
+	}
+}
+
+// adminOutbox 参数: status，为空时返回所有记录
+func adminOutbox(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		records, err := srv.OutboxRecords(c.QueryParam("status"))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "records": records})
+	}
+}
+
+// adminIncidents 参数: device, limit
+func adminIncidents(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, _ := strconv.Atoi(c.QueryParam("limit"))
+		incidents, err := srv.Incidents(c.QueryParam("device"), limit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "incidents": incidents})
+	}
+}
+
+// adminAuthorityDecisions 参数: card, limit
+func adminAuthorityDecisions(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		limit, _ := strconv.Atoi(c.QueryParam("limit"))
+		decisions, err := srv.AuthorityDecisions(c.QueryParam("card"), limit)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "decisions": decisions})
+	}
+}
+
+// adminAudits 参数: operator, device, game, op, from, to, limit
+func adminAudits(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		q, err := core.ParseAuditQuery(c.QueryParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		audits, err := srv.Audits(q)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "audits": audits})
+	}
+}
+
+func adminOperators(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		operators, err := srv.Operators()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "operators": operators})
+	}
+}
+
+func adminAddOperator(srv *core.Srv) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		params, err := adminBody(c)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		op, err := srv.AddOperator(adminSession(c), params["name"], params["password"], params["role"], "http", c.Request().RemoteAddress())
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "data": op})
+	}
+}
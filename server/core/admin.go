@@ -0,0 +1,333 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+// 管理操作，http 管理接口和管理端 websocket 命令共用
+const (
+	AdminOpDevices       = "devices"
+	AdminOpGameCtrl      = "gameCtrl"
+	AdminOpEvent         = "event"
+	AdminOpResetBox      = "resetBox"
+	AdminOpResetSession  = "resetSession"
+	AdminOpLaserStart    = "laserStart"
+	AdminOpLaserStop     = "laserStop"
+	AdminOpOutboxDrain   = "drainOutbox"
+	AdminOpBackendReload = "reloadBackend"
+	AdminOpShowsReload   = "reloadShows"
+)
+
+const adminCommandTimeout = 5 * time.Second
+
+// game_ctrl 的 value
+var gameCtrlValues = map[string]string{
+	"end":       "0",
+	"start":     "1",
+	"reset":     "2",
+	"realStart": "3",
+}
+
+const auditDefaultLimit = 100
+
+type AdminApiOptions struct {
+	Token          string // 请求头 X-Admin-Token 与之相同时视为值班经理，只能管理操作员，用于创建第一个操作员，为空时只能登录后访问
+	SessionTimeout int    // 登录会话的有效时间(分钟)
+}
+
+// AdminAudit 对应数据库中的 admin_audits 表，每次改变状态的管理操作一条记录，只能追加
+type AdminAudit struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Operator  string    `gorm:"index" json:"operator"`
+	Source    string    `json:"source"` // http、ws 或 arduino
+	Remote    string    `json:"remote"` // http 为客户端地址，ws 和 arduino 为发出命令的设备
+	Op        string    `json:"op"`
+	Device    string    `gorm:"index" json:"device"` // 操作的设备
+	Game      int       `gorm:"index" json:"game"`
+	Params    string    `json:"params"`
+	Result    string    `json:"result"` // ok 或错误信息
+}
+
+func (AdminAudit) TableName() string {
+	return "admin_audits"
+}
+
+// AuditQuery 为空的条件不限制，From、To 为零值时不限时间
+type AuditQuery struct {
+	Operator string
+	Device   string
+	Game     int
+	Op       string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// ParseAuditQuery get 按名字取请求参数，from、to 的格式为 2006-01-02 或 2006-01-02 15:04，使用本地时间
+func ParseAuditQuery(get func(string) string) (AuditQuery, error) {
+	q := AuditQuery{Operator: get("operator"), Device: get("device"), Op: get("op")}
+	var err error
+	if v := get("game"); v != "" {
+		if q.Game, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("game must be a number")
+		}
+	}
+	if v := get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("limit must be a number")
+		}
+	}
+	if q.From, err = parseAuditTime(get("from")); err != nil {
+		return q, err
+	}
+	if q.To, err = parseAuditTime(get("to")); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+func parseAuditTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time: " + v)
+}
+
+func (db *DB) AddAudit(audit *AdminAudit) error {
+	return db.conn.Create(audit).Error
+}
+
+// Audits 按时间倒序返回
+func (db *DB) Audits(q AuditQuery) ([]AdminAudit, error) {
+	if q.Limit <= 0 {
+		q.Limit = auditDefaultLimit
+	}
+	query := db.conn.Order("id desc").Limit(q.Limit)
+	if q.Operator != "" {
+		query = query.Where("operator = ?", q.Operator)
+	}
+	if q.Device != "" {
+		query = query.Where("device = ?", q.Device)
+	}
+	if q.Game != 0 {
+		query = query.Where("game = ?", q.Game)
+	}
+	if q.Op != "" {
+		query = query.Where("op = ?", q.Op)
+	}
+	if !q.From.IsZero() {
+		query = query.Where("created_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("created_at < ?", q.To)
+	}
+	var ret []AdminAudit
+	err := query.Find(&ret).Error
+	return ret, err
+}
+
+// Audits 只读数据库，可以在 http goroutine 中直接调用
+func (s *Srv) Audits(q AuditQuery) ([]AdminAudit, error) {
+	return s.db.Audits(q)
+}
+
+// AdminCommand 是管理接口发来的一次操作，由主循环执行后通过 result 返回
+type AdminCommand struct {
+	Op       string
+	Params   map[string]string
+	Operator string
+	Source   string
+	Remote   string
+	result   chan adminResult
+}
+
+type adminResult struct {
+	data interface{}
+	err  error
+}
+
+// Admin 在 http goroutine 中调用，等待主循环执行完命令
+func (s *Srv) Admin(cmd AdminCommand) (interface{}, error) {
+	cmd.result = make(chan adminResult, 1)
+	s.adminChan <- &cmd
+	select {
+	case r := <-cmd.result:
+		return r.data, r.err
+	case <-time.After(adminCommandTimeout):
+		return nil, errors.New("admin command timeout")
+	}
+}
+
+// Audit 记录没有进入主循环的请求，例如认证失败
+func (s *Srv) Audit(audit AdminAudit) {
+	if err := s.db.AddAudit(&audit); err != nil {
+		log.Println("save audit error:", err.Error())
+	}
+}
+
+func (s *Srv) handleAdminCommand(cmd *AdminCommand) {
+	defer s.recoverMessage("admin", cmd.Operator, cmd.Params)
+	data, err := s.execAdminCommand(cmd)
+	cmd.result <- adminResult{data, err}
+}
+
+// AdminOpAudited 改变状态的操作记录审计，必须由登录的操作员发出
+func AdminOpAudited(op string) bool {
+	return op != AdminOpDevices
+}
+
+// execAdminCommand 执行并记录审计，只读操作不记录
+func (s *Srv) execAdminCommand(cmd *AdminCommand) (interface{}, error) {
+	if !AdminOpAudited(cmd.Op) {
+		return s.runAdminOp(cmd.Op, cmd.Params)
+	}
+	//会话重置后就找不到对应的游戏了，先取出操作对象
+	device, game := s.adminTarget(cmd.Params)
+	data, err := s.runAdminOp(cmd.Op, cmd.Params)
+	params, _ := json.Marshal(cmd.Params)
+	audit := AdminAudit{Operator: cmd.Operator, Source: cmd.Source, Remote: cmd.Remote, Op: cmd.Op, Device: device, Game: game, Params: string(params), Result: "ok"}
+	if err != nil {
+		audit.Result = err.Error()
+	}
+	log.Println("admin", audit.Operator, "from", audit.Source, audit.Remote, audit.Op, audit.Params, audit.Result)
+	s.Audit(audit)
+	return data, err
+}
+
+// auditArduino 记录管理员通过 arduino 发出的操作，操作员为帧中的 ADMIN
+func (s *Srv) auditArduino(msg *InboxMessage, op string, device string, game int) {
+	params, _ := json.Marshal(arduinoFrame(msg))
+	audit := AdminAudit{Operator: msg.GetStr("ADMIN"), Source: "arduino", Remote: msg.Address.ID, Op: op, Device: device, Game: game, Params: string(params), Result: "ok"}
+	s.Audit(audit)
+}
+
+// adminTarget 从参数中取出操作的设备和游戏
+func (s *Srv) adminTarget(params map[string]string) (string, int) {
+	device := params["arduino"]
+	if params["box"] != "" {
+		device = "B-" + params["box"]
+	}
+	if params["teamID"] != "" {
+		device = "T-" + params["teamID"]
+	}
+	game, _ := strconv.Atoi(params["game"])
+	if gs := s.findSession(params["session"]); gs != nil {
+		device = gs.ArduinoId
+		game = gs.GameId
+	}
+	return device, game
+}
+
+func (s *Srv) runAdminOp(op string, params map[string]string) (interface{}, error) {
+	switch op {
+	case AdminOpDevices:
+		return s.arduinoSnapshot(), nil
+	case AdminOpGameCtrl:
+		return nil, s.adminGameCtrl(params["arduino"], params["action"], params["players"])
+	case AdminOpEvent:
+		return nil, s.adminEvent(params["event"])
+	case AdminOpResetBox:
+		return s.adminResetBox(params["box"])
+	case AdminOpResetSession:
+		return nil, s.adminResetSession(params["session"], params["game"])
+	case AdminOpLaserStart:
+		if err := s.startLaserMatch(params["mode"], splitPlayers(params["players"]), splitPlayers(params["ids"]), params["team"]); err != nil {
+			return nil, err
+		}
+		return s.laserMatchId, nil
+	case AdminOpLaserStop:
+		return nil, s.stopLaserMatch()
+	case AdminOpOutboxDrain:
+		return s.outbox.Drain()
+	case AdminOpBackendReload:
+		if err := ReloadBackendOptions(); err != nil {
+			return nil, err
+		}
+		return map[string]string{"baseUrl": GetBackendOptions().BaseUrl}, nil
+	case AdminOpShowsReload:
+		return nil, ReloadShows()
+	case AdminOpTeamAdd, AdminOpQueueReset, AdminOpTeamAddPlayer, AdminOpTeamRemovePlayer, AdminOpTeamCall, AdminOpTeamCutLine,
+		AdminOpTeamDelay, AdminOpTeamPrepare, AdminOpTeamCancelPrepare, AdminOpTeamChangeMode, AdminOpTeamStart, AdminOpTeamRemove:
+		return s.runTeamOp(op, params)
+	}
+	return nil, errors.New("unknown op: " + op)
+}
+
+func (s *Srv) adminGameCtrl(arduinoId string, action string, players string) error {
+	value, ok := gameCtrlValues[action]
+	if !ok {
+		return errors.New("action must be start, end, reset or realStart")
+	}
+	addr := InboxAddress{InboxAddressTypeGameArduinoDevice, arduinoId}
+	if s.aDict[addr.String()] == nil {
+		return errors.New("unknown game arduino: " + arduinoId)
+	}
+	if players == "" {
+		players = "1"
+	}
+	if n, err := strconv.Atoi(players); err != nil || n < 1 || n > loginMaxPlayers {
+		return errors.New("players must be 1-" + strconv.Itoa(loginMaxPlayers))
+	}
+	s.gameControl(value, arduinoId, players)
+	return nil
+}
+
+// adminEvent event 可以是事件编号，也可以是 shows.toml 中的 show 名
+func (s *Srv) adminEvent(event string) error {
+	if s.match != nil {
+		return errors.New("show " + s.match.ShowName + " is running")
+	}
+	for id, name := range eventShows {
+		if event == name || event == strconv.Itoa(id) {
+			s.startNewMatch(id)
+			return nil
+		}
+	}
+	return errors.New("unknown event: " + event)
+}
+
+func (s *Srv) adminResetBox(box string) (*HunterBox, error) {
+	boxId, err := strconv.Atoi(box)
+	if err != nil {
+		return nil, errors.New("box must be a number")
+	}
+	for k := range s.boxes {
+		if s.boxes[k].Box_ID == boxId {
+			s.boxes[k].Reset()
+			s.saveBox(k)
+			log.Println("Box:", boxId, "has been reset by admin api!")
+			return &s.boxes[k], nil
+		}
+	}
+	return nil, errors.New("unknown box: " + box)
+}
+
+// adminResetSession 给出 session 时只丢弃这一个会话，否则重置整个游戏
+func (s *Srv) adminResetSession(session string, game string) error {
+	if session != "" {
+		gs := s.findSession(session)
+		if gs == nil {
+			return errors.New("unknown session: " + session)
+		}
+		s.removeSession(gs)
+		return nil
+	}
+	gameId, err := strconv.Atoi(game)
+	if err != nil || NewGame(gameId) == nil {
+		return errors.New("unknown game: " + game)
+	}
+	s.resetGame(gameId)
+	return nil
+}
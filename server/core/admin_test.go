@@ -0,0 +1,55 @@
+package core
+
+import "testing"
+
+// outbox、后台配置和 show 的重新加载与其他管理操作一样经过主循环并记录审计
+func TestAdminMaintenanceOpsAudited(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	for _, op := range []string{AdminOpOutboxDrain, AdminOpBackendReload, AdminOpShowsReload} {
+		if !AdminOpAudited(op) {
+			t.Errorf("%v is not audited", op)
+		}
+		if _, err := ts.Admin(AdminCommand{Op: op, Operator: "staff-1", Source: "test"}); err != nil {
+			t.Errorf("%v: %v", op, err)
+		}
+		audits, err := ts.Audits(AuditQuery{Op: op})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(audits) != 1 || audits[0].Operator != "staff-1" || audits[0].Result != "ok" {
+			t.Errorf("%v audits = %+v", op, audits)
+		}
+	}
+	if AdminOpAudited(AdminOpDevices) {
+		t.Error("read only devices op is audited")
+	}
+}
+
+// 管理端的查询命令也要先登录，init 不需要
+func TestAdminQueriesRequireLogin(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	admin := ts.connect(InboxAddressTypeAdminDevice, "admin-1")
+	queries := []string{"queryGameInfo", "queryHallData", "queryOutbox", "queryAudits", "queryAuthority", "queryIncidents", "querySessions"}
+	for _, cmd := range queries {
+		msg := NewInboxMessage()
+		msg.SetCmd(cmd)
+		msg.Address = &InboxAddress{InboxAddressTypeAdminDevice, "admin-1"}
+		ts.onInboxMessageArrived(msg)
+	}
+	rejected := map[interface{}]bool{}
+	for _, res := range admin.waitReceived(t, "adminResult", len(queries)) {
+		if res["error"] == "login required" {
+			rejected[res["op"]] = true
+		}
+	}
+	for _, cmd := range queries {
+		if !rejected[cmd] {
+			t.Errorf("%v is not rejected without login", cmd)
+		}
+	}
+	if adminLoginRequired["init"] {
+		t.Error("init requires login")
+	}
+}
@@ -1,5 +1,7 @@
 package core
 
+import "time"
+
 type ArduinoMode int
 
 const ArduinoModeUnknown ArduinoMode = -1
@@ -17,6 +19,12 @@ type ArduinoController struct {
 	Mode    ArduinoMode  `json:"mode"`
 	Online  bool         `json:"online"`
 	//ScoreUpdated bool         `json:"scoreUpdated"`
+	LastSeen    time.Time `json:"lastSeen"`    // 最后一次收到消息(包括心跳)的时间
+	OnlineSince time.Time `json:"onlineSince"` // 本次连接的时间
+	Uptime      float64   `json:"uptime"`      // 本次连接持续的秒数，快照时计算
+	Reconnects  int       `json:"reconnects"`  // 服务器启动后重新连接的次数
+	Alert       bool      `json:"alert"`       // 超时没有消息，已经报警
+	connected   bool
 }
 
 func NewArduinoController(addr InboxAddress) *ArduinoController {
@@ -28,3 +36,33 @@ func NewArduinoController(addr InboxAddress) *ArduinoController {
 	//a.ScoreUpdated = false
 	return &a
 }
+
+func (a *ArduinoController) connect(now time.Time) {
+	if a.connected {
+		a.Reconnects++
+	}
+	a.connected = true
+	a.Online = true
+	a.OnlineSince = now
+}
+
+func (a *ArduinoController) disconnect() {
+	a.Online = false
+	a.OnlineSince = time.Time{}
+}
+
+// silence 返回距离最后一次收到消息的时间，从没收到过时从 since 开始计算
+func (a *ArduinoController) silence(now time.Time, since time.Time) time.Duration {
+	if a.LastSeen.IsZero() {
+		return now.Sub(since)
+	}
+	return now.Sub(a.LastSeen)
+}
+
+func (a *ArduinoController) snapshot(now time.Time) ArduinoController {
+	c := *a
+	if c.Online && !c.OnlineSince.IsZero() {
+		c.Uptime = now.Sub(c.OnlineSince).Seconds()
+	}
+	return c
+}
@@ -0,0 +1,303 @@
+package core
+
+import (
+	"log"
+	"math"
+)
+
+var _ = log.Printf
+
+// ArenaPlayer 场地中的一个玩家，Pos 为中心点的像素坐标(与 WallRects、Buttons 相同)，成绩在 MatchPlayer 中
+type ArenaPlayer struct {
+	*MatchPlayer
+	Pos         RP      `json:"pos"`
+	Dir         string  `json:"dir"`
+	Moving      bool    `json:"moving"`
+	Button      string  `json:"button"`      // 正在按的按钮
+	ButtonLevel int     `json:"buttonLevel"` // 0-3，按住的时间对应 t1,t2,t3
+	ButtonTime  float64 `json:"buttonTime"`
+	Invincible  float64 `json:"invincible"`
+	index       int
+}
+
+// ArenaLaser 沿着 TileAdjacency 追最近的玩家，在两个格子中心之间移动
+type ArenaLaser struct {
+	Pos       RP      `json:"pos"`
+	IsPause   bool    `json:"isPause"`
+	PauseTime float64 `json:"pauseTime"`
+	tile      int     // 当前所在格子
+	next      int     // 正在移向的格子，-1 表示停在 tile 中心
+}
+
+// Arena 激光迷宫的场地状态，玩家的按钮和碰激光交给 MatchEngine 计分，只能在一个 goroutine 中使用
+// json 格式与网页模拟器(arena.jsx)和游戏中屏幕(ingame.jsx)一致
+type Arena struct {
+	*MatchEngine
+
+	ID          int            `json:"id"`
+	Member      []*ArenaPlayer `json:"member"`
+	Lasers      []*ArenaLaser  `json:"lasers"`
+	laserAppear float64        // 激光出现前的预警时间
+	buttonOwner map[string]*ArenaPlayer
+}
+
+func NewArena(id int, mode string, cids []string) *Arena {
+	a := Arena{}
+	a.MatchEngine = NewMatchEngine(mode, cids)
+	a.ID = id
+	a.Member = make([]*ArenaPlayer, len(cids))
+	for i := range cids {
+		a.Member[i] = &ArenaPlayer{MatchPlayer: a.Players[i], Pos: a.opt.RealPosition(a.opt.ArenaEntrance), Dir: "up", index: i}
+	}
+	a.Lasers = make([]*ArenaLaser, 0)
+	a.buttonOwner = make(map[string]*ArenaPlayer)
+	a.laserAppear = a.opt.LaserAppearTime
+	return &a
+}
+
+func (a *Arena) Player(cid string) *ArenaPlayer {
+	for _, p := range a.Member {
+		if p.Cid == cid {
+			return p
+		}
+	}
+	return nil
+}
+
+// Move dir 为空时停止移动
+func (a *Arena) Move(cid string, dir string) {
+	p := a.Player(cid)
+	if p == nil {
+		return
+	}
+	if dir == "" {
+		p.Moving = false
+		return
+	}
+	p.Dir = dir
+	p.Moving = true
+}
+
+func (a *Arena) Tick(dt float64) {
+	a.MatchEngine.Tick(dt)
+	a.TakeButtonChanges()
+	a.TakeLaserChanges()
+	for _, p := range a.Member {
+		a.movePlayer(p, dt)
+		a.pressButtons(p, dt)
+		p.Invincible = math.Max(p.Invincible-dt, 0)
+	}
+	a.tickLasers(dt)
+}
+
+func (a *Arena) playerRect(pos RP) Rect {
+	size := a.opt.PlayerSize
+	return Rect{pos.X - size/2, pos.Y - size/2, size, size}
+}
+
+func (a *Arena) movePlayer(p *ArenaPlayer, dt float64) {
+	if !p.Moving {
+		return
+	}
+	d := a.opt.PlayerSpeed * dt
+	pos := p.Pos
+	switch p.Dir {
+	case "up":
+		pos.Y -= d
+	case "down":
+		pos.Y += d
+	case "left":
+		pos.X -= d
+	case "right":
+		pos.X += d
+	}
+	u := float64(a.opt.ArenaCellSize + a.opt.ArenaBorder)
+	r := a.playerRect(pos)
+	if r.X < 0 || r.Y < 0 || r.X+r.W > u*float64(a.opt.ArenaWidth) || r.Y+r.H > u*float64(a.opt.ArenaHeight) {
+		return
+	}
+	if a.opt.CollideWall(&r) {
+		return
+	}
+	p.Pos = pos
+}
+
+// pressButtons 玩家离开按钮时按住的时间决定档位，按钮消失
+func (a *Arena) pressButtons(p *ArenaPlayer, dt float64) {
+	r := a.playerRect(p.Pos)
+	pressing := a.opt.PressingButtons(&r)
+	if p.Button != "" {
+		if StrSlice(pressing).Pos(p.Button) >= 0 {
+			p.ButtonTime += dt
+			p.ButtonLevel = a.buttonLevel(p.ButtonTime)
+			return
+		}
+		a.releaseButton(p)
+	}
+	for _, id := range pressing {
+		if a.OnButtons[id] && a.buttonOwner[id] == nil {
+			p.Button = id
+			p.ButtonTime = 0
+			p.ButtonLevel = 0
+			a.buttonOwner[id] = p
+			return
+		}
+	}
+}
+
+// buttonLevel 暴走时按住 tRampage 就算按下
+func (a *Arena) buttonLevel(t float64) int {
+	if a.IsRampage() {
+		if t < a.opt.TRampage {
+			return 0
+		}
+		return 3
+	}
+	if t < a.opt.T1 {
+		return 0
+	} else if t < a.opt.T2 {
+		return 1
+	} else if t < a.opt.T3 {
+		return 2
+	}
+	return 3
+}
+
+func (a *Arena) releaseButton(p *ArenaPlayer) {
+	a.Press(p.index, p.Button, p.ButtonLevel)
+	delete(a.buttonOwner, p.Button)
+	p.Button = ""
+	p.ButtonTime = 0
+	p.ButtonLevel = 0
+}
+
+// tickLasers 热身结束、预警时间过后在离入口最远的格子出现和玩家人数相同的激光
+func (a *Arena) tickLasers(dt float64) {
+	if a.IsWarmup() {
+		return
+	}
+	if a.laserAppear > 0 {
+		if a.laserAppear -= dt; a.laserAppear <= 0 {
+			tile := a.farthestTile(a.opt.TilePosToInt(a.opt.ArenaEntrance))
+			for range a.Member {
+				a.Lasers = append(a.Lasers, &ArenaLaser{Pos: a.opt.RealPosition(a.opt.IntToTile(tile)), tile: tile, next: -1})
+			}
+		}
+		return
+	}
+	//暴走时激光停止
+	if a.IsRampage() {
+		return
+	}
+	for _, l := range a.Lasers {
+		if l.IsPause {
+			if l.PauseTime -= dt; l.PauseTime <= 0 {
+				l.IsPause = false
+			}
+			continue
+		}
+		a.moveLaser(l, dt)
+		a.catchPlayers(l)
+	}
+}
+
+// laserSpeed 随团队能量提速，间隔不能小于一帧
+func (a *Arena) laserSpeed() float64 {
+	interval := math.Max(a.opt.laserMoveInterval(a.Energy, a.playerIndex()+1), 0.01)
+	return float64(a.opt.ArenaCellSize) / 10 / interval
+}
+
+func (a *Arena) moveLaser(l *ArenaLaser, dt float64) {
+	d := a.laserSpeed() * dt
+	for d > 0 {
+		if l.next < 0 {
+			l.next = a.chaseNext(l.tile)
+			if l.next < 0 {
+				return
+			}
+		}
+		dst := a.opt.RealPosition(a.opt.IntToTile(l.next))
+		dx, dy := dst.X-l.Pos.X, dst.Y-l.Pos.Y
+		dist := math.Sqrt(dx*dx + dy*dy)
+		if dist <= d {
+			l.Pos = dst
+			l.tile = l.next
+			l.next = -1
+			d -= dist
+			continue
+		}
+		l.Pos.X += dx / dist * d
+		l.Pos.Y += dy / dist * d
+		return
+	}
+}
+
+// chaseNext 广度优先找到最近的可以碰的玩家，返回下一步的格子，没有目标时返回 -1
+func (a *Arena) chaseNext(from int) int {
+	targets := make(map[int]bool)
+	for _, p := range a.Member {
+		if p.Invincible <= 0 {
+			targets[a.playerTile(p)] = true
+		}
+	}
+	if len(targets) == 0 || targets[from] {
+		return -1
+	}
+	prev := map[int]int{from: from}
+	queue := []int{from}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, next := range a.opt.TileAdjacency[cur] {
+			if _, ok := prev[next]; ok {
+				continue
+			}
+			prev[next] = cur
+			if targets[next] {
+				for prev[next] != from {
+					next = prev[next]
+				}
+				return next
+			}
+			queue = append(queue, next)
+		}
+	}
+	return -1
+}
+
+func (a *Arena) farthestTile(from int) int {
+	visited := map[int]bool{from: true}
+	queue := []int{from}
+	last := from
+	for len(queue) > 0 {
+		last = queue[0]
+		queue = queue[1:]
+		for _, next := range a.opt.TileAdjacency[last] {
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return last
+}
+
+func (a *Arena) playerTile(p *ArenaPlayer) int {
+	tile, _ := a.opt.TilePosition(p.Pos)
+	return a.opt.TilePosToInt(tile)
+}
+
+// catchPlayers 激光所在格子里的玩家被碰到，激光硬直，玩家进入无敌时间
+func (a *Arena) catchPlayers(l *ArenaLaser) {
+	tile, _ := a.opt.TilePosition(l.Pos)
+	t := a.opt.TilePosToInt(tile)
+	for _, p := range a.Member {
+		if p.Invincible > 0 || a.playerTile(p) != t {
+			continue
+		}
+		a.Hit(p.index)
+		p.Invincible = a.opt.PlayerInvincibleTime
+		l.IsPause = true
+		l.PauseTime = a.opt.LaserPauseTime
+	}
+}
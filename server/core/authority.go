@@ -0,0 +1,254 @@
+package core
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	AuthoritySourceBackend = "backend" // 后台返回的结果
+	AuthoritySourceCache   = "cache"   // 后台不可用时按本地缓存决定
+)
+
+const (
+	AuthorityPolicyOpen   = "open"   // 后台不可用时，缓存中没有过期的授权放行
+	AuthorityPolicyClosed = "closed" // 后台不可用时一律拒绝
+)
+
+const (
+	authorityRefreshKey      = "authorityRefresh" // 后台定期刷新缓存的请求，不需要回复设备
+	authorityRefreshPerTick  = 5                  // 每秒最多发出的刷新请求
+	authorityDecisionsLimit  = 100
+	authorityDefaultTTL      = 24 * 3600.0
+	authorityDefaultInterval = 600.0
+)
+
+// AuthorityGrant 对应数据库中的 authority_grants 表，后台验证通过的卡和权限
+// 服务器重启后后台仍不可用时也能使用
+type AuthorityGrant struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	CardId      string    `gorm:"index" json:"cardId"`
+	AuthorityId string    `json:"authorityId"`
+	ValidatedAt time.Time `json:"validatedAt"` // 最近一次后台验证通过的时间
+	checkedAt   time.Time // 最近一次发出刷新请求的时间，只在内存中
+}
+
+func (AuthorityGrant) TableName() string {
+	return "authority_grants"
+}
+
+// AuthorityDecision 对应数据库中的 authority_decisions 表，每次回复 authority_check 一条记录
+type AuthorityDecision struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Device      string    `json:"device"`
+	CardId      string    `gorm:"index" json:"cardId"`
+	AuthorityId string    `json:"authorityId"`
+	Allowed     bool      `json:"allowed"`
+	Source      string    `json:"source"` // backend 或 cache
+	Reason      string    `json:"reason"`
+}
+
+func (AuthorityDecision) TableName() string {
+	return "authority_decisions"
+}
+
+func authorityKey(cardId string, authorityId string) string {
+	return cardId + "|" + authorityId
+}
+
+func (db *DB) AuthorityGrants() ([]AuthorityGrant, error) {
+	var ret []AuthorityGrant
+	err := db.conn.Find(&ret).Error
+	return ret, err
+}
+
+func (db *DB) SaveAuthorityGrant(grant *AuthorityGrant) error {
+	return db.conn.Save(grant).Error
+}
+
+func (db *DB) DeleteAuthorityGrant(grant *AuthorityGrant) error {
+	return db.conn.Delete(grant).Error
+}
+
+func (db *DB) AddAuthorityDecision(decision *AuthorityDecision) error {
+	return db.conn.Create(decision).Error
+}
+
+// AuthorityDecisions 按时间倒序返回，cardId 为空时返回所有卡
+func (db *DB) AuthorityDecisions(cardId string, limit int) ([]AuthorityDecision, error) {
+	if limit <= 0 {
+		limit = authorityDecisionsLimit
+	}
+	query := db.conn.Order("id desc").Limit(limit)
+	if cardId != "" {
+		query = query.Where("card_id = ?", cardId)
+	}
+	var ret []AuthorityDecision
+	err := query.Find(&ret).Error
+	return ret, err
+}
+
+// AuthorityDecisions 只读数据库，可以在 http goroutine 中直接调用
+func (s *Srv) AuthorityDecisions(cardId string, limit int) ([]AuthorityDecision, error) {
+	return s.db.AuthorityDecisions(cardId, limit)
+}
+
+// AuthorityCache 门禁卡授权的本地缓存，只在主循环中使用
+type AuthorityCache struct {
+	db     *DB
+	grants map[string]*AuthorityGrant
+}
+
+func NewAuthorityCache(db *DB) *AuthorityCache {
+	c := AuthorityCache{}
+	c.db = db
+	c.grants = make(map[string]*AuthorityGrant)
+	grants, err := db.AuthorityGrants()
+	if err != nil {
+		log.Println("load authority grants error:", err.Error())
+	}
+	for i := range grants {
+		c.grants[authorityKey(grants[i].CardId, grants[i].AuthorityId)] = &grants[i]
+	}
+	log.Println(len(c.grants), "authority grants loaded")
+	return &c
+}
+
+// Update 后台返回结果后调用，通过时记录或续期，拒绝时删除
+func (c *AuthorityCache) Update(cardId string, authorityId string, allowed bool, now time.Time) {
+	key := authorityKey(cardId, authorityId)
+	grant := c.grants[key]
+	if !allowed {
+		if grant != nil {
+			delete(c.grants, key)
+			if err := c.db.DeleteAuthorityGrant(grant); err != nil {
+				log.Println("delete authority grant error:", err.Error())
+			}
+		}
+		return
+	}
+	if grant == nil {
+		grant = &AuthorityGrant{CardId: cardId, AuthorityId: authorityId}
+		c.grants[key] = grant
+	}
+	grant.ValidatedAt = now
+	if err := c.db.SaveAuthorityGrant(grant); err != nil {
+		log.Println("save authority grant error:", err.Error())
+	}
+}
+
+// Decide 后台不可用时按缓存和配置的策略决定，返回是否放行和原因
+func (c *AuthorityCache) Decide(cardId string, authorityId string, now time.Time) (bool, string) {
+	opt := GetOptions()
+	if opt.AuthorityOfflinePolicy == AuthorityPolicyClosed {
+		return false, "backend unavailable, policy closed"
+	}
+	grant := c.grants[authorityKey(cardId, authorityId)]
+	if grant == nil {
+		return false, "backend unavailable, card not cached"
+	}
+	if now.Sub(grant.ValidatedAt).Seconds() > opt.authorityCacheTTL() {
+		return false, "backend unavailable, cached grant expired"
+	}
+	return true, "backend unavailable, cached grant validated at " + grant.ValidatedAt.Format("2006-01-02 15:04:05")
+}
+
+// due 返回需要重新验证的授权，同一个授权在刷新间隔内只请求一次
+func (c *AuthorityCache) due(now time.Time, max int) []*AuthorityGrant {
+	interval := GetOptions().authorityRefreshInterval()
+	ret := make([]*AuthorityGrant, 0)
+	for _, grant := range c.grants {
+		if len(ret) >= max {
+			break
+		}
+		if now.Sub(grant.ValidatedAt).Seconds() < interval || now.Sub(grant.checkedAt).Seconds() < interval {
+			continue
+		}
+		grant.checkedAt = now
+		ret = append(ret, grant)
+	}
+	return ret
+}
+
+func (opt *MatchOptions) authorityCacheTTL() float64 {
+	if opt.AuthorityCacheTTL <= 0 {
+		return authorityDefaultTTL
+	}
+	return opt.AuthorityCacheTTL
+}
+
+func (opt *MatchOptions) authorityRefreshInterval() float64 {
+	if opt.AuthorityRefreshInterval <= 0 {
+		return authorityDefaultInterval
+	}
+	return opt.AuthorityRefreshInterval
+}
+
+// requestAuthority 向后台验证，refresh 为 true 时是后台刷新，不回复设备
+func (s *Srv) requestAuthority(cardId string, authorityId string, msg *InboxMessage, refresh bool) {
+	if refresh {
+		msg = NewInboxMessage()
+		msg.Set("CARD_ID", cardId)
+		msg.Set("AR", authorityId)
+		msg.Set(authorityRefreshKey, "1")
+	}
+	request := NewHttpRequest(s)
+	request.SetApi(AuthorityGet)
+	params := make(map[string]string)
+	params["card_Uid"] = cardId
+	params["authority_ID"] = authorityId
+	params["op"] = "validate_authid"
+	request.SetParams(params)
+	request.SetMsg(msg) //创建request的时候需要放入ID
+	request.DoGet()
+}
+
+// refreshAuthority 在主循环中每秒调用
+func (s *Srv) refreshAuthority(now time.Time) {
+	for _, grant := range s.authority.due(now, authorityRefreshPerTick) {
+		s.requestAuthority(grant.CardId, grant.AuthorityId, nil, true)
+	}
+}
+
+// handleAuthorityResponse 后台返回非200、超时或格式不对时按缓存决定
+func (s *Srv) handleAuthorityResponse(httpRes *HttpResponse) {
+	cardId := httpRes.Msg.GetStr("CARD_ID")
+	authorityId := httpRes.Msg.GetStr("AR")
+	now := time.Now()
+	res, ok := httpRes.Get("return").(bool)
+	ok = ok && httpRes.StatusCode == 200
+	if ok {
+		s.authority.Update(cardId, authorityId, res, now)
+	}
+	if httpRes.Msg.GetStr(authorityRefreshKey) != "" {
+		if !ok {
+			log.Println("refresh authority of card:", cardId, "failed:", httpRes.StatusCode)
+		}
+		return
+	}
+
+	decision := AuthorityDecision{Device: httpRes.Msg.GetStr("ID"), CardId: cardId, AuthorityId: authorityId}
+	if ok {
+		decision.Allowed = res
+		decision.Source = AuthoritySourceBackend
+	} else {
+		decision.Allowed, decision.Reason = s.authority.Decide(cardId, authorityId, now)
+		decision.Source = AuthoritySourceCache
+		log.Println("authority request error:", httpRes.StatusCode)
+	}
+	log.Println("authority card:", cardId, "AR:", authorityId, "allowed:", decision.Allowed, "from", decision.Source, decision.Reason)
+	metrics.Inc(MetricAuthorityDecisions, "source", decision.Source, "allowed", strconv.FormatBool(decision.Allowed))
+	if err := s.db.AddAuthorityDecision(&decision); err != nil {
+		log.Println("save authority decision error:", err.Error())
+	}
+
+	addr := InboxAddress{at(decision.Device), decision.Device}
+	msg := NewInboxMessage()
+	msg.SetCmd("authority_check")
+	msg.Set("return", strconv.FormatBool(decision.Allowed))
+	s.sendToOne(msg, addr)
+}
@@ -0,0 +1,107 @@
+package core
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var _ = log.Printf
+
+// BackendOptions 对应 cfg.toml 中的 [backend]，描述票务后台 gsaleapi 的地址
+type BackendOptions struct {
+	BaseUrl         string
+	ConnectTimeout  float64 // 秒
+	ResponseTimeout float64 // 秒
+	AuthHeader      string  // 为空时不发送认证头
+	AuthValue       string
+	Endpoints       map[string]string // 接口名:相对BaseUrl的路径，未配置的接口使用默认路径
+}
+
+var backendLock = new(sync.RWMutex)
+
+// 不为空时覆盖配置中的 baseUrl，重新加载配置后依然有效
+var backendBaseUrlOverride string
+
+func GetBackendOptions() BackendOptions {
+	opt := GetOptions()
+	backendLock.RLock()
+	defer backendLock.RUnlock()
+	return opt.Backend
+}
+
+// ReloadBackendOptions 重新读取 cfg.toml 的 [backend]，不影响其他配置
+func ReloadBackendOptions() error {
+	var cfg struct {
+		Backend BackendOptions
+	}
+	if _, err := toml.DecodeFile("cfg.toml", &cfg); err != nil {
+		return err
+	}
+	cfg.Backend.fillDefaults()
+	opt := GetOptions()
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	if backendBaseUrlOverride != "" {
+		cfg.Backend.BaseUrl = backendBaseUrlOverride
+	}
+	opt.Backend = cfg.Backend
+	log.Println("backend reloaded:", opt.Backend.BaseUrl)
+	return nil
+}
+
+// SetBackendBaseUrl 把后台指向另一个地址，例如本地的 mockapi
+func SetBackendBaseUrl(baseUrl string) {
+	opt := GetOptions()
+	backendLock.Lock()
+	defer backendLock.Unlock()
+	backendBaseUrlOverride = baseUrl
+	opt.Backend.BaseUrl = baseUrl
+	log.Println("backend base url set to:", baseUrl)
+}
+
+func (b *BackendOptions) fillDefaults() {
+	if b.ConnectTimeout <= 0 {
+		b.ConnectTimeout = 2
+	}
+	if b.ResponseTimeout <= 0 {
+		b.ResponseTimeout = 2
+	}
+	if b.Endpoints == nil {
+		b.Endpoints = make(map[string]string)
+	}
+	for api, path := range defaultBackendEndpoints {
+		if _, ok := b.Endpoints[api]; !ok {
+			b.Endpoints[api] = path
+		}
+	}
+}
+
+// URL 返回接口的完整地址，api 本身是完整地址时原样返回
+func (b BackendOptions) URL(api string) string {
+	if strings.HasPrefix(api, "http://") || strings.HasPrefix(api, "https://") {
+		return api
+	}
+	path, ok := b.Endpoints[api]
+	if !ok {
+		path = defaultBackendEndpoints[api]
+	}
+	if path == "" {
+		return ""
+	}
+	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimRight(b.BaseUrl, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+func (b BackendOptions) connectTimeout() time.Duration {
+	return time.Duration(b.ConnectTimeout * float64(time.Second))
+}
+
+func (b BackendOptions) responseTimeout() time.Duration {
+	return time.Duration(b.ResponseTimeout * float64(time.Second))
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+var _ = log.Printf
+
+// HunterBoxRecord 保存寻宝宝箱的分配情况，服务器重启后据此恢复 Srv.boxes
+type HunterBoxRecord struct {
+	ID           uint `gorm:"primary_key"`
+	BoxId        int  `gorm:"unique_index"`
+	UpdatedAt    time.Time
+	CardId1      string
+	CardId2      string
+	CardIds      string // 所有卡号，逗号分隔
+	TimeBuild    string
+	TimeValidity string
+	BoxStatus    int
+	IsAssigned   bool
+}
+
+func (HunterBoxRecord) TableName() string {
+	return "hunter_boxes"
+}
+
+func (db *DB) SaveBox(box *HunterBox) error {
+	rec := HunterBoxRecord{}
+	if err := db.conn.Where("box_id = ?", box.Box_ID).FirstOrInit(&rec).Error; err != nil {
+		return err
+	}
+	rec.BoxId = box.Box_ID
+	rec.CardId1 = box.Card_ID1
+	rec.CardId2 = box.Card_ID2
+	rec.CardIds = strings.Join(box.Card_IDs, ",")
+	rec.TimeBuild = box.Time_build
+	rec.TimeValidity = box.Time_validity
+	rec.BoxStatus = box.Box_status
+	rec.IsAssigned = box.IsAssigned
+	return db.conn.Save(&rec).Error
+}
+
+// LoadBoxes 把数据库中的记录填入 boxes，Box_ID 超出范围的记录忽略
+func (db *DB) LoadBoxes(boxes []HunterBox) error {
+	var records []HunterBoxRecord
+	if err := db.conn.Find(&records).Error; err != nil {
+		return err
+	}
+	for _, rec := range records {
+		for i := range boxes {
+			if boxes[i].Box_ID != rec.BoxId {
+				continue
+			}
+			boxes[i].Card_ID1 = rec.CardId1
+			boxes[i].Card_ID2 = rec.CardId2
+			boxes[i].Card_IDs = nil
+			if rec.CardIds != "" {
+				boxes[i].Card_IDs = strings.Split(rec.CardIds, ",")
+			}
+			boxes[i].Time_build = rec.TimeBuild
+			boxes[i].Time_validity = rec.TimeValidity
+			boxes[i].Box_status = rec.BoxStatus
+			boxes[i].IsAssigned = rec.IsAssigned
+		}
+	}
+	return nil
+}
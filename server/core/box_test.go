@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectBox 模拟宝箱arduino连上后的第一个心跳
+func (ts *testSrv) connectBox(id string) *testConn {
+	c := ts.connect(InboxAddressTypeBoxArduinoDevice, id)
+	msg := arduinoMsg(id, "TYPE", Hbt)
+	msg.AddAddress = msg.Address
+	ts.onInboxMessageArrived(msg)
+	return c
+}
+
+func (ts *testSrv) assignBox(k int, card1 string, card2 string, validity time.Time) {
+	ts.do(func() {
+		box := &ts.boxes[k]
+		box.IsAssigned = true
+		box.Box_status = -1
+		box.Card_ID1 = card1
+		box.Card_ID2 = card2
+		box.Time_build = currentTime()
+		box.Time_validity = validity.Format("2006-01-02 15:04:05")
+	})
+}
+
+func TestReconcileBoxResendsAfterClosedReport(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.assignBox(0, "card-1", "card-2", time.Now().Add(time.Hour))
+
+	box := ts.connectBox("B-1")
+	box.waitReceived(t, "box_status_get", 1)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(box.received("box_set")); n != 0 {
+		t.Fatalf("box_set sent before the box reported, got %v", n)
+	}
+	ts.send("B-1", "TYPE", BoxStatus, "BOX_ID", "0", "ST", "0")
+	set := box.waitReceived(t, "box_set", 1)[0]
+	if set["cardId1"] != "card-1" || set["cardId2"] != "card-2" {
+		t.Errorf("box_set = %v", set)
+	}
+	ts.do(func() {
+		if !ts.boxes[0].IsAssigned || !ts.boxes[0].reconcileAt.IsZero() {
+			t.Errorf("box after reconcile = %+v", ts.boxes[0])
+		}
+	})
+}
+
+func TestReconcileBoxAppliesOpenedReport(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.assignBox(1, "card-1", "", time.Now().Add(time.Hour))
+
+	box := ts.connectBox("B-2")
+	box.waitReceived(t, "box_status_get", 1)
+	var reconcileAt time.Time
+	ts.do(func() { reconcileAt = ts.boxes[1].reconcileAt })
+	ts.send("B-2", "TYPE", BoxStatus, "BOX_ID", "1", "ST", "1")
+	var status int
+	waitFor(t, "box opened", func() bool {
+		ts.do(func() { status = ts.boxes[1].Box_status })
+		return status == 1
+	})
+	//打开后不再重发分配，超时也不重发
+	ts.boxChan <- boxEvent{BoxID: 1, Reconcile: true, At: reconcileAt}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(box.received("box_set")); n != 0 {
+		t.Errorf("box_set sent to an opened box, got %v", n)
+	}
+}
+
+func TestReconcileBoxTimeoutResends(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.assignBox(2, "card-1", "", time.Now().Add(time.Hour))
+
+	box := ts.connectBox("B-3")
+	box.waitReceived(t, "box_status_get", 1)
+	//不支持 box_status_get 的固件不会上报
+	var reconcileAt time.Time
+	ts.do(func() { reconcileAt = ts.boxes[2].reconcileAt })
+	ts.boxChan <- boxEvent{BoxID: 2, Reconcile: true, At: reconcileAt}
+	box.waitReceived(t, "box_set", 1)
+}
+
+// 分配过期时按 Box_ID 通知宝箱重置一次，宝箱在 boxes 中的位置会因为排序改变
+func TestBoxExpiryResetsOnce(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	box := ts.connect(InboxAddressTypeBoxArduinoDevice, "B-4")
+	ts.assignBox(3, "card-1", "", time.Now().Add(time.Second))
+	ts.do(func() {
+		ts.boxes[0], ts.boxes[3] = ts.boxes[3], ts.boxes[0]
+		ts.watchBoxExpiry(&ts.boxes[0])
+	})
+	reset := box.waitReceived(t, "box_reset", 1)[0]
+	if reset["num"] != "3" {
+		t.Errorf("box_reset = %v, want num 3", reset)
+	}
+	for i := 0; i < 3; i++ {
+		ts.tickAt(time.Now())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(box.received("box_reset")); n != 1 {
+		t.Errorf("box_reset sent %v times, want 1", n)
+	}
+}
+
+// 3、4人寻宝时所有卡号都发给宝箱并保存，cardId1 cardId2 仍是前两张
+func TestAssignHunterBoxAllCards(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	conns := make(map[string]*testConn)
+	for _, id := range GetOptions().BoxArduino {
+		conns[id] = ts.connect(InboxAddressTypeBoxArduinoDevice, id)
+	}
+	cards := []string{"card-1", "card-2", "card-3", "card-4"}
+	k := -1
+	ts.do(func() {
+		game := NewGame(ID_Hunter).(*Hunter)
+		game.GetLoginInfo().SetPlayerNum(len(cards))
+		for i, cardId := range cards {
+			game.Login(cardId, strconv.Itoa(i))
+		}
+		ts.assignHunterBox(game)
+		k = game.Box_ID
+	})
+
+	set := conns[returnBox(k)].waitReceived(t, "box_set", 1)[0]
+	if set["cardId1"] != "card-1" || set["cardId2"] != "card-2" || fmt.Sprint(set["cardIds"]) != fmt.Sprint(cards) {
+		t.Errorf("box_set = %v", set)
+	}
+	boxes := make([]HunterBox, len(GetOptions().BoxArduino))
+	for i := range boxes {
+		boxes[i].Box_ID = i
+	}
+	if err := ts.db.LoadBoxes(boxes); err != nil {
+		t.Fatal(err)
+	}
+	if got := boxes[k].Cards(); strings.Join(got, ",") != strings.Join(cards, ",") {
+		t.Errorf("saved cards = %v, want %v", got, cards)
+	}
+}
@@ -0,0 +1,50 @@
+package core
+
+import (
+	"log"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+var _ = log.Printf
+
+type DB struct {
+	conn *gorm.DB
+}
+
+func NewDb(path string) (*DB, error) {
+	conn, err := gorm.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite 只允许一个写连接，避免多个 goroutine 同时写时出现 database is locked
+	conn.DB().SetMaxOpenConns(1)
+	db := DB{conn: conn}
+	if err := db.migrate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &db, nil
+}
+
+func (db *DB) migrate() error {
+	err := db.conn.AutoMigrate(&OutboxRecord{}, &MatchData{}, &PlayerData{}, &HunterBoxRecord{}, &Incident{}, &AdminAudit{}, &Operator{}, &AuthorityGrant{}, &AuthorityDecision{}, &TicketRecord{}, &Team{}).Error
+	if err != nil {
+		return err
+	}
+	// 审计记录只能追加，不能修改或删除
+	for _, stmt := range []string{
+		"CREATE TRIGGER IF NOT EXISTS admin_audits_no_update BEFORE UPDATE ON admin_audits BEGIN SELECT RAISE(ABORT, 'admin_audits is append-only'); END",
+		"CREATE TRIGGER IF NOT EXISTS admin_audits_no_delete BEFORE DELETE ON admin_audits BEGIN SELECT RAISE(ABORT, 'admin_audits is append-only'); END",
+	} {
+		if err := db.conn.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
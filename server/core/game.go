@@ -0,0 +1,111 @@
+package core
+
+import (
+	"log"
+	"strconv"
+)
+
+var _ = log.Printf
+
+// Game 是每个游戏房间需要实现的接口，Srv 只通过它来驱动游戏的登录、开始、数据、结束和上传
+// 每个会话创建一个新的 Game，上传后丢弃，不会重复使用
+type Game interface {
+	ID() int
+	GetLoginInfo() *LoginInfo
+	Login(cardId string, ticketId string) bool // 人数已满时返回 false
+	Start()
+	ApplyData(s *Srv, msg *InboxMessage)
+	End()
+	UploadApi() string
+	BuildUpload() map[string]string
+}
+
+var gameRegistry = make(map[int]func() Game)
+var gameUploadApis = make(map[string]bool) // 注册时记录，后台返回时判断是否为游戏数据的上传
+
+// RegisterGame 以 ID_* 常量为键注册游戏的构造函数
+func RegisterGame(gameId int, newGame func() Game) {
+	if _, ok := gameRegistry[gameId]; ok {
+		log.Printf("game %v registered twice\n", gameId)
+	}
+	gameRegistry[gameId] = newGame
+	gameUploadApis[newGame().UploadApi()] = true
+}
+
+func NewGame(gameId int) Game {
+	if newGame, ok := gameRegistry[gameId]; ok {
+		return newGame()
+	}
+	return nil
+}
+
+func isGameUploadApi(api string) bool {
+	return gameUploadApis[api]
+}
+
+// gameBase 包含所有游戏共有的字段，具体游戏嵌入它即可
+type gameBase struct {
+	GameId     int
+	Time_start string
+	Time_end   string
+	LoginInfo  *LoginInfo
+}
+
+func newGameBase(gameId int) gameBase {
+	base := gameBase{}
+	base.GameId = gameId
+	base.LoginInfo = &LoginInfo{}
+	base.LoginInfo.PlayerCardInfo = make(map[string]string)
+	base.LoginInfo.CardTicketInfo = make(map[string]string)
+	return base
+}
+
+func (base *gameBase) ID() int {
+	return base.GameId
+}
+
+func (base *gameBase) GetLoginInfo() *LoginInfo {
+	return base.LoginInfo
+}
+
+func (base *gameBase) Login(cardId string, ticketId string) bool {
+	if !base.LoginInfo.setCardId(cardId) {
+		return false
+	}
+	base.LoginInfo.setTicket(cardId, ticketId)
+	return true
+}
+
+func (base *gameBase) Start() {
+	base.Time_start = currentTime()
+	base.LoginInfo.IsUploadInfo = true
+}
+
+func (base *gameBase) End() {
+	base.Time_end = currentTime()
+}
+
+// baseUpload 返回所有游戏上传时共有的参数，card_ID1 card_ID2 总是上传，
+// 3人以上时再加上 card_ID3 card_ID4，原来的后台接口不受影响
+func (base *gameBase) baseUpload(op string) map[string]string {
+	params := make(map[string]string)
+	params["card_ID1"] = base.LoginInfo.PlayerCardInfo["1p"]
+	params["card_ID2"] = base.LoginInfo.PlayerCardInfo["2p"]
+	for i := 3; i <= loginMaxPlayers; i++ {
+		if cardId := base.LoginInfo.PlayerCardInfo[playerKey(i)]; cardId != "" {
+			params["card_ID"+strconv.Itoa(i)] = cardId
+		}
+	}
+	params["time_start"] = base.Time_start
+	params["time_end"] = base.Time_end
+	params["op"] = op
+	return params
+}
+
+// 硬件上传的数据字段为空时按 "0" 处理
+func dataOrZero(msg *InboxMessage, key string) string {
+	if v := msg.GetStr(key); v != "" {
+		return v
+	}
+	return "0"
+}
@@ -0,0 +1,21 @@
+package core
+
+import "testing"
+
+func TestIsGameUploadApi(t *testing.T) {
+	tests := []struct {
+		api  string
+		want bool
+	}{
+		{GameDataHunterCreate, true},
+		{GameDataFollowCreate, true},
+		{GameDataAdivinacionCreate, true},
+		{BoxUpload, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isGameUploadApi(tt.api); got != tt.want {
+			t.Errorf("isGameUploadApi(%q) = %v, want %v", tt.api, got, tt.want)
+		}
+	}
+}
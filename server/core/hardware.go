@@ -1,6 +1,12 @@
 package core
 
-import "log"
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"challenger/server/protocol"
+)
 
 var _ = log.Printf
 
@@ -17,21 +23,73 @@ const (
 	ID_Hunter                  //寻宝 11
 )
 
+func init() {
+	RegisterGame(ID_Follow, func() Game { return NewFollow() })
+	RegisterGame(ID_Privity, func() Game { return NewPrivity() })
+	RegisterGame(ID_Bang, func() Game { return NewBang() })
+	RegisterGame(ID_Highnoon, func() Game { return NewHighnoon() })
+	RegisterGame(ID_Greeting, func() Game { return NewGreeting() })
+	RegisterGame(ID_Russian, func() Game { return NewRussian() })
+	RegisterGame(ID_Marksman, func() Game { return NewMarksman() })
+	RegisterGame(ID_Adivainacion, func() Game { return NewAdivainacion() })
+	RegisterGame(ID_Miner, func() Game { return NewMiner() })
+	RegisterGame(ID_Hunter, func() Game { return NewHunter() })
+}
+
+const (
+	loginDefaultPlayers = 2 // 刷卡时没有带 P 的设备按原来的两人处理
+	loginMaxPlayers     = protocol.MaxPlayers
+)
+
 type LoginInfo struct {
-	PlayerNum      int
-	PlayerCardInfo map[string]string //1p:cardId
+	PlayerNum      int               //这一局的人数，由刷卡消息中的 P 决定，0 表示使用默认人数
+	PlayerCardInfo map[string]string //1p:cardId ... 4p:cardId
 	CardTicketInfo map[string]string //cardId:ticketId
 	IsUploadInfo   bool
 }
 
-func (l *LoginInfo) setCardId(cardId string) {
-	if l.PlayerCardInfo["1p"] != "" {
-		l.PlayerCardInfo["2p"] = cardId
-		log.Println("2p login:", cardId)
-	} else {
-		l.PlayerCardInfo["1p"] = cardId
-		log.Println("1p login:", cardId)
+func playerKey(n int) string {
+	return strconv.Itoa(n) + "p"
+}
+
+// SetPlayerNum 超出 1-4 的人数按默认人数处理
+func (l *LoginInfo) SetPlayerNum(n int) {
+	if n < 1 || n > loginMaxPlayers {
+		n = 0
 	}
+	l.PlayerNum = n
+}
+
+// Capacity 返回这一局最多可以登录的人数
+func (l *LoginInfo) Capacity() int {
+	if l.PlayerNum == 0 {
+		return loginDefaultPlayers
+	}
+	return l.PlayerNum
+}
+
+// Cards 按 1p 2p ... 的顺序返回已登录的卡号
+func (l *LoginInfo) Cards() []string {
+	ret := make([]string, 0)
+	for i := 1; i <= loginMaxPlayers; i++ {
+		if cardId := l.PlayerCardInfo[playerKey(i)]; cardId != "" {
+			ret = append(ret, cardId)
+		}
+	}
+	return ret
+}
+
+func (l *LoginInfo) setCardId(cardId string) bool {
+	for i := 1; i <= l.Capacity(); i++ {
+		key := playerKey(i)
+		if l.PlayerCardInfo[key] == "" {
+			l.PlayerCardInfo[key] = cardId
+			log.Println(key, "login:", cardId)
+			return true
+		}
+	}
+	log.Println("game is full, card:", cardId, "not login")
+	return false
 }
 
 func (l *LoginInfo) setTicket(card, ticket string) {
@@ -40,231 +98,190 @@ func (l *LoginInfo) setTicket(card, ticket string) {
 
 //占卜
 type Adivainacion struct {
-	GameId int
-	//Card_ID    string
-	Time_start string
-	Time_end   string
-	LoginInfo  *LoginInfo
+	gameBase
 }
 
 func NewAdivainacion() *Adivainacion {
 	game := Adivainacion{}
-	game.GameId = ID_Adivainacion
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Adivainacion)
 	return &game
 }
 
-func (game *Adivainacion) Reset() {
-	//game.Card_ID = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Adivainacion) ApplyData(s *Srv, msg *InboxMessage) {
+}
+
+func (game *Adivainacion) UploadApi() string {
+	return GameDataAdivinacionCreate
+}
+
+func (game *Adivainacion) BuildUpload() map[string]string {
+	params := make(map[string]string)
+	params["card_ID"] = game.LoginInfo.PlayerCardInfo["1p"]
+	params["time_start"] = game.Time_start
+	params["time_end"] = game.Time_end
+	params["op"] = "set_adivinacion"
+	return params
 }
 
 //六连
 type Bang struct {
-	GameId int
-	//Card_ID     string
-	Time_start  string
-	Time_end    string
+	gameBase
 	Point_round map[int]string //设定为3局map[局数]分数
-	LoginInfo   *LoginInfo
 }
 
 func NewBang() *Bang {
 	game := Bang{}
-	game.GameId = ID_Bang
+	game.gameBase = newGameBase(ID_Bang)
 	game.Point_round = make(map[int]string)
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
 	return &game
 }
 
-func (game *Bang) Reset() {
-	//game.Card_ID = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	for k, _ := range game.Point_round {
-		delete(game.Point_round, k)
-	}
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
+func (game *Bang) ApplyData(s *Srv, msg *InboxMessage) {
+	for i := 1; i <= 3; i++ {
+		game.Point_round[i] = dataOrZero(msg, "PR"+strconv.Itoa(i))
 	}
 }
 
+func (game *Bang) UploadApi() string {
+	return GameDataBangCreate
+}
+
+func (game *Bang) BuildUpload() map[string]string {
+	params := make(map[string]string)
+	params["card_ID"] = game.LoginInfo.PlayerCardInfo["1p"]
+	params["time_start"] = game.Time_start
+	params["time_end"] = game.Time_end
+	params["point_round1"] = game.Point_round[1]
+	params["point_round2"] = game.Point_round[2]
+	params["point_round3"] = game.Point_round[3]
+	params["op"] = "set_bang"
+	return params
+}
+
 //走格子
 type Follow struct {
-	GameId int
-	//Card_ID1   string
-	//Card_ID2   string
-	Time_start string
-	Time_end   string
+	gameBase
 	Last_round string
-	LoginInfo  *LoginInfo
 }
 
 func NewFollow() *Follow {
 	game := Follow{}
-	game.GameId = ID_Follow
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Follow)
 	return &game
 }
 
-func (game *Follow) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.Last_round = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Follow) ApplyData(s *Srv, msg *InboxMessage) {
+	game.Last_round = dataOrZero(msg, "LR")
+}
+
+func (game *Follow) UploadApi() string {
+	return GameDataFollowCreate
+}
+
+func (game *Follow) BuildUpload() map[string]string {
+	params := game.baseUpload("set_follow")
+	params["last_round"] = game.Last_round
+	return params
 }
 
 //新人走廊
 type Greeting struct {
-	GameId int
-	//Card_ID1   string
-	//Card_ID2   string
-	Time_start string
-	Time_end   string
-	LoginInfo  *LoginInfo
+	gameBase
 }
 
 func NewGreeting() *Greeting {
 	game := Greeting{}
-	game.GameId = ID_Greeting
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Greeting)
 	return &game
 }
 
-func (game *Greeting) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Greeting) ApplyData(s *Srv, msg *InboxMessage) {
+}
+
+func (game *Greeting) UploadApi() string {
+	return GameDataGreetingCreate
+}
+
+func (game *Greeting) BuildUpload() map[string]string {
+	return game.baseUpload("set_greeting")
 }
 
 //午时已到
 type Highnoon struct {
-	GameId int
-	//Card_ID1        string
-	//Card_ID2        string
-	Time_start      string
-	Time_end        string
+	gameBase
 	Result_round_1p map[int]string //共7局 map[7]0.617 float代表开枪时间
 	Result_round_2p map[int]string //共7局 map[7]0.617 float代表开枪时间
-	LoginInfo       *LoginInfo
 }
 
+const highnoonRounds = 7
+
 func NewHighnoon() *Highnoon {
 	game := Highnoon{}
-	game.GameId = ID_Highnoon
+	game.gameBase = newGameBase(ID_Highnoon)
 	game.Result_round_1p = make(map[int]string)
 	game.Result_round_2p = make(map[int]string)
-	for i := 1; i < 8; i++ {
+	for i := 1; i <= highnoonRounds; i++ {
 		game.Result_round_1p[i] = "0"
 		game.Result_round_2p[i] = "0"
 	}
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
 	return &game
 }
 
-func (game *Highnoon) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	for k, _ := range game.Result_round_1p {
-		//delete(game.Result_round_1p, k)
-		game.Result_round_1p[k] = "0"
-	}
-	for k, _ := range game.Result_round_2p {
-		//delete(game.Result_round_2p, k)
-		game.Result_round_2p[k] = "0"
-	}
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
+func (game *Highnoon) ApplyData(s *Srv, msg *InboxMessage) {
+	for i := 1; i <= highnoonRounds; i++ {
+		round := "R" + strconv.Itoa(i)
+		game.Result_round_1p[i] = dataOrZero(msg, round+"P1")
+		game.Result_round_2p[i] = dataOrZero(msg, round+"P2")
 	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
+}
+
+func (game *Highnoon) UploadApi() string {
+	return GameDataHighnoonCreate
+}
+
+func (game *Highnoon) BuildUpload() map[string]string {
+	params := game.baseUpload("set_highnoon")
+	for i := 1; i <= highnoonRounds; i++ {
+		round := strconv.Itoa(i)
+		params["1p_result_round"+round] = game.Result_round_1p[i]
+		params["2p_result_round"+round] = game.Result_round_2p[i]
 	}
+	return params
 }
 
 //寻宝
 type Hunter struct {
-	GameId int
-	//Card_ID1         string
-	//Card_ID2         string
-	Time_start       string
-	Time_end         string
+	gameBase
 	Time_firstButton string
 	Box_ID           int
-	LoginInfo        *LoginInfo
 }
 
 func NewHunter() *Hunter {
 	game := Hunter{}
-	game.GameId = ID_Hunter
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Hunter)
 	return &game
 }
 
-func (game *Hunter) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.Time_firstButton = ""
-	game.Box_ID = 0
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
+func (game *Hunter) ApplyData(s *Srv, msg *InboxMessage) {
+	game.Time_firstButton = msg.GetStr("FB")
+	if game.Time_firstButton != "0" && game.Time_firstButton != "" {
+		s.assignHunterBox(game)
+	} else {
+		game.Time_firstButton = "0"
 	}
 }
 
+func (game *Hunter) UploadApi() string {
+	return GameDataHunterCreate
+}
+
+func (game *Hunter) BuildUpload() map[string]string {
+	params := game.baseUpload("set_hunter")
+	params["time_firstbutton"] = game.Time_firstButton
+	params["box_ID"] = strconv.Itoa(game.Box_ID + 1)
+	return params
+}
+
 //寻宝所分配的场地保箱
 type HunterBox struct {
 	Box_ID        int
@@ -272,8 +289,11 @@ type HunterBox struct {
 	Time_validity string
 	Card_ID1      string
 	Card_ID2      string
-	Box_status    int //0代表未开启，1代表开启
+	Card_IDs      []string //所有登录的卡号，Card_ID1、Card_ID2 是前两张，兼容只认两张卡的固件
+	Box_status    int      //0代表未开启，1代表开启
 	IsAssigned    bool
+
+	reconcileAt time.Time //宝箱arduino上线后等待上报状态的截止时间，为零值时不在等待
 }
 
 func (box *HunterBox) Reset() {
@@ -281,8 +301,36 @@ func (box *HunterBox) Reset() {
 	box.Time_validity = ""
 	box.Card_ID1 = ""
 	box.Card_ID2 = ""
+	box.Card_IDs = nil
 	box.Box_status = -1
 	box.IsAssigned = false
+	box.reconcileAt = time.Time{}
+}
+
+func (box *HunterBox) setCards(cards []string) {
+	box.Card_IDs = cards
+	box.Card_ID1 = ""
+	box.Card_ID2 = ""
+	if len(cards) > 0 {
+		box.Card_ID1 = cards[0]
+	}
+	if len(cards) > 1 {
+		box.Card_ID2 = cards[1]
+	}
+}
+
+// Cards 返回分配给宝箱的所有卡号，升级前保存的记录只有 Card_ID1 和 Card_ID2
+func (box *HunterBox) Cards() []string {
+	if len(box.Card_IDs) > 0 {
+		return box.Card_IDs
+	}
+	ret := make([]string, 0)
+	for _, cardId := range []string{box.Card_ID1, box.Card_ID2} {
+		if cardId != "" {
+			ret = append(ret, cardId)
+		}
+	}
+	return ret
 }
 
 type HunterBoxSlice []HunterBox
@@ -305,146 +353,109 @@ func (box HunterBoxSlice) Less(i, j int) bool { // 重写 Less() 方法， 从
 
 //射箭
 type Marksman struct {
-	GameId int
-	//Card_ID1    string
-	//Card_ID2    string
-	Time_start  string
-	Time_end    string
+	gameBase
 	Point_left  string
 	Point_right string
-	LoginInfo   *LoginInfo
 }
 
 func NewMarksman() *Marksman {
 	game := Marksman{}
-	game.GameId = ID_Marksman
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Marksman)
 	return &game
 }
 
-func (game *Marksman) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.Point_left = ""
-	game.Point_right = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Marksman) ApplyData(s *Srv, msg *InboxMessage) {
+	game.Point_right = dataOrZero(msg, "PR")
+	game.Point_left = dataOrZero(msg, "PL")
+}
+
+func (game *Marksman) UploadApi() string {
+	return GameDataMarksmanCreate
+}
+
+func (game *Marksman) BuildUpload() map[string]string {
+	params := game.baseUpload("set_marksman")
+	params["point_left"] = game.Point_left
+	params["point_right"] = game.Point_right
+	return params
 }
 
 //挖矿
 type Miner struct {
-	GameId int
-	//Card_ID1   string
-	//Card_ID2   string
-	Time_start string
-	Time_end   string
-	LoginInfo  *LoginInfo
+	gameBase
 }
 
 func NewMiner() *Miner {
 	game := Miner{}
-	game.GameId = ID_Miner
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Miner)
 	return &game
 }
 
-func (game *Miner) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Miner) ApplyData(s *Srv, msg *InboxMessage) {
+}
+
+func (game *Miner) UploadApi() string {
+	return GameDataMinerCreate
+}
+
+func (game *Miner) BuildUpload() map[string]string {
+	return game.baseUpload("set_miner")
 }
 
 //默契牢笼
 type Privity struct {
-	GameId int
-	//Card_ID1     string
-	//Card_ID2     string
-	Time_start   string
-	Time_end     string
+	gameBase
 	Num_question string
 	Num_right    string
-	LoginInfo    *LoginInfo
 }
 
 func NewPrivity() *Privity {
 	game := Privity{}
-	game.GameId = ID_Privity
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Privity)
 	return &game
 }
 
-func (game *Privity) Reset() {
-	//game.Card_ID1 = ""
-	//game.Card_ID2 = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.Num_question = ""
-	game.Num_right = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Privity) ApplyData(s *Srv, msg *InboxMessage) {
+	game.Num_right = dataOrZero(msg, "NR")
+	game.Num_question = dataOrZero(msg, "NQ")
+}
+
+func (game *Privity) UploadApi() string {
+	return GameDataPrivityCreate
+}
+
+func (game *Privity) BuildUpload() map[string]string {
+	params := game.baseUpload("set_privity")
+	params["number_question"] = game.Num_question
+	params["number_right"] = game.Num_right
+	return params
 }
 
 //献祭房间
 type Russian struct {
-	GameId int
-	//Card_ID    string
-	Time_start     string
-	Time_end       string
+	gameBase
 	Desk_num       string
 	Bullet_trigger string
-	LoginInfo      *LoginInfo
 }
 
 func NewRussian() *Russian {
 	game := Russian{}
-	game.GameId = ID_Russian
-	game.LoginInfo = &LoginInfo{}
-	game.LoginInfo.PlayerCardInfo = make(map[string]string)
-	game.LoginInfo.CardTicketInfo = make(map[string]string)
+	game.gameBase = newGameBase(ID_Russian)
 	return &game
 }
 
-func (game *Russian) Reset() {
-	//game.Card_ID = ""
-	game.LoginInfo.IsUploadInfo = false
-	game.Time_start = ""
-	game.Time_end = ""
-	game.Desk_num = ""
-	game.Bullet_trigger = ""
-	game.LoginInfo.PlayerNum = 0
-	for k, _ := range game.LoginInfo.PlayerCardInfo {
-		delete(game.LoginInfo.PlayerCardInfo, k)
-	}
-	for k, _ := range game.LoginInfo.CardTicketInfo {
-		delete(game.LoginInfo.CardTicketInfo, k)
-	}
+func (game *Russian) ApplyData(s *Srv, msg *InboxMessage) {
+	game.Bullet_trigger = dataOrZero(msg, "BT")
+	game.Desk_num = dataOrZero(msg, "DN")
+}
+
+func (game *Russian) UploadApi() string {
+	return GameDataRussianCreate
+}
+
+func (game *Russian) BuildUpload() map[string]string {
+	params := game.baseUpload("set_russian")
+	params["desk_no"] = game.Desk_num
+	params["bullet_trigger"] = game.Bullet_trigger
+	return params
 }
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	IncidentOffline   = "offline"   // 超过 deviceOfflineAlert 秒没有收到设备的消息
+	IncidentRecovered = "recovered" // 报警后重新收到设备的消息
+)
+
+const incidentDefaultLimit = 100
+
+// Incident 对应数据库中的 incidents 表，记录设备报警，供工作人员事后查看
+type Incident struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Device    string    `gorm:"index" json:"device"`
+	Kind      string    `json:"kind"`
+	Detail    string    `json:"detail"`
+}
+
+func (db *DB) AddIncident(incident *Incident) error {
+	return db.conn.Create(incident).Error
+}
+
+// Incidents 按时间倒序返回最近的记录，device 为空时返回所有设备
+func (db *DB) Incidents(device string, limit int) ([]Incident, error) {
+	if limit <= 0 {
+		limit = incidentDefaultLimit
+	}
+	query := db.conn.Order("id desc").Limit(limit)
+	if device != "" {
+		query = query.Where("device = ?", device)
+	}
+	var ret []Incident
+	err := query.Find(&ret).Error
+	return ret, err
+}
+
+// Incidents 只读数据库，可以在 http goroutine 中直接调用
+func (s *Srv) Incidents(device string, limit int) ([]Incident, error) {
+	return s.db.Incidents(device, limit)
+}
+
+// deviceSeen 收到 arduino 的任何消息都算作心跳
+func (s *Srv) deviceSeen(controller *ArduinoController, now time.Time) {
+	controller.LastSeen = now
+	if controller.Alert {
+		controller.Alert = false
+		s.raiseIncident(controller, IncidentRecovered, "")
+	}
+}
+
+// checkDeviceHealth 在主循环中每秒调用，从没连上的设备从服务器启动开始计时
+func (s *Srv) checkDeviceHealth(now time.Time) {
+	gap := GetOptions().DeviceOfflineAlert
+	if gap <= 0 {
+		return
+	}
+	for _, controller := range s.aDict {
+		silence := controller.silence(now, s.startedAt)
+		if controller.Alert || silence.Seconds() < gap {
+			continue
+		}
+		controller.Alert = true
+		s.raiseIncident(controller, IncidentOffline, "no message for "+strconv.Itoa(int(silence.Seconds()))+"s")
+	}
+}
+
+// raiseIncident 写入数据库并通知所有管理端
+func (s *Srv) raiseIncident(controller *ArduinoController, kind string, detail string) {
+	incident := Incident{Device: controller.Address.ID, Kind: kind, Detail: detail}
+	log.Println("device", incident.Device, kind, detail)
+	if err := s.db.AddIncident(&incident); err != nil {
+		log.Println("save incident error:", err.Error())
+	}
+	msg := NewInboxMessage()
+	msg.SetCmd("deviceAlert")
+	msg.Set("incident", incident)
+	msg.Set("arduino", controller.snapshot(time.Now()))
+	s.sends(msg, InboxAddressTypeAdminDevice)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"encoding/json"
@@ -14,11 +15,12 @@ import (
 )
 
 type HttpRequest struct {
-	s      *Srv
-	api    string
-	params map[string]string
-	client *http.Client
-	msg    *InboxMessage
+	s       *Srv
+	api     string
+	params  map[string]string
+	client  *http.Client
+	msg     *InboxMessage
+	backend BackendOptions
 	//arduinoId string //个别arduino的命令需要转发该id
 	//cardId    string //票务请求需要知道cardId与ticketId的对应关系
 }
@@ -27,17 +29,20 @@ func NewHttpRequest(s *Srv) *HttpRequest {
 	request := HttpRequest{}
 	request.s = s
 	request.api = ""
+	request.backend = GetBackendOptions()
+	connectTimeout := request.backend.connectTimeout()
+	responseTimeout := request.backend.responseTimeout()
 	request.client = &http.Client{
 		Transport: &http.Transport{
 			Dial: func(netw, addr string) (net.Conn, error) {
-				conn, err := net.DialTimeout(netw, addr, time.Second*2)
+				conn, err := net.DialTimeout(netw, addr, connectTimeout)
 				if err != nil {
 					return nil, err
 				}
-				conn.SetDeadline(time.Now().Add(time.Second * 2))
+				conn.SetDeadline(time.Now().Add(connectTimeout + responseTimeout))
 				return conn, nil
 			},
-			ResponseHeaderTimeout: time.Second * 2,
+			ResponseHeaderTimeout: responseTimeout,
 		},
 	}
 	return &request
@@ -67,14 +72,35 @@ func (r *HttpRequest) SetParams(params map[string]string) {
 	r.params = params
 }
 
+func (r *HttpRequest) url() string {
+	return r.backend.URL(r.api)
+}
+
+func (r *HttpRequest) setAuth(request *http.Request) {
+	if r.backend.AuthHeader != "" {
+		request.Header.Set(r.backend.AuthHeader, r.backend.AuthValue)
+	}
+}
+
+// observe 记录请求的耗时和结果，status 为0表示没有收到后台的回复
+func (r *HttpRequest) observe(start time.Time, status int) {
+	outcome := "ok"
+	if status == 0 {
+		outcome = "error"
+	} else if status != http.StatusOK {
+		outcome = "http_" + strconv.Itoa(status)
+	}
+	metrics.ObserveSince(MetricBackendRequests, start, "api", r.api, "outcome", outcome)
+}
+
 func (r *HttpRequest) DoGet() {
 	go func() {
-		if r.api == "" {
-			log.Println("http request api nil!")
+		if r.url() == "" {
+			log.Println("http request api nil!", r.api)
 			return
 		}
 		var httpAddr string
-		u, _ := url.Parse(r.api)
+		u, _ := url.Parse(r.url())
 		q := u.Query()
 		for k, v := range r.params {
 			q.Set(k, v)
@@ -88,8 +114,11 @@ func (r *HttpRequest) DoGet() {
 			return
 		}
 		request.Header.Set("Connection", "keep-alive")
+		r.setAuth(request)
+		start := time.Now()
 		response, error := r.client.Do(request)
 		if error != nil {
+			r.observe(start, 0)
 			log.Println("Do Get error:", error)
 			hr := NewHttpResponse()
 			hr.Api = r.api
@@ -104,6 +133,7 @@ func (r *HttpRequest) DoGet() {
 			}
 		}()
 		if response != nil {
+			r.observe(start, response.StatusCode)
 			if response.StatusCode == http.StatusOK {
 				body, _ := ioutil.ReadAll(response.Body)
 				hr := NewHttpResponse()
@@ -113,6 +143,13 @@ func (r *HttpRequest) DoGet() {
 				hr.StatusCode = http.StatusOK
 				json.Unmarshal(body, &hr.JsonData)
 				r.s.OnHttpRequest(hr)
+			} else {
+				log.Println("Do Get status:", response.StatusCode)
+				hr := NewHttpResponse()
+				hr.Api = r.api
+				hr.Msg = r.msg
+				hr.StatusCode = response.StatusCode
+				r.s.OnHttpRequest(hr)
 			}
 		}
 	}()
@@ -120,49 +157,52 @@ func (r *HttpRequest) DoGet() {
 
 func (r *HttpRequest) DoPost() {
 	go func() {
-		if r.api == "" {
-			log.Println("http request api nil!")
-			return
-		}
-		if r.params == nil {
-			log.Println("http request params nil")
-		}
-		p := make(url.Values)
-		for k, v := range r.params {
-			p.Set(k, v)
-		}
-		log.Println("request httpAddr:", r.api)
-		log.Println("parmas:", p)
-		request, err := http.NewRequest(echo.POST, r.api, strings.NewReader(p.Encode()))
-		if err != nil {
-			log.Println("New request Post error:", err)
-			return
-		}
-		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
-		response, error := r.client.Do(request)
-		if error != nil {
-			log.Println("Do Post error:", error)
-			hr := NewHttpResponse()
-			hr.StatusCode = 408
+		if hr := r.post(); hr != nil {
 			r.s.OnHttpRequest(hr)
-			return
-		}
-		defer func() {
-			if response != nil {
-				response.Body.Close()
-			}
-		}()
-		if response != nil {
-			if response.StatusCode == 200 {
-				body, _ := ioutil.ReadAll(response.Body)
-				hr := NewHttpResponse()
-				hr.Data = string(body)
-				hr.Api = r.api
-				hr.Msg = r.msg
-				hr.StatusCode = http.StatusOK
-				json.Unmarshal(body, &hr.JsonData)
-				r.s.OnHttpRequest(hr)
-			}
 		}
 	}()
 }
+
+// post 同步发送请求，出错时返回的 StatusCode 为 408 或服务器返回的状态码
+func (r *HttpRequest) post() *HttpResponse {
+	if r.url() == "" {
+		log.Println("http request api nil!", r.api)
+		return nil
+	}
+	if r.params == nil {
+		log.Println("http request params nil")
+	}
+	p := make(url.Values)
+	for k, v := range r.params {
+		p.Set(k, v)
+	}
+	log.Println("request httpAddr:", r.url())
+	log.Println("parmas:", p)
+	request, err := http.NewRequest(echo.POST, r.url(), strings.NewReader(p.Encode()))
+	if err != nil {
+		log.Println("New request Post error:", err)
+		return nil
+	}
+	request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	r.setAuth(request)
+	hr := NewHttpResponse()
+	hr.Api = r.api
+	hr.Msg = r.msg
+	start := time.Now()
+	response, error := r.client.Do(request)
+	if error != nil {
+		r.observe(start, 0)
+		log.Println("Do Post error:", error)
+		hr.StatusCode = 408
+		return hr
+	}
+	defer response.Body.Close()
+	r.observe(start, response.StatusCode)
+	hr.StatusCode = response.StatusCode
+	if response.StatusCode == http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		hr.Data = string(body)
+		json.Unmarshal(body, &hr.JsonData)
+	}
+	return hr
+}
@@ -1,34 +1,60 @@
 package core
 
+// 票务后台接口名，实际地址由 cfg.toml 的 [backend] 决定
 const (
-	//api = "http://172.16.10.56/gsaleapi/"
-	api                       = "http://192.168.1.6/gsaleapi/"
-	AuthorityGet              = api + "authority_list.php"
-	GameDataAdivinacionCreate = api + "gamedata_adivinacion.php"
-	GameDataAdivinacionModify = api + "14.php"
-	GameDataBangCreate        = api + "gamedata_bang.php"
-	GameDataBangModify        = api + "15.php"
-	GameDataFollowCreate      = api + "gamedata_follow.php"
-	GameDataFollowModify      = api + "16.php"
-	GameDataGreetingCreate    = api + "gamedata_greeting.php"
-	GameDataGreetingModify    = api + "17.php"
-	GameDataHighnoonCreate    = api + "gamedata_highnoon.php"
-	GameDataHighnoonModify    = api + "18.php"
-	GameDataHunterCreate      = api + "gamedata_hunter.php"
-	GameDataHunterModify      = api + "19.php"
-	GameDataMarksmanCreate    = api + "gamedata_marksman.php"
-	GameDataMarksmanModify    = api + "21.php"
-	GameDataMinerCreate       = api + "gamedata_miner.php"
-	GameDataMinerModify       = api + "22.php"
-	GameDataPrivityCreate     = api + "gamedata_privity.php"
-	GameDataPrivityModify     = api + "23.php"
-	GameDataRussianCreate     = api + "gamedata_russian.php"
-	GameDataRussianModify     = api + "24.php"
-	TicketUse                 = api + "ticket_update.php"
-	TicketCheck               = api + "ticket_game.php"
-	BoxUpload                 = api + "gamedata_hunter_box.php"
+	AuthorityGet              = "authorityGet"
+	GameDataAdivinacionCreate = "gameDataAdivinacionCreate"
+	GameDataAdivinacionModify = "gameDataAdivinacionModify"
+	GameDataBangCreate        = "gameDataBangCreate"
+	GameDataBangModify        = "gameDataBangModify"
+	GameDataFollowCreate      = "gameDataFollowCreate"
+	GameDataFollowModify      = "gameDataFollowModify"
+	GameDataGreetingCreate    = "gameDataGreetingCreate"
+	GameDataGreetingModify    = "gameDataGreetingModify"
+	GameDataHighnoonCreate    = "gameDataHighnoonCreate"
+	GameDataHighnoonModify    = "gameDataHighnoonModify"
+	GameDataHunterCreate      = "gameDataHunterCreate"
+	GameDataHunterModify      = "gameDataHunterModify"
+	GameDataMarksmanCreate    = "gameDataMarksmanCreate"
+	GameDataMarksmanModify    = "gameDataMarksmanModify"
+	GameDataMinerCreate       = "gameDataMinerCreate"
+	GameDataMinerModify       = "gameDataMinerModify"
+	GameDataPrivityCreate     = "gameDataPrivityCreate"
+	GameDataPrivityModify     = "gameDataPrivityModify"
+	GameDataRussianCreate     = "gameDataRussianCreate"
+	GameDataRussianModify     = "gameDataRussianModify"
+	TicketUse                 = "ticketUse"
+	TicketCheck               = "ticketCheck"
+	BoxUpload                 = "boxUpload"
 )
 
+var defaultBackendEndpoints = map[string]string{
+	AuthorityGet:              "authority_list.php",
+	GameDataAdivinacionCreate: "gamedata_adivinacion.php",
+	GameDataAdivinacionModify: "14.php",
+	GameDataBangCreate:        "gamedata_bang.php",
+	GameDataBangModify:        "15.php",
+	GameDataFollowCreate:      "gamedata_follow.php",
+	GameDataFollowModify:      "16.php",
+	GameDataGreetingCreate:    "gamedata_greeting.php",
+	GameDataGreetingModify:    "17.php",
+	GameDataHighnoonCreate:    "gamedata_highnoon.php",
+	GameDataHighnoonModify:    "18.php",
+	GameDataHunterCreate:      "gamedata_hunter.php",
+	GameDataHunterModify:      "19.php",
+	GameDataMarksmanCreate:    "gamedata_marksman.php",
+	GameDataMarksmanModify:    "21.php",
+	GameDataMinerCreate:       "gamedata_miner.php",
+	GameDataMinerModify:       "22.php",
+	GameDataPrivityCreate:     "gamedata_privity.php",
+	GameDataPrivityModify:     "23.php",
+	GameDataRussianCreate:     "gamedata_russian.php",
+	GameDataRussianModify:     "24.php",
+	TicketUse:                 "ticket_update.php",
+	TicketCheck:               "ticket_game.php",
+	BoxUpload:                 "gamedata_hunter_box.php",
+}
+
 type HttpResponse struct {
 	Data       string
 	JsonData   map[string]interface{}
@@ -56,9 +82,7 @@ func (res *HttpResponse) Set(key string, value interface{}) {
 	res.JsonData[key] = value
 }
 
+// GetStr 与 InboxMessage.GetStr 相同，后台返回数字时不会panic
 func (res *HttpResponse) GetStr(key string) string {
-	if v, ok := res.JsonData[key]; ok {
-		return v.(string)
-	}
-	return ""
+	return toStr(res.JsonData[key])
 }
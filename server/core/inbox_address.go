@@ -8,11 +8,15 @@ type InboxAddressType int
 
 const (
 	InboxAddressTypeUnknown           = 0
-	InboxAddressTypeAdminDevice       = 1 // 管理员屏幕
-	InboxAddressTypeGameArduinoDevice = 2 // 游戏 Arduino
-	InboxAddressTypeBoxArduinoDevice  = 3 // 箱子 Arduino
-	InboxAddressTypeNightArduino      = 4 // 垃圾桶 arduino
-	InboxAddressTypeDjArduino         = 5 // dj台 arduino
+	InboxAddressTypeAdminDevice       = 1  // 管理员屏幕
+	InboxAddressTypeGameArduinoDevice = 2  // 游戏 Arduino
+	InboxAddressTypeBoxArduinoDevice  = 3  // 箱子 Arduino
+	InboxAddressTypeNightArduino      = 4  // 垃圾桶 arduino
+	InboxAddressTypeDjArduino         = 5  // dj台 arduino
+	InboxAddressTypeMainArduinoDevice = 6  // 激光房间主控 arduino，ID 即按钮ID
+	InboxAddressTypeQueueDevice       = 8  // 排队屏幕
+	InboxAddressTypeIngameDevice      = 9  // 游戏中屏幕
+	InboxAddressTypeSimulatorDevice   = 10 // 网页模拟器玩家
 )
 
 func (t InboxAddressType) IsArduinoControllerType() bool {
@@ -3,6 +3,7 @@ package core
 import (
 	"bufio"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net"
@@ -11,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"challenger/server/protocol"
 	"golang.org/x/net/websocket"
 )
 
@@ -31,11 +33,13 @@ type InboxTcpConnection struct {
 	id      string
 	ch      chan []byte
 	closeCh chan struct{}
+	l       *sync.RWMutex // id 只在读取的goroutine中修改，Accept 在发送消息的goroutine中读取
 }
 
 func NewInboxTcpConnection(conn *net.TCPConn) *InboxTcpConnection {
 	tcp := InboxTcpConnection{conn: conn}
 	tcp.r = bufio.NewReader(conn)
+	tcp.l = new(sync.RWMutex)
 	tcp.ch = make(chan []byte, 1000)
 	tcp.closeCh = make(chan struct{})
 	go tcp.doWrite()
@@ -79,7 +83,14 @@ func (tcp *InboxTcpConnection) ReadJSON(v *InboxMessage) error {
 	if b[0] == 123 { // first byte is '{', json encoding frame
 		json.Unmarshal(b[:len(b)-1], &v.Data)
 	} else { // parse heart beat frame
-		parseTcpHB(string(b[:len(b)-1]), v)
+		f, err := protocol.ParseFrame(string(b[:len(b)-1]))
+		if err != nil {
+			log.Println("malformed frame from", tcp.id, ":", err.Error())
+			return nil
+		}
+		for k, value := range f {
+			v.Set(k, value)
+		}
 		//v.SetCmd("hb")
 		infoType := v.GetStr("TYPE")
 		if infoType != "" {
@@ -94,7 +105,9 @@ func (tcp *InboxTcpConnection) ReadJSON(v *InboxMessage) error {
 			if tcp.id != "" {
 				v.RemoveAddress = &InboxAddress{at(tcp.id), tcp.id}
 			}
+			tcp.l.Lock()
 			tcp.id = id
+			tcp.l.Unlock()
 		}
 	}
 	return nil
@@ -113,21 +126,12 @@ func at(id string) InboxAddressType {
 		return InboxAddressTypeDjArduino
 	} else if strings.HasPrefix(id, "A") {
 		return InboxAddressTypeAdminDevice
+	} else if strings.HasPrefix(id, "M") {
+		return InboxAddressTypeMainArduinoDevice
 	}
 	return InboxAddressTypeUnknown
 }
 
-// Tcp HB format is [key1]value1[key2]value2
-func parseTcpHB(hb string, v *InboxMessage) {
-	kvs := strings.Split(hb, "[")
-	for _, s := range kvs {
-		kv := strings.Split(s, "]")
-		if len(kv) == 2 {
-			v.Set(kv[0], kv[1])
-		}
-	}
-}
-
 func (tcp *InboxTcpConnection) WriteJSON(v *InboxMessage) error {
 	b, e := v.Marshal()
 	if e != nil {
@@ -143,6 +147,11 @@ func (tcp *InboxTcpConnection) WriteJSON(v *InboxMessage) error {
 	select {
 	case tcp.ch <- buf:
 	default:
+		tcp.l.RLock()
+		id := tcp.id
+		tcp.l.RUnlock()
+		log.Println("tcp write queue full, drop message to", id, ":", string(b))
+		metrics.Inc(MetricTcpWriteDrops, "device", id)
 	}
 	return nil
 }
@@ -165,10 +174,13 @@ func (tcp *InboxTcpConnection) doWrite() {
 }
 
 func (tcp *InboxTcpConnection) Accept(addr InboxAddress) bool {
-	if addr.Type != at(tcp.id) {
+	tcp.l.RLock()
+	id := tcp.id
+	tcp.l.RUnlock()
+	if addr.Type != at(id) {
 		return false
 	}
-	return addr.ID == "" || addr.ID == tcp.id
+	return addr.ID == "" || addr.ID == id
 }
 
 type InboxWsConnection struct {
@@ -197,18 +209,20 @@ func (ws *InboxWsConnection) ReadJSON(v *InboxMessage) error {
 		return e
 	}
 	if v.GetCmd() == "init" {
-		tt, _ := strconv.Atoi(v.Get("TYPE").(string))
+		// 网页发送的 TYPE 是字符串，iOS 端发送的是数字
+		tt, _ := strconv.Atoi(fmt.Sprint(v.Get("TYPE")))
 		t := InboxAddressType(tt)
 		id := v.GetStr("ID")
 		oldid, oldt := ws.getAddressInfo()
-		if oldid != id {
+		if oldid != id || oldt != t {
 			v.AddAddress = &InboxAddress{t, id}
-			v.Address = v.AddAddress
 			if oldid != "" {
 				v.RemoveAddress = &InboxAddress{oldt, oldid}
 			}
 			ws.setAddressInfo(id, t)
 		}
+		// 重复发送 init 时也需要回复，客户端据此重新获取状态
+		v.Address = &InboxAddress{t, id}
 	} else {
 		id, t := ws.getAddressInfo()
 		if id != "" {
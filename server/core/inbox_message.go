@@ -36,11 +36,12 @@ func (message *InboxMessage) Set(key string, value interface{}) {
 	message.Data[key] = value
 }
 
+// GetStr 数字和bool转换为字符串，其他类型返回空字符串
 func (message *InboxMessage) GetStr(key string) string {
-	if v, ok := message.Data[key]; ok {
-		return v.(string)
+	if message == nil {
+		return ""
 	}
-	return ""
+	return toStr(message.Data[key])
 }
 
 func (message *InboxMessage) GetCmd() string {
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = log.Printf
+
+// LaserMatch 激光房间的一局游戏，主控 arduino 上报的按钮和碰激光交给 MatchEngine 计分
+// 亮灭变化的按钮通知对应的主控，状态每 100ms 推送给游戏中屏幕和管理端
+type LaserMatch struct {
+	srv    *Srv
+	engine *MatchEngine
+
+	ID     int
+	TeamID string
+	ids    []string // 玩家的 ExternalID，与 engine.Players 顺序一致，可以为空
+
+	msgCh   chan *InboxMessage
+	closeCh chan bool
+}
+
+func NewLaserMatch(s *Srv, id int, mode string, cids []string, ids []string, teamId string) *LaserMatch {
+	m := LaserMatch{}
+	m.srv = s
+	m.ID = id
+	m.TeamID = teamId
+	m.ids = ids
+	m.engine = NewMatchEngine(mode, cids)
+	m.msgCh = make(chan *InboxMessage, 1000)
+	m.closeCh = make(chan bool)
+	log.Println("laser match:", id, "mode:", mode, "players:", cids)
+	return &m
+}
+
+// Run 在单独的 goroutine 中运行，只能通过 srv.onMatchEvent 通知主循环，不能直接修改 Srv
+func (m *LaserMatch) Run() {
+	dt := 10 * time.Millisecond
+	ticker := time.NewTicker(dt)
+	defer ticker.Stop()
+	defer close(m.closeCh)
+	lastUpdate := time.Now()
+	for {
+		<-ticker.C
+		m.handleInputs()
+		m.engine.Tick(dt.Seconds())
+		m.sendButtons()
+		m.sendLasers()
+		if m.engine.Done() {
+			result := m.result()
+			m.srv.sendMsgs("matchStop", matchStopData(m.ID, result), InboxAddressTypeIngameDevice, InboxAddressTypeAdminDevice, InboxAddressTypeQueueDevice)
+			log.Println("laser match:", m.ID, "stop! gold:", result.Gold, "elasped:", result.Elasped, "grade:", result.Grade)
+			m.srv.onMatchEvent(MatchEvent{Type: MatchEventTypeLaserEnd, ID: uint(m.ID), Data: result})
+			return
+		}
+		if time.Since(lastUpdate) >= matchUpdateInterval {
+			lastUpdate = time.Now()
+			m.sendUpdate()
+		}
+	}
+}
+
+func (m *LaserMatch) OnMatchCmdArrived(cmd *InboxMessage) {
+	go func() {
+		select {
+		case m.msgCh <- cmd:
+		case <-m.closeCh:
+		}
+	}()
+}
+
+func (m *LaserMatch) handleInputs() {
+	for {
+		select {
+		case msg := <-m.msgCh:
+			m.handleInput(msg)
+		default:
+			return
+		}
+	}
+}
+
+// handleInput 主循环转发的 buttonPress、laserHit 和 stopMatch，PLAYER 从1开始
+func (m *LaserMatch) handleInput(msg *InboxMessage) {
+	player, _ := strconv.Atoi(msg.GetStr("PLAYER"))
+	switch msg.GetCmd() {
+	case "buttonPress":
+		level, _ := strconv.Atoi(msg.GetStr("LV"))
+		if !m.engine.Press(player-1, msg.GetStr("ID"), level) {
+			log.Println("laser match: ignore button", msg.GetStr("ID"), "of player:", player)
+		}
+	case "laserHit":
+		m.engine.Hit(player - 1)
+	case "stopMatch":
+		m.engine.Stop()
+	}
+}
+
+// result 结束后的成绩，加上队伍和玩家的 ExternalID，用于写入数据库
+// 记录的 ID 与 matchStop 中的 matchID 相同，结算屏幕可以直接用它查询
+func (m *LaserMatch) result() *MatchData {
+	result := m.engine.Result()
+	result.ID = uint(m.ID)
+	result.TeamID = m.TeamID
+	for i := range result.Players {
+		if i < len(m.ids) {
+			result.Players[i].ExternalID = m.ids[i]
+		}
+	}
+	return result
+}
+
+// sendButtons 通知主控按钮亮灭，status 1 亮 0 灭
+func (m *LaserMatch) sendButtons() {
+	for id, on := range m.engine.TakeButtonChanges() {
+		msg := NewInboxMessage()
+		msg.SetCmd("btn_ctrl")
+		if on {
+			msg.Set("status", "1")
+		} else {
+			msg.Set("status", "0")
+		}
+		m.srv.sendToOne(msg, InboxAddress{InboxAddressTypeMainArduinoDevice, id})
+	}
+}
+
+// sendLasers 热身时按 warmup.toml 的图案控制所有主控的激光，10路的主控使用 Large，5路的使用 Small
+func (m *LaserMatch) sendLasers() {
+	for _, l := range m.engine.TakeLaserChanges() {
+		for _, info := range GetOptions().MainArduinoInfo {
+			pattern := l.Small[:]
+			if info.LaserNum == len(l.Large) {
+				pattern = l.Large[:]
+			}
+			lasers := make([]map[string]string, len(pattern))
+			for i, s := range pattern {
+				lasers[i] = map[string]string{"laser_n": strconv.Itoa(i), "laser_s": strconv.Itoa(s)}
+			}
+			msg := NewInboxMessage()
+			msg.SetCmd("laser_ctrl")
+			msg.Set("laser", lasers)
+			m.srv.sendToOne(msg, InboxAddress{InboxAddressTypeMainArduinoDevice, info.ID})
+		}
+	}
+}
+
+// sendUpdate 格式与模拟器相同，member 中只有成绩，teamID 给排队屏幕显示
+func (m *LaserMatch) sendUpdate() {
+	data := struct {
+		*MatchEngine
+		ID     int            `json:"id"`
+		TeamID string         `json:"teamID"`
+		Member []*MatchPlayer `json:"member"`
+	}{m.engine, m.ID, m.TeamID, m.engine.Players}
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Println("marshal match error:", err.Error())
+		return
+	}
+	m.srv.sendMsgs("updateMatch", string(b), InboxAddressTypeIngameDevice, InboxAddressTypeAdminDevice, InboxAddressTypeQueueDevice)
+}
+
+// matchStopData matchStop 消息的 data，格式与网页端 board.jsx 一致
+func matchStopData(id int, result *MatchData) map[string]interface{} {
+	member := make([]map[string]interface{}, len(result.Players))
+	for i, p := range result.Players {
+		member[i] = map[string]interface{}{
+			"cid":       p.Name,
+			"name":      p.Name,
+			"gold":      p.Gold,
+			"lostGold":  p.LostGold,
+			"energy":    p.Energy,
+			"combo":     p.Combo,
+			"grade":     p.Grade,
+			"levelData": p.LevelData,
+			"hitCount":  p.HitCount,
+		}
+	}
+	return map[string]interface{}{
+		"matchID": id,
+		"matchData": map[string]interface{}{
+			"mode":         result.Mode,
+			"member":       member,
+			"gold":         result.Gold,
+			"elasped":      result.Elasped,
+			"rampageCount": result.RampageCount,
+			"grade":        result.Grade,
+		},
+	}
+}
+
+// startLaserMatch 管理端开始激光房间的一局游戏，players 为玩家名，顺序与主控上报的 PLAYER 一致
+// ids 为玩家的 ExternalID，不为空时数量必须和 players 相同，teamId 可以为空
+func (s *Srv) startLaserMatch(mode string, players []string, ids []string, teamId string) error {
+	if s.laserMatch != nil {
+		return errors.New("laser match " + strconv.Itoa(s.laserMatch.ID) + " is going")
+	}
+	if mode != MatchModeGold && mode != MatchModeSurvival {
+		return errors.New("mode must be g or s")
+	}
+	if len(players) < 1 || len(players) > loginMaxPlayers {
+		return errors.New("players must be 1-" + strconv.Itoa(loginMaxPlayers))
+	}
+	if len(ids) > 0 && len(ids) != len(players) {
+		return errors.New("ids must match players")
+	}
+	s.laserMatchId++
+	s.laserMatch = NewLaserMatch(s, s.laserMatchId, mode, players, ids, teamId)
+	go s.laserMatch.Run()
+	return nil
+}
+
+func (s *Srv) stopLaserMatch() error {
+	if s.laserMatch == nil {
+		return errors.New("no laser match")
+	}
+	msg := NewInboxMessage()
+	msg.SetCmd("stopMatch")
+	s.laserMatch.OnMatchCmdArrived(msg)
+	return nil
+}
+
+// splitPlayers 逗号分隔的玩家名或 ExternalID
+func splitPlayers(players string) []string {
+	ret := make([]string, 0)
+	for _, p := range strings.Split(players, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+// forwardLaserMatch 主控的上报转发给正在进行的一局，没有进行中的游戏时丢弃
+func (s *Srv) forwardLaserMatch(cmd string, msg *InboxMessage) {
+	if s.laserMatch == nil {
+		log.Println("no laser match, ignore", cmd, "from", msg.GetStr("ID"))
+		return
+	}
+	fwd := NewInboxMessage()
+	fwd.SetCmd(cmd)
+	fwd.Set("ID", msg.GetStr("ID"))
+	fwd.Set("PLAYER", msg.GetStr("PLAYER"))
+	fwd.Set("LV", msg.GetStr("LV"))
+	s.laserMatch.OnMatchCmdArrived(fwd)
+}
@@ -2,7 +2,6 @@ package core
 
 import (
 	"log"
-	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +11,12 @@ var _ = log.Printf
 
 type MatchEventType int
 
+const (
+	MatchEventTypeEnd          MatchEventType = iota + 1 // Data 为结束的 *Match
+	MatchEventTypeSimulatorEnd                           // Data 为结束的 *Simulator
+	MatchEventTypeLaserEnd                               // ID 为激光房间的一局，Data 为成绩 *MatchData
+)
+
 const (
 	EventToDay = iota + 1
 	EventToNight
@@ -32,53 +37,67 @@ type Match struct {
 	opt *MatchOptions
 	srv *Srv
 
-	Event   int
-	IsGoing bool
+	Event    int
+	ShowName string
+	IsGoing  bool
 
-	LapseTime   float64
-	TotalStep   int
-	CurrentStep int
-	CurrentBgm  int
+	CurrentBgm int
+
+	player *ShowPlayer
 
 	msgCh   chan *InboxMessage
 	closeCh chan bool
 }
 
+// 每个DJ事件对应 shows.toml 中的一个 show
+var eventShows = map[int]string{
+	EventToDay:          "toDay",
+	EventToNight:        "toNight",
+	EventChallengeBilly: "challengeBilly",
+	EventRecoverDay:     "recoverDay",
+	EventRecoverNight:   "recoverNight",
+	EventRobBar:         "robBar",
+	CancleRobBar:        "cancleRobBar",
+}
+
 func NewMatch(s *Srv, event int) *Match {
+	m := newShowMatch(s, eventShows[event])
+	m.Event = event
+	log.Println("Event:", event, " has been ready!")
+	return m
+}
+
+func newShowMatch(s *Srv, showName string) *Match {
 	m := Match{}
 	m.CurrentBgm = 0
 	m.srv = s
 	m.opt = GetOptions()
-	m.Event = event
+	m.ShowName = showName
 	m.IsGoing = true
-	m.LapseTime = 0
-	m.TotalStep = 8
-	m.CurrentStep = 0
 	m.msgCh = make(chan *InboxMessage, 1000)
 	m.closeCh = make(chan bool)
-	log.Println("Event:", event, " has been ready!")
 	return &m
-
 }
 
+// Run 在单独的 goroutine 中运行，只能通过 srv.onMatchEvent 通知主循环，不能直接修改 Srv
 func (m *Match) Run() {
 	dt := 10 * time.Millisecond
-	tickChan := time.Tick(dt)
+	ticker := time.NewTicker(dt)
+	defer ticker.Stop()
+	//关闭后 OnMatchCmdArrived 中等待的 goroutine 可以退出
+	defer close(m.closeCh)
 	for {
-		<-tickChan
+		<-ticker.C
 		m.handleInputs()
 		m.tick(dt)
 		if !m.IsGoing {
-			break
+			log.Println("event stop!")
+			m.srv.onMatchEvent(MatchEvent{Type: MatchEventTypeEnd, Data: m})
+			return
 		}
 	}
 }
 
-func (m *Match) Stop() {
-	m.IsGoing = false
-	log.Println("event stop!")
-}
-
 func (m *Match) OnMatchCmdArrived(cmd *InboxMessage) {
 	go func() {
 		select {
@@ -102,6 +121,20 @@ func (m *Match) handleInputs() bool {
 }
 
 func (m *Match) handleInput(msg *InboxMessage) { //处理arduino的信息，来改变服务器变量
+	if m.player == nil {
+		return
+	}
+	switch msg.GetCmd() {
+	case "showPause":
+		m.player.Pause()
+		log.Println("show:", m.ShowName, "paused")
+	case "showResume":
+		m.player.Resume()
+		log.Println("show:", m.ShowName, "resumed")
+	case "showAbort":
+		m.player.Abort()
+		log.Println("show:", m.ShowName, "aborted")
+	}
 }
 
 func (m *Match) setStage(s string) {
@@ -109,464 +142,21 @@ func (m *Match) setStage(s string) {
 }
 
 func (m *Match) tick(dt time.Duration) {
-	sec := dt.Seconds()
-	switch m.Event {
-	case CancleRobBar:
-		addr := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-6-5"}
-		sendMsg := NewInboxMessage()
-		sendMsg.SetCmd("reset")
-		m.srv.sendToOne(sendMsg, addr)
-		m.srv.stopMatch()
-	case EventRobBar:
-		addr := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-6-5"}
-		sendMsg := NewInboxMessage()
-		sendMsg.SetCmd("loot")
-		m.srv.sendToOne(sendMsg, addr)
-		m.srv.stopMatch()
-	case EventChallengeBilly:
-		addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-		sendMsg := NewInboxMessage()
-		sendMsg.SetCmd("mp3_ctrl")
-		mp3 := make([]map[string]string, 0)
-		mp3 = append(mp3,
-			map[string]string{"mp3_n": "0", "music": "12"},
-		)
-		sendMsg.Set("mp3", mp3)
-		m.srv.sendToOne(sendMsg, addr)
-		m.srv.stopMatch()
-	case EventToDay:
-		m.LapseTime = math.Max(m.LapseTime-sec, 0)
-		if m.LapseTime == 0 {
-			log.Println("current Step:", m.CurrentStep)
-			switch m.CurrentStep {
-			case 0:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("mp3_ctrl")
-				mp3 := make([]map[string]string, 0)
-				mp3 = append(mp3,
-					map[string]string{"mp3_n": "0", "music": "8"},
-				)
-				sendMsg.Set("mp3", mp3)
-				m.srv.sendToOne(sendMsg, addr)
-
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("led_ctrl")
-				led := make([]map[string]string, 0)
-				led = append(led,
-					map[string]string{"led_n": "0", "mode": "0"},
-				)
-				sendMsg1.Set("led", led)
-				m.srv.sends(sendMsg1, InboxAddressTypeNightArduino)
-			case 1:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "0", "light_s": "1"},
-					map[string]string{"light_n": "10", "light_s": "1"},
-					map[string]string{"light_n": "11", "light_s": "1"},
-					map[string]string{"light_n": "12", "light_s": "1"},
-					map[string]string{"light_n": "19", "light_s": "1"},
-					map[string]string{"light_n": "21", "light_s": "1"},
-					map[string]string{"light_n": "22", "light_s": "1"},
-					map[string]string{"light_n": "23", "light_s": "1"},
-					map[string]string{"light_n": "25", "light_s": "1"},
-					map[string]string{"light_n": "27", "light_s": "1"},
-					map[string]string{"light_n": "28", "light_s": "1"},
-					map[string]string{"light_n": "41", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-7-2"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "1"},
-					map[string]string{"light_n": "1", "light_s": "1"},
-					map[string]string{"light_n": "2", "light_s": "1"},
-					map[string]string{"light_n": "3", "light_s": "1"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 2:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "3", "light_s": "1"},
-					map[string]string{"light_n": "30", "light_s": "1"},
-					map[string]string{"light_n": "42", "light_s": "1"},
-					map[string]string{"light_n": "46", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-			case 3:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "4", "light_s": "1"},
-					map[string]string{"light_n": "6", "light_s": "1"},
-					map[string]string{"light_n": "8", "light_s": "1"},
-					map[string]string{"light_n": "9", "light_s": "1"},
-					map[string]string{"light_n": "16", "light_s": "1"},
-					map[string]string{"light_n": "43", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-4-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "1"},
-					map[string]string{"light_n": "1", "light_s": "1"},
-					map[string]string{"light_n": "2", "light_s": "1"},
-					map[string]string{"light_n": "3", "light_s": "1"},
-					map[string]string{"light_n": "4", "light_s": "1"},
-					map[string]string{"light_n": "5", "light_s": "1"},
-					map[string]string{"light_n": "9", "light_s": "1"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 4:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "17", "light_s": "1"},
-					map[string]string{"light_n": "18", "light_s": "1"},
-					map[string]string{"light_n": "35", "light_s": "1"},
-					map[string]string{"light_n": "36", "light_s": "1"},
-					map[string]string{"light_n": "39", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-2-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "2", "light_s": "1"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 5:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "13", "light_s": "1"},
-					map[string]string{"light_n": "15", "light_s": "1"},
-					map[string]string{"light_n": "31", "light_s": "1"},
-					map[string]string{"light_n": "38", "light_s": "1"},
-					map[string]string{"light_n": "40", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-2-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "1"},
-					map[string]string{"light_n": "1", "light_s": "1"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-
-				addr2 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-1-1"}
-				sendMsg2 := NewInboxMessage()
-				sendMsg2.SetCmd("light_ctrl")
-				lights2 := make([]map[string]string, 0)
-				lights2 = append(lights2,
-					map[string]string{"light_n": "2", "light_s": "1"},
-					map[string]string{"light_n": "3", "light_s": "1"},
-					map[string]string{"light_n": "4", "light_s": "1"},
-					map[string]string{"light_n": "5", "light_s": "1"},
-					map[string]string{"light_n": "9", "light_s": "1"},
-				)
-				sendMsg2.Set("light", lights2)
-				m.srv.sendToOne(sendMsg2, addr2)
-			case 6:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "14", "light_s": "1"},
-					map[string]string{"light_n": "24", "light_s": "1"},
-					map[string]string{"light_n": "34", "light_s": "1"},
-					map[string]string{"light_n": "45", "light_s": "1"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-1-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "1"},
-					map[string]string{"light_n": "1", "light_s": "1"},
-					map[string]string{"light_n": "6", "light_s": "1"},
-					map[string]string{"light_n": "8", "light_s": "1"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-
-				addr2 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-9-1"}
-				sendMsg2 := NewInboxMessage()
-				sendMsg2.SetCmd("light_ctrl")
-				lights2 := make([]map[string]string, 0)
-				lights2 = append(lights2,
-					map[string]string{"light_n": "0", "light_s": "1"},
-				)
-				sendMsg2.Set("light", lights2)
-				m.srv.sendToOne(sendMsg2, addr2)
-				m.srv.stopMatch()
-			}
-			m.LapseTime = GetOptions().LapseTime
-			m.CurrentStep++
-		}
-	case EventToNight:
-		m.LapseTime = math.Max(m.LapseTime-sec, 0)
-		if m.LapseTime == 0 {
-			switch m.CurrentStep {
-			case 0:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("mp3_ctrl")
-				mp3 := make([]map[string]string, 0)
-				mp3 = append(mp3,
-					map[string]string{"mp3_n": "0", "music": "10"},
-				)
-				sendMsg.Set("mp3", mp3)
-				m.srv.sendToOne(sendMsg, addr)
-
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("led_ctrl")
-				led := make([]map[string]string, 0)
-				led = append(led,
-					map[string]string{"led_n": "0", "mode": "1"},
-				)
-				sendMsg1.Set("led", led)
-				m.srv.sends(sendMsg1, InboxAddressTypeNightArduino)
-			case 1:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "0", "light_s": "0"},
-					map[string]string{"light_n": "10", "light_s": "0"},
-					map[string]string{"light_n": "11", "light_s": "0"},
-					map[string]string{"light_n": "12", "light_s": "0"},
-					map[string]string{"light_n": "19", "light_s": "0"},
-					map[string]string{"light_n": "21", "light_s": "0"},
-					map[string]string{"light_n": "22", "light_s": "0"},
-					map[string]string{"light_n": "23", "light_s": "0"},
-					map[string]string{"light_n": "25", "light_s": "0"},
-					map[string]string{"light_n": "27", "light_s": "0"},
-					map[string]string{"light_n": "28", "light_s": "0"},
-					map[string]string{"light_n": "41", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-7-2"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "0"},
-					map[string]string{"light_n": "1", "light_s": "0"},
-					map[string]string{"light_n": "2", "light_s": "0"},
-					map[string]string{"light_n": "3", "light_s": "0"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 2:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "3", "light_s": "0"},
-					map[string]string{"light_n": "30", "light_s": "0"},
-					map[string]string{"light_n": "42", "light_s": "0"},
-					map[string]string{"light_n": "46", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-			case 3:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "4", "light_s": "0"},
-					map[string]string{"light_n": "6", "light_s": "0"},
-					map[string]string{"light_n": "8", "light_s": "0"},
-					map[string]string{"light_n": "9", "light_s": "0"},
-					map[string]string{"light_n": "16", "light_s": "0"},
-					map[string]string{"light_n": "43", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-4-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "0"},
-					map[string]string{"light_n": "1", "light_s": "0"},
-					map[string]string{"light_n": "2", "light_s": "0"},
-					map[string]string{"light_n": "3", "light_s": "0"},
-					map[string]string{"light_n": "4", "light_s": "0"},
-					map[string]string{"light_n": "5", "light_s": "0"},
-					map[string]string{"light_n": "9", "light_s": "0"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 4:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "17", "light_s": "0"},
-					map[string]string{"light_n": "18", "light_s": "0"},
-					map[string]string{"light_n": "35", "light_s": "0"},
-					map[string]string{"light_n": "36", "light_s": "0"},
-					map[string]string{"light_n": "39", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-2-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "2", "light_s": "0"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-			case 5:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "13", "light_s": "0"},
-					map[string]string{"light_n": "15", "light_s": "0"},
-					map[string]string{"light_n": "31", "light_s": "0"},
-					map[string]string{"light_n": "38", "light_s": "0"},
-					map[string]string{"light_n": "40", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-2-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "0"},
-					map[string]string{"light_n": "1", "light_s": "0"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-
-				addr2 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-1-1"}
-				sendMsg2 := NewInboxMessage()
-				sendMsg2.SetCmd("light_ctrl")
-				lights2 := make([]map[string]string, 0)
-				lights2 = append(lights2,
-					map[string]string{"light_n": "2", "light_s": "0"},
-					map[string]string{"light_n": "3", "light_s": "0"},
-					map[string]string{"light_n": "4", "light_s": "0"},
-					map[string]string{"light_n": "5", "light_s": "0"},
-					map[string]string{"light_n": "9", "light_s": "0"},
-				)
-				sendMsg2.Set("light", lights2)
-				m.srv.sendToOne(sendMsg2, addr2)
-			case 6:
-				addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-				sendMsg := NewInboxMessage()
-				sendMsg.SetCmd("light_ctrl")
-				lights := make([]map[string]string, 0)
-				lights = append(lights,
-					map[string]string{"light_n": "14", "light_s": "0"},
-					map[string]string{"light_n": "24", "light_s": "0"},
-					map[string]string{"light_n": "34", "light_s": "0"},
-					map[string]string{"light_n": "45", "light_s": "0"},
-				)
-				sendMsg.Set("light", lights)
-				m.srv.sendToOne(sendMsg, addr)
-
-				addr1 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-1-1"}
-				sendMsg1 := NewInboxMessage()
-				sendMsg1.SetCmd("light_ctrl")
-				lights1 := make([]map[string]string, 0)
-				lights1 = append(lights1,
-					map[string]string{"light_n": "0", "light_s": "0"},
-					map[string]string{"light_n": "1", "light_s": "0"},
-					map[string]string{"light_n": "6", "light_s": "0"},
-					map[string]string{"light_n": "8", "light_s": "0"},
-				)
-				sendMsg1.Set("light", lights1)
-				m.srv.sendToOne(sendMsg1, addr1)
-
-				addr2 := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-9-1"}
-				sendMsg2 := NewInboxMessage()
-				sendMsg2.SetCmd("light_ctrl")
-				lights2 := make([]map[string]string, 0)
-				lights2 = append(lights2,
-					map[string]string{"light_n": "0", "light_s": "0"},
-				)
-				sendMsg2.Set("light", lights2)
-				m.srv.sendToOne(sendMsg2, addr2)
-				m.srv.stopMatch()
-			}
-			m.LapseTime = GetOptions().LapseTime
-			m.CurrentStep++
+	if m.player == nil {
+		show := GetShow(m.ShowName)
+		if show == nil {
+			log.Println("show not found:", m.ShowName)
+			m.IsGoing = false
+			return
 		}
-	case EventRecoverDay:
-		addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-		sendMsg := NewInboxMessage()
-		sendMsg.SetCmd("mp3_ctrl")
-		mp3 := make([]map[string]string, 0)
-		mp3 = append(mp3,
-			map[string]string{"mp3_n": "0", "music": "9"},
-		)
-		sendMsg.Set("mp3", mp3)
-		m.srv.sendToOne(sendMsg, addr)
-		m.srv.stopMatch()
-	case EventRecoverNight:
-		addr := InboxAddress{InboxAddressTypeDjArduino, "D-1"}
-		sendMsg := NewInboxMessage()
-		sendMsg.SetCmd("mp3_ctrl")
-		mp3 := make([]map[string]string, 0)
-		mp3 = append(mp3,
-			map[string]string{"mp3_n": "0", "music": "11"},
-		)
-		sendMsg.Set("mp3", mp3)
-		m.srv.sendToOne(sendMsg, addr)
-		m.srv.stopMatch()
+		m.player = NewShowPlayer(show)
+	}
+	for _, cue := range m.player.Tick(dt.Seconds()) {
+		m.srv.sendToOne(cue.message(), cue.address())
+	}
+	if m.player.Done() {
+		log.Println("show:", m.ShowName, "done!")
+		m.IsGoing = false
 	}
 }
 
@@ -594,6 +184,8 @@ func att(id string) InboxAddressType {
 		return InboxAddressTypeBoxArduinoDevice
 	} else if strings.HasPrefix(id, "D") {
 		return InboxAddressTypeDjArduino
+	} else if strings.HasPrefix(id, "M") {
+		return InboxAddressTypeMainArduinoDevice
 	}
 	return InboxAddressTypeUnknown
 }
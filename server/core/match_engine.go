@@ -0,0 +1,360 @@
+package core
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+var _ = log.Printf
+
+const (
+	MatchModeGold     = RankModeGold     // 赏金模式，限时内拿到尽量多的金币
+	MatchModeSurvival = RankModeSurvival // 生存模式，金币随时间减少，坚持尽量长的时间
+)
+
+const (
+	MatchStageWarmup  = "warmup"  // 热身，按钮逐渐亮起，激光按 warmup.toml 表演，不计分
+	MatchStageOngoing = "ongoing" // 正式游戏
+)
+
+// MatchPlayer 一局激光游戏中一个玩家的成绩
+type MatchPlayer struct {
+	Cid       string  `json:"cid"`
+	Gold      int     `json:"gold"`
+	LostGold  int     `json:"lostGold"`
+	Energy    float64 `json:"energy"`
+	Combo     int     `json:"combo"`
+	MaxCombo  int     `json:"maxCombo"`
+	HitCount  int     `json:"hitCount"`
+	LevelData [4]int  `json:"levelData"` // 各个档位按下按钮的次数
+	lastPress float64 // 上次按按钮的时间，小于0表示还没有按过
+	lastHit   float64 // 上次碰到激光的时间，小于0表示还没有碰过
+}
+
+// MatchEngine 按 cfg.toml 中的规则计算一局激光游戏的金币、能量、连击和暴走
+// 输入是主控 arduino 上报的按钮和碰激光，或者模拟器中虚拟玩家的操作，只能在一个 goroutine 中使用
+type MatchEngine struct {
+	opt *MatchOptions
+
+	Mode           string          `json:"mode"`
+	Stage          string          `json:"stage"`
+	WarmupTime     float64         `json:"warmupTime"` // 热身剩余时间
+	Players        []*MatchPlayer  `json:"-"`
+	OnButtons      map[string]bool `json:"onButtons"`
+	RampageTime    float64         `json:"rampageTime"` // 暴走剩余时间
+	MaxRampageTime float64         `json:"maxRampageTime"`
+	TotalTime      float64         `json:"totalTime"` // 赏金模式剩余时间
+	Elasped        float64         `json:"elasped"`
+	Gold           int             `json:"gold"`
+	Energy         float64         `json:"energy"`
+	MaxEnergy      float64         `json:"maxEnergy"`
+	RampageCount   int             `json:"rampageCount"`
+	hiddenButtons  []float64       // 被按过的按钮，倒计时结束后随机点亮一个新按钮
+	buttonChanges  map[string]bool // 还没有通知主控的按钮变化
+	goldDrop       float64         // 生存模式距离下次扣金币的时间
+	warmupElasped  float64
+	warmupLaser    int           // 下一个要播放的 WarmupLasers
+	laserChanges   []WarmupLaser // 还没有通知主控的激光图案
+	laserOn        bool          // 最后播放的图案中有亮着的激光
+	stopped        bool
+}
+
+func NewMatchEngine(mode string, cids []string) *MatchEngine {
+	return newMatchEngine(GetOptions(), mode, cids)
+}
+
+// newMatchEngine 使用给定的规则，测试用它固定参数
+func newMatchEngine(opt *MatchOptions, mode string, cids []string) *MatchEngine {
+	e := MatchEngine{}
+	e.opt = opt
+	e.Mode = mode
+	e.Players = make([]*MatchPlayer, len(cids))
+	for i, cid := range cids {
+		e.Players[i] = &MatchPlayer{Cid: cid, lastPress: -1, lastHit: -1}
+	}
+	e.OnButtons = make(map[string]bool)
+	e.buttonChanges = make(map[string]bool)
+	e.hiddenButtons = make([]float64, 0)
+	e.laserChanges = make([]WarmupLaser, 0)
+	e.MaxEnergy = e.opt.MaxEnergy
+	e.MaxRampageTime = e.opt.RampageTime[e.modeIndex()]
+	if mode == MatchModeGold {
+		e.TotalTime = e.opt.Mode1TotalTime
+	} else {
+		e.Gold = e.opt.Mode2InitGold[e.playerIndex()]
+		e.goldDrop = e.opt.Mode2GoldDropInterval
+	}
+	if e.opt.Warmup > 0 {
+		e.Stage = MatchStageWarmup
+		e.WarmupTime = e.opt.Warmup
+		e.tickWarmup(0)
+	} else {
+		e.startOngoing()
+	}
+	return &e
+}
+
+func (e *MatchEngine) modeIndex() int {
+	if e.Mode == MatchModeGold {
+		return 0
+	}
+	return 1
+}
+
+// playerIndex 配置中按 1-4 人区分的参数的下标
+func (e *MatchEngine) playerIndex() int {
+	return MaxInt(MinInt(len(e.Players), 4), 1) - 1
+}
+
+func (e *MatchEngine) IsRampage() bool {
+	return e.RampageTime > 0
+}
+
+func (e *MatchEngine) Stop() {
+	e.stopped = true
+}
+
+// Done 赏金模式时间到，生存模式金币扣完，或者被中止
+func (e *MatchEngine) Done() bool {
+	if e.stopped {
+		return true
+	}
+	if e.Mode == MatchModeGold {
+		return e.TotalTime <= 0
+	}
+	return e.Gold <= 0
+}
+
+func (e *MatchEngine) IsWarmup() bool {
+	return e.Stage == MatchStageWarmup
+}
+
+func (e *MatchEngine) Tick(dt float64) {
+	if e.Done() {
+		return
+	}
+	if e.IsWarmup() {
+		e.tickWarmup(dt)
+		return
+	}
+	e.Elasped += dt
+	if e.Mode == MatchModeGold {
+		e.TotalTime = math.Max(e.opt.Mode1TotalTime-e.Elasped, 0)
+	} else if e.goldDrop -= dt; e.goldDrop <= 0 {
+		e.goldDrop += e.opt.Mode2GoldDropInterval
+		e.Gold = MaxInt(e.Gold-e.opt.Mode2GoldDropRate[e.playerIndex()], 0)
+	}
+	if e.RampageTime > 0 {
+		if e.RampageTime -= dt; e.RampageTime <= 0 {
+			e.RampageTime = 0
+			e.Energy = 0
+			log.Println("rampage end")
+		}
+	}
+	hidden := e.hiddenButtons[:0]
+	for _, t := range e.hiddenButtons {
+		if t -= dt; t > 0 {
+			hidden = append(hidden, t)
+		} else {
+			e.showButton()
+		}
+	}
+	e.hiddenButtons = hidden
+}
+
+// tickWarmup 每隔 WarmupButtonInterval 点亮一批按钮，热身结束时正好点亮 InitButtonNum 个
+// 激光图案到时间后放进 laserChanges，由调用方发给主控
+func (e *MatchEngine) tickWarmup(dt float64) {
+	e.warmupElasped += dt
+	e.WarmupTime = math.Max(e.opt.Warmup-e.warmupElasped, 0)
+	if e.WarmupTime <= 0 {
+		e.startOngoing()
+		return
+	}
+	n := e.opt.InitButtonNum[e.playerIndex()]
+	if interval := e.opt.WarmupButtonInterval; interval > 0 {
+		steps := MaxInt(int(e.opt.Warmup/interval), 1)
+		step := MinInt(int(e.warmupElasped/interval), steps-1)
+		n = (step + 1) * n / steps
+	}
+	e.showButtons(n)
+	for e.warmupLaser < len(e.opt.WarmupLasers) {
+		l := e.opt.WarmupLasers[e.warmupLaser]
+		if float64(l.Time)/1000 > e.warmupElasped {
+			break
+		}
+		e.playLaser(l)
+		e.warmupLaser++
+	}
+}
+
+// startOngoing 热身结束，没有播放的激光图案不再播放，亮着的激光全部熄灭
+func (e *MatchEngine) startOngoing() {
+	if e.laserOn {
+		e.playLaser(WarmupLaser{})
+	}
+	e.Stage = MatchStageOngoing
+	e.WarmupTime = 0
+	e.showButtons(e.opt.InitButtonNum[e.playerIndex()])
+	log.Println("match start, buttons:", len(e.OnButtons))
+}
+
+func (e *MatchEngine) playLaser(l WarmupLaser) {
+	e.laserChanges = append(e.laserChanges, l)
+	e.laserOn = false
+	for _, v := range l.Large {
+		e.laserOn = e.laserOn || v != 0
+	}
+	for _, v := range l.Small {
+		e.laserOn = e.laserOn || v != 0
+	}
+}
+
+// TakeLaserChanges 返回上次调用后需要播放的激光图案
+func (e *MatchEngine) TakeLaserChanges() []WarmupLaser {
+	changes := e.laserChanges
+	e.laserChanges = make([]WarmupLaser, 0)
+	return changes
+}
+
+// Press 第 i 个玩家松开按钮，level 为读条档位 0-3
+// 按钮没有亮或者在热身时返回 false；暴走时只加金币，不加能量
+func (e *MatchEngine) Press(i int, button string, level int) bool {
+	if i < 0 || i >= len(e.Players) || level < 0 || level > 3 || !e.OnButtons[button] || e.Done() || e.IsWarmup() {
+		return false
+	}
+	e.hideButton(button)
+	p := e.Players[i]
+	bonus := e.opt.GoldBonus[e.modeIndex()]
+	if e.IsRampage() {
+		p.Gold += bonus
+		e.Gold += bonus
+		return true
+	}
+	p.LevelData[level]++
+	if level == 0 {
+		p.Combo = 0
+		p.lastPress = e.Elasped
+		return true
+	}
+	energy := e.opt.EnergyBonus[level][e.playerIndex()]
+	if p.lastPress >= 0 && e.Elasped-p.lastPress <= e.comboInterval(p.Combo) {
+		p.Combo++
+		if p.Combo == 1 {
+			energy += e.opt.FirstComboExtra
+		} else {
+			energy += e.opt.ComboExtra
+		}
+	} else {
+		p.Combo = 0
+	}
+	p.MaxCombo = MaxInt(p.MaxCombo, p.Combo)
+	p.lastPress = e.Elasped
+	p.Gold += bonus
+	p.Energy += energy
+	e.Gold += bonus
+	e.Energy = math.Min(e.Energy+energy, e.MaxEnergy)
+	if e.Energy >= e.MaxEnergy {
+		e.RampageTime = e.MaxRampageTime
+		e.RampageCount++
+		log.Println("rampage start, count:", e.RampageCount)
+	}
+	return true
+}
+
+func (e *MatchEngine) comboInterval(combo int) float64 {
+	if combo == 0 {
+		return e.opt.FirstComboInterval[e.playerIndex()]
+	}
+	return e.opt.ComboInterval[e.playerIndex()]
+}
+
+// Hit 第 i 个玩家碰到激光，无敌时间内重复上报的和热身时的不算，返回是否扣了金币
+func (e *MatchEngine) Hit(i int) bool {
+	if i < 0 || i >= len(e.Players) || e.Done() || e.IsWarmup() {
+		return false
+	}
+	p := e.Players[i]
+	if p.lastHit >= 0 && e.Elasped-p.lastHit < e.opt.PlayerInvincibleTime {
+		return false
+	}
+	p.lastHit = e.Elasped
+	p.HitCount++
+	p.Combo = 0
+	punish := e.opt.Mode1TouchPunish[e.playerIndex()]
+	if e.Mode == MatchModeSurvival {
+		punish = e.opt.Mode2TouchPunish[e.playerIndex()]
+	}
+	lost := MinInt(punish, e.Gold)
+	e.Gold -= lost
+	p.LostGold += lost
+	return true
+}
+
+func (e *MatchEngine) hideButton(id string) {
+	delete(e.OnButtons, id)
+	e.buttonChanges[id] = false
+	e.hiddenButtons = append(e.hiddenButtons, e.opt.ButtonHideTime[e.modeIndex()])
+}
+
+// showButtons 点亮按钮直到有 n 个亮着
+func (e *MatchEngine) showButtons(n int) {
+	for i := len(e.OnButtons); i < n; i++ {
+		e.showButton()
+	}
+}
+
+// showButton 随机点亮一个没有亮的按钮
+func (e *MatchEngine) showButton() {
+	off := make([]string, 0)
+	for _, btn := range e.opt.Buttons {
+		if !e.OnButtons[btn.Id] {
+			off = append(off, btn.Id)
+		}
+	}
+	if len(off) == 0 {
+		return
+	}
+	id := off[rand.Intn(len(off))]
+	e.OnButtons[id] = true
+	e.buttonChanges[id] = true
+}
+
+// TakeButtonChanges 返回上次调用后亮灭有变化的按钮
+func (e *MatchEngine) TakeButtonChanges() map[string]bool {
+	changes := e.buttonChanges
+	e.buttonChanges = make(map[string]bool)
+	return changes
+}
+
+// Result 结束后的成绩，格式与 matches/players 表一致
+func (e *MatchEngine) Result() *MatchData {
+	n := len(e.Players)
+	data := MatchData{Mode: e.Mode, Elasped: e.Elasped, Gold: e.Gold, RampageCount: e.RampageCount}
+	if n > 0 {
+		data.Grade = e.opt.TeamGrade(e.Gold, e.Elasped, e.playerIndex()+1, e.Mode)
+	}
+	data.Players = make([]PlayerData, n)
+	for i, p := range e.Players {
+		levels := make([]string, len(p.LevelData))
+		for j, c := range p.LevelData {
+			levels[j] = strconv.Itoa(c)
+			if c > 0 {
+				data.Players[i].Level = j
+			}
+		}
+		data.Players[i].Name = p.Cid
+		data.Players[i].Gold = p.Gold
+		data.Players[i].LostGold = p.LostGold
+		data.Players[i].Energy = p.Energy
+		data.Players[i].Combo = p.MaxCombo
+		data.Players[i].Grade = e.opt.PersonGrade(p.Gold, e.playerIndex()+1, e.Mode)
+		data.Players[i].LevelData = strings.Join(levels, ",")
+		data.Players[i].HitCount = p.HitCount
+		data.Players[i].ControllerID = strconv.Itoa(i + 1)
+	}
+	return &data
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+// testMatchOptions 在 cfg.toml 的基础上固定计分规则，不热身，按钮按下后很快重新亮起
+func testMatchOptions(t *testing.T) *MatchOptions {
+	opt := *GetOptions()
+	if len(opt.Buttons) < 4 {
+		t.Fatalf("cfg.toml has %v buttons, want at least 4", len(opt.Buttons))
+	}
+	opt.Warmup = 0
+	opt.Mode1TotalTime = 100
+	opt.GoldBonus = [2]int{10, 5}
+	opt.MaxEnergy = 100
+	opt.RampageTime = [2]float64{5, 5}
+	for pi := 0; pi < 4; pi++ {
+		for level := 0; level < 4; level++ {
+			opt.EnergyBonus[level][pi] = float64(level)
+		}
+		opt.InitButtonNum[pi] = 4
+		opt.FirstComboInterval[pi] = 2
+		opt.ComboInterval[pi] = 1.5
+		opt.Mode1TouchPunish[pi] = 30
+		opt.Mode2TouchPunish[pi] = 20
+		opt.Mode2InitGold[pi] = 15
+		opt.Mode2GoldDropRate[pi] = 1
+	}
+	opt.FirstComboExtra = 0.5
+	opt.ComboExtra = 0.25
+	opt.ButtonHideTime = [2]float64{0.1, 0.1}
+	opt.PlayerInvincibleTime = 1
+	opt.Mode2GoldDropInterval = 100
+	return &opt
+}
+
+// matchInput 主控上报的 ButtonPress(hit 为 false) 或 LaserHit，at 为游戏开始后的秒数
+type matchInput struct {
+	at     float64
+	hit    bool
+	player int
+	lv     int
+	want   bool
+}
+
+// play 按时间顺序输入，按钮总是选亮着的第一个
+func play(t *testing.T, e *MatchEngine, inputs []matchInput) {
+	for _, in := range inputs {
+		if dt := in.at - e.Elasped; dt > 0 {
+			e.Tick(dt)
+		}
+		var ok bool
+		if in.hit {
+			ok = e.Hit(in.player - 1)
+		} else {
+			ok = e.Press(in.player-1, litButton(e), in.lv)
+		}
+		if ok != in.want {
+			t.Errorf("input %+v = %v", in, ok)
+		}
+	}
+}
+
+func litButton(e *MatchEngine) string {
+	on := make([]string, 0)
+	for id := range e.OnButtons {
+		on = append(on, id)
+	}
+	sort.Strings(on)
+	if len(on) == 0 {
+		return ""
+	}
+	return on[0]
+}
+
+func TestMatchEngineScoring(t *testing.T) {
+	e := newMatchEngine(testMatchOptions(t), MatchModeGold, []string{"p1", "p2"})
+	play(t, e, []matchInput{
+		{at: 0, player: 1, lv: 1, want: true},
+		{at: 0, player: 2, lv: 1, want: true},
+		{at: 1, player: 1, lv: 2, want: true},   // 第一次连击，间隔 2 秒内
+		{at: 2, player: 1, lv: 3, want: true},   // 之后的连击，间隔 1.5 秒内
+		{at: 2.5, player: 1, lv: 0, want: true}, // LV 0 不加金币和能量，连击清零
+		{at: 3, player: 2, hit: true, want: true},
+		{at: 3.5, player: 2, hit: true, want: false}, // 无敌时间内
+		{at: 4, player: 2, hit: true, want: true},    // 队伍金币不够扣，扣到0
+		{at: 6, player: 2, lv: 2, want: true},        // 超过连击间隔
+		{at: 6, player: 3, lv: 1, want: false},
+		{at: 6, player: 1, lv: 4, want: false},
+	})
+
+	tests := []struct {
+		player    int
+		gold      int
+		lostGold  int
+		energy    float64
+		combo     int
+		maxCombo  int
+		hitCount  int
+		levelData [4]int
+	}{
+		{1, 30, 0, 1 + 2.5 + 3.25, 0, 2, 0, [4]int{1, 1, 1, 1}},
+		{2, 20, 40, 1 + 2, 0, 0, 2, [4]int{0, 1, 1, 0}},
+	}
+	for _, tt := range tests {
+		p := e.Players[tt.player-1]
+		if p.Gold != tt.gold || p.LostGold != tt.lostGold || math.Abs(p.Energy-tt.energy) > 1e-9 ||
+			p.Combo != tt.combo || p.MaxCombo != tt.maxCombo || p.HitCount != tt.hitCount || p.LevelData != tt.levelData {
+			t.Errorf("player %v = %+v, want %+v", tt.player, *p, tt)
+		}
+	}
+	if e.Gold != 10 || math.Abs(e.Energy-9.75) > 1e-9 || e.IsRampage() {
+		t.Errorf("team gold = %v energy = %v rampage = %v, want 10 9.75 false", e.Gold, e.Energy, e.IsRampage())
+	}
+}
+
+// 能量满后暴走，暴走时只加金币，结束后能量清零
+func TestMatchEngineRampage(t *testing.T) {
+	opt := testMatchOptions(t)
+	opt.MaxEnergy = 5
+	e := newMatchEngine(opt, MatchModeGold, []string{"p1"})
+	play(t, e, []matchInput{
+		{at: 0, player: 1, lv: 3, want: true},
+		{at: 5, player: 1, lv: 3, want: true},
+		{at: 6, player: 1, lv: 2, want: true},
+	})
+	p := e.Players[0]
+	if !e.IsRampage() || e.RampageCount != 1 || e.Energy != 5 {
+		t.Fatalf("rampage = %v count = %v energy = %v", e.IsRampage(), e.RampageCount, e.Energy)
+	}
+	if p.Gold != 30 || p.Energy != 6 || p.LevelData != [4]int{0, 0, 0, 2} {
+		t.Errorf("player = %+v", *p)
+	}
+	e.Tick(5)
+	if e.IsRampage() || e.Energy != 0 {
+		t.Errorf("after rampage = %v energy = %v", e.IsRampage(), e.Energy)
+	}
+}
+
+// 生存模式碰激光扣的金币超过剩余的金币时扣到0，游戏结束
+func TestMatchEngineSurvivalPunish(t *testing.T) {
+	e := newMatchEngine(testMatchOptions(t), MatchModeSurvival, []string{"p1"})
+	play(t, e, []matchInput{
+		{at: 1, player: 1, hit: true, want: true},
+		{at: 3, player: 1, lv: 1, want: false},
+		{at: 3, player: 1, hit: true, want: false},
+	})
+	p := e.Players[0]
+	if e.Gold != 0 || p.LostGold != 15 || p.HitCount != 1 || !e.Done() {
+		t.Errorf("gold = %v player = %+v done = %v", e.Gold, *p, e.Done())
+	}
+}
+
+func TestMatchGrades(t *testing.T) {
+	opt := testMatchOptions(t)
+	for i := 0; i < 4; i++ {
+		opt.GoldRank[i] = [4]int{400, 300, 200, 100}
+		opt.SurvivalRank[i] = [4]int{40, 30, 20, 10}
+		opt.GoldTeamRank[i] = [4]int{800, 600, 400, 200}
+		opt.SurvivalTeamRank[i] = [4]int{80000, 60000, 40000, 20000}
+	}
+	person := []struct {
+		gold int
+		mode string
+		want string
+	}{
+		{0, MatchModeGold, "D"},
+		{99, MatchModeGold, "D"},
+		{100, MatchModeGold, "C"},
+		{199, MatchModeGold, "C"},
+		{200, MatchModeGold, "B"},
+		{300, MatchModeGold, "A"},
+		{399, MatchModeGold, "A"},
+		{400, MatchModeGold, "S"},
+		{9, MatchModeSurvival, "D"},
+		{10, MatchModeSurvival, "C"},
+		{40, MatchModeSurvival, "S"},
+	}
+	for _, tt := range person {
+		for size := 1; size <= 4; size++ {
+			if got := opt.PersonGrade(tt.gold, size, tt.mode); got != tt.want {
+				t.Errorf("PersonGrade(%v, %v, %v) = %v, want %v", tt.gold, size, tt.mode, got, tt.want)
+			}
+		}
+	}
+	team := []struct {
+		gold    int
+		elasped float64
+		mode    string
+		want    string
+	}{
+		{199, 0, MatchModeGold, "D"},
+		{200, 0, MatchModeGold, "C"},
+		{800, 0, MatchModeGold, "S"},
+		{0, 19.999, MatchModeSurvival, "D"},
+		{0, 20, MatchModeSurvival, "C"},
+		{0, 59.999, MatchModeSurvival, "B"},
+		{0, 60, MatchModeSurvival, "A"},
+		{0, 80, MatchModeSurvival, "S"},
+	}
+	for _, tt := range team {
+		if got := opt.TeamGrade(tt.gold, tt.elasped, 2, tt.mode); got != tt.want {
+			t.Errorf("TeamGrade(%v, %v, %v) = %v, want %v", tt.gold, tt.elasped, tt.mode, got, tt.want)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package core
 import (
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/BurntSushi/toml"
 )
@@ -120,6 +122,7 @@ type MatchOptions struct {
 	Mode1TouchPunish      [4]int        `json:"-"`
 	Mode2TouchPunish      [4]int        `json:"-"`
 	Mode2GoldDropInterval float64       `json:"-"`
+	TeamMatchTime         [2]float64    `json:"-"`
 	MainArduino           []string      `json:"-"`
 	SubArduino            []string      `json:"-"`
 	//MusicArduino          []string           `json:"-"`
@@ -155,17 +158,35 @@ type MatchOptions struct {
 	BoxLastTime float64
 	BoxNum      int
 	LapseTime   float64
+
+	OutboxRetryInterval      float64
+	OutboxMaxRetryInterval   float64
+	OutboxMaxAttempts        int
+	DeviceOfflineAlert       float64
+	AuthorityCacheTTL        float64
+	AuthorityRefreshInterval float64
+	AuthorityOfflinePolicy   string
+	GameSessionTimeout       float64
+
+	Backend  BackendOptions
+	AdminApi AdminApiOptions
 }
 
 type ScoreInfo [4]map[string]interface{}
 
-var opt = DefaultMatchOptions()
+var opt *MatchOptions
+var optOnce sync.Once
 
+// GetOptions 第一次调用时读取 cfg.toml 和 warmup.toml，路径相对于当前目录
 func GetOptions() *MatchOptions {
+	optOnce.Do(func() {
+		opt = DefaultMatchOptions()
+	})
 	return opt
 }
 
 func GetScoreInfo() ScoreInfo {
+	opt := GetOptions()
 	return [4]map[string]interface{}{
 		map[string]interface{}{
 			"time":   strconv.FormatFloat(opt.T1, 'f', -1, 64),
@@ -198,8 +219,16 @@ func DefaultMatchOptions() *MatchOptions {
 		os.Exit(1)
 	}
 	opt.Warmup = float64(warmupInfo.WarmupTime) / 1000
-	opt.WarmupButtonInterval = float64(warmupInfo.WarmupButtonInterval)
+	opt.WarmupButtonInterval = float64(warmupInfo.WarmupButtonInterval) / 1000
 	opt.WarmupLasers = warmupInfo.Lasers
+	sort.Slice(opt.WarmupLasers, func(i, j int) bool {
+		return opt.WarmupLasers[i].Time < opt.WarmupLasers[j].Time
+	})
+	if err := reloadShows(opt.LapseTime); err != nil {
+		log.Printf("parse %v error:%v\n", showsFile, err.Error())
+		os.Exit(1)
+	}
+	opt.Backend.fillDefaults()
 	opt.buildMainArduinoInfo()
 	opt.buildWallRects()
 	opt.buildButtons()
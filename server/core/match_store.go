@@ -0,0 +1,118 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	matchDefaultLimit = 20
+	matchMaxLimit     = 500
+)
+
+// MatchQuery 查询激光游戏记录，为空的条件不限制，From、To 为零值时不限时间
+type MatchQuery struct {
+	Player string // 玩家的 ExternalID
+	Team   string
+	Mode   string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+// ParseMatchQuery 参数: player, team, mode, from, to, limit，from、to 的格式与审计查询相同
+func ParseMatchQuery(get func(string) string) (MatchQuery, error) {
+	q := MatchQuery{Player: get("player"), Team: get("team"), Mode: get("mode")}
+	var err error
+	if v := get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			return q, errors.New("limit must be a number")
+		}
+	}
+	if q.From, err = parseAuditTime(get("from")); err != nil {
+		return q, err
+	}
+	if q.To, err = parseAuditTime(get("to")); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// SaveMatch 一局结束时写入 matches 表，Players 同时写入 players 表
+func (db *DB) SaveMatch(m *MatchData) error {
+	return db.conn.Create(m).Error
+}
+
+// LastMatchID 启动时用于继续编号，保证激光房间的 matchID 与 matches 表的 ID 一致
+func (db *DB) LastMatchID() (int, error) {
+	var ret []MatchData
+	if err := db.conn.Order("id desc").Limit(1).Find(&ret).Error; err != nil {
+		return 0, err
+	}
+	if len(ret) == 0 {
+		return 0, nil
+	}
+	return int(ret[0].ID), nil
+}
+
+// Match 按ID查询一局，包括所有玩家，不存在时返回 nil
+func (db *DB) Match(id uint) (*MatchData, error) {
+	var ret []MatchData
+	if err := db.conn.Preload("Players").Where("id = ?", id).Limit(1).Find(&ret).Error; err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return &ret[0], nil
+}
+
+// Matches 按时间倒序返回，包括所有玩家
+func (db *DB) Matches(q MatchQuery) ([]MatchData, error) {
+	if q.Limit <= 0 {
+		q.Limit = matchDefaultLimit
+	} else if q.Limit > matchMaxLimit {
+		q.Limit = matchMaxLimit
+	}
+	query := db.conn.Preload("Players").Order("id desc").Limit(q.Limit)
+	if q.Player != "" {
+		query = query.Where("id in (SELECT match_id FROM players WHERE external_id = ?)", q.Player)
+	}
+	if q.Team != "" {
+		query = query.Where("team_id = ?", q.Team)
+	}
+	if q.Mode != "" {
+		query = query.Where("mode = ?", q.Mode)
+	}
+	if !q.From.IsZero() {
+		query = query.Where("created_at >= ?", q.From)
+	}
+	if !q.To.IsZero() {
+		query = query.Where("created_at < ?", q.To)
+	}
+	ret := make([]MatchData, 0)
+	err := query.Find(&ret).Error
+	return ret, err
+}
+
+// Match 和 Matches 只读数据库，可以在 http goroutine 中直接调用
+func (s *Srv) Match(id uint) (*MatchData, error) {
+	return s.db.Match(id)
+}
+
+func (s *Srv) Matches(q MatchQuery) ([]MatchData, error) {
+	return s.db.Matches(q)
+}
+
+// saveMatch 激光房间一局结束后在主循环中调用
+func (s *Srv) saveMatch(result *MatchData) {
+	if err := s.db.SaveMatch(result); err != nil {
+		log.Println("save match error:", err.Error())
+		return
+	}
+	log.Println("match:", result.ID, "saved, mode:", result.Mode, "gold:", result.Gold, "players:", len(result.Players))
+}
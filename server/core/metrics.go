@@ -0,0 +1,183 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	MetricPanics             = "challenger_handler_panics_total"      // 处理消息时发生并被恢复的panic
+	MetricArduinoOnline      = "challenger_arduino_online"            // 每个 ArduinoController 是否在线
+	MetricInboxMessages      = "challenger_inbox_messages_total"      // 收到的消息，arduino 按 TYPE，网页按 cmd
+	MetricTcpWriteDrops      = "challenger_tcp_write_drops_total"     // tcp 发送队列满时丢弃的消息
+	MetricGameDataDropped    = "challenger_game_data_dropped_total"   // 游戏数据中不是数字而被丢弃的字段
+	MetricBackendRequests    = "challenger_backend_request_seconds"   // 票务后台请求的耗时和结果
+	MetricBoxesAssigned      = "challenger_hunter_boxes_assigned"     // 已分配给玩家的宝箱
+	MetricBoxesTotal         = "challenger_hunter_boxes"              // 宝箱总数
+	MetricMatchesActive      = "challenger_matches_active"            // 正在进行的 match(show)、激光房间和模拟器的比赛
+	MetricGameSessions       = "challenger_game_sessions"             // 各状态的游戏会话
+	MetricAuthorityDecisions = "challenger_authority_decisions_total" // 门禁授权结果，按来源(后台或缓存)
+)
+
+// 后台请求耗时的分桶(秒)
+var backendBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+// Counter 是一个带标签的计数器、仪表或直方图的当前值，直方图的 Buckets 为累计数量
+type Counter struct {
+	Name    string
+	Kind    string
+	Labels  map[string]string
+	Value   float64
+	Count   uint64
+	Buckets []uint64
+}
+
+// Metrics 保存服务器的指标，可以在任意goroutine中调用
+type Metrics struct {
+	l        *sync.Mutex
+	counters map[string]*Counter
+}
+
+var metrics = NewMetrics()
+
+func GetMetrics() *Metrics {
+	return metrics
+}
+
+func NewMetrics() *Metrics {
+	m := Metrics{}
+	m.l = new(sync.Mutex)
+	m.counters = make(map[string]*Counter)
+	return &m
+}
+
+// Inc 计数加1，labels 按 key, value, key, value 的顺序给出
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+func (m *Metrics) Add(name string, v float64, labels ...string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.get(name, metricCounter, labels).Value += v
+}
+
+// Set 设置仪表的当前值
+func (m *Metrics) Set(name string, v float64, labels ...string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.get(name, metricGauge, labels).Value = v
+}
+
+// Observe 把一次耗时(秒)计入直方图
+func (m *Metrics) Observe(name string, v float64, labels ...string) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	c := m.get(name, metricHistogram, labels)
+	if c.Buckets == nil {
+		c.Buckets = make([]uint64, len(backendBuckets))
+	}
+	for i, le := range backendBuckets {
+		if v <= le {
+			c.Buckets[i]++
+		}
+	}
+	c.Value += v
+	c.Count++
+}
+
+// ObserveSince 记录从 start 到现在的耗时
+func (m *Metrics) ObserveSince(name string, start time.Time, labels ...string) {
+	m.Observe(name, time.Since(start).Seconds(), labels...)
+}
+
+func (m *Metrics) get(name string, kind string, labels []string) *Counter {
+	key := name + "{" + strings.Join(labels, ",") + "}"
+	c, ok := m.counters[key]
+	if !ok {
+		lm := make(map[string]string)
+		for i := 0; i+1 < len(labels); i += 2 {
+			lm[labels[i]] = labels[i+1]
+		}
+		c = &Counter{Name: name, Kind: kind, Labels: lm}
+		m.counters[key] = c
+	}
+	return c
+}
+
+// Counters 返回按名字和标签排序的所有指标的拷贝
+func (m *Metrics) Counters() []Counter {
+	m.l.Lock()
+	defer m.l.Unlock()
+	keys := make([]string, 0, len(m.counters))
+	for k := range m.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]Counter, 0, len(keys))
+	for _, k := range keys {
+		c := *m.counters[k]
+		c.Buckets = append([]uint64(nil), c.Buckets...)
+		ret = append(ret, c)
+	}
+	return ret
+}
+
+// WritePrometheus 按 prometheus 的文本格式输出所有指标
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	last := ""
+	for _, c := range m.Counters() {
+		if c.Name != last {
+			fmt.Fprintf(w, "# TYPE %s %s\n", c.Name, c.Kind)
+			last = c.Name
+		}
+		if c.Kind != metricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, "", ""), formatValue(c.Value))
+			continue
+		}
+		for i, le := range backendBuckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", c.Name, formatLabels(c.Labels, "le", formatValue(le)), c.Buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", c.Name, formatLabels(c.Labels, "le", "+Inf"), c.Count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", c.Name, formatLabels(c.Labels, "", ""), formatValue(c.Value))
+		fmt.Fprintf(w, "%s_count%s %d\n", c.Name, formatLabels(c.Labels, "", ""), c.Count)
+	}
+}
+
+// formatLabels extraKey 不为空时追加一个标签，用于直方图的 le
+func formatLabels(labels map[string]string, extraKey string, extraValue string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		parts = append(parts, k+"="+strconv.Quote(labels[k]))
+	}
+	if extraKey != "" {
+		parts = append(parts, extraKey+"="+strconv.Quote(extraValue))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
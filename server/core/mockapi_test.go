@@ -0,0 +1,118 @@
+package core
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"challenger/server/mockapi"
+)
+
+// newMockBackend 启动 mockapi 并把后台指向它，返回的函数在测试结束时关闭
+func newMockBackend(t *testing.T) (*mockapi.Server, func()) {
+	mock := mockapi.NewServer()
+	hs := httptest.NewServer(mock)
+	SetBackendBaseUrl(hs.URL + "/gsaleapi/")
+	return mock, func() {
+		mock.Close()
+		hs.Close()
+	}
+}
+
+func waitRequests(t *testing.T, mock *mockapi.Server, endpoint string, n int) []mockapi.Request {
+	var ret []mockapi.Request
+	waitFor(t, endpoint, func() bool {
+		ret = mock.Requests(endpoint)
+		return len(ret) >= n
+	})
+	return ret
+}
+
+// 刷卡 -> 登录 -> 开始 -> 结束 -> 上传，后台收到的请求和 idempotency_key 都应该与设备的操作一一对应
+func TestMockApiSessionFlow(t *testing.T) {
+	mock, closeMock := newMockBackend(t)
+	defer closeMock()
+	ts := newTestSrv(t)
+	defer ts.close()
+	go ts.outbox.Run()
+
+	const arduino = "G-2-1"
+	game := ts.connect(InboxAddressTypeGameArduinoDevice, arduino)
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1", "P", "2")
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-2")
+	for _, m := range game.waitReceived(t, "ticket_check", 2) {
+		if m["return"] != TicketCheckTrue {
+			t.Fatalf("ticket_check = %v, want true", m)
+		}
+	}
+	checks := mock.Requests(mockapi.TicketGame)
+	if len(checks) != 2 {
+		t.Fatalf("ticket_game requests = %v, want 2", len(checks))
+	}
+	tickets := make(map[string]bool)
+	for _, r := range checks {
+		if r.Method != "GET" || r.Params["game_ID"] != "2" || r.Params["op"] != "get_ticket_game_id" {
+			t.Errorf("unexpected ticket_game request: %+v", r)
+		}
+	}
+
+	ts.send(arduino, "TYPE", GameStart, "GAME", "2", "ADMIN", "staff-1", "P", "2")
+	uses := waitRequests(t, mock, mockapi.TicketUpdate, 2)
+	for _, r := range uses {
+		if r.Params["exchanger_ID"] != "staff-1" || r.Params["op"] != "set_exchanger_id" {
+			t.Errorf("unexpected ticket_update request: %+v", r)
+		}
+		if r.Params[idempotencyKeyParam] != "ticket-use-"+r.Params["id"] {
+			t.Errorf("ticket_update key = %v, want ticket-use-%v", r.Params[idempotencyKeyParam], r.Params["id"])
+		}
+		tickets[r.Params["id"]] = true
+	}
+	if len(tickets) != 2 {
+		t.Errorf("redeemed tickets = %v, want 2 different tickets", tickets)
+	}
+
+	ts.send(arduino, "TYPE", GameEnd, "GAME", "2", "LR", "7")
+	uploads := waitRequests(t, mock, "gamedata_follow.php", 1)
+	up := uploads[0]
+	//两个玩家的门票请求同时进行，登录顺序由后台返回的先后决定
+	cards := up.Params["card_ID1"] + "," + up.Params["card_ID2"]
+	if up.Method != "POST" || (cards != "card-1,card-2" && cards != "card-2,card-1") ||
+		up.Params["last_round"] != "7" || up.Params["op"] != "set_follow" {
+		t.Errorf("unexpected upload: %+v", up)
+	}
+	if up.Params[idempotencyKeyParam] == "" || strings.HasPrefix(up.Params[idempotencyKeyParam], "ticket-use-") {
+		t.Errorf("upload key = %q, want a generated key", up.Params[idempotencyKeyParam])
+	}
+
+	waitFor(t, "outbox delivered", func() bool {
+		records, err := ts.OutboxRecords("")
+		return err == nil && len(records) == 0
+	})
+	delivered, err := ts.OutboxRecords(OutboxStatusDelivered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[string]bool)
+	for _, rec := range delivered {
+		keys[rec.IdempotencyKey] = true
+	}
+	for _, r := range append(uses, up) {
+		if !keys[r.Params[idempotencyKeyParam]] {
+			t.Errorf("request key %v not in outbox", r.Params[idempotencyKeyParam])
+		}
+		if r.Duplicate {
+			t.Errorf("request %+v delivered twice", r)
+		}
+	}
+	if len(delivered) != 3 {
+		t.Errorf("delivered records = %v, want 3", len(delivered))
+	}
+	ts.do(func() {
+		if len(ts.sessions) != 0 {
+			t.Errorf("sessions after upload = %v, want none", ts.sessions)
+		}
+	})
+	if n := len(mock.Requests("")); n != 5 {
+		t.Errorf("backend requests = %v, want 5", n)
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	OperatorRoleStaff   = "staff"   // 可以执行管理操作
+	OperatorRoleManager = "manager" // 值班经理，另外可以管理操作员、查询审计记录
+)
+
+const operatorSessionDefaultTimeout = 12 * 60 // 分钟
+
+// Operator 对应数据库中的 operators 表，密码只保存加盐后的 sha256
+type Operator struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Name      string    `gorm:"unique_index" json:"name"`
+	Role      string    `json:"role"`
+	Salt      string    `json:"-"`
+	Password  string    `json:"-"`
+	Disabled  bool      `json:"disabled"`
+}
+
+func (Operator) TableName() string {
+	return "operators"
+}
+
+func (op *Operator) checkPassword(password string) bool {
+	return op.Password == hashPassword(op.Salt, password)
+}
+
+func hashPassword(salt string, password string) string {
+	sum := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (db *DB) AddOperator(name string, password string, role string) (*Operator, error) {
+	op := Operator{Name: name, Role: role, Salt: randomHex(8)}
+	op.Password = hashPassword(op.Salt, password)
+	if err := db.conn.Create(&op).Error; err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+func (db *DB) FindOperator(name string) (*Operator, error) {
+	var op Operator
+	if err := db.conn.Where("name = ?", name).First(&op).Error; err != nil {
+		return nil, err
+	}
+	return &op, nil
+}
+
+func (db *DB) Operators() ([]Operator, error) {
+	var ret []Operator
+	err := db.conn.Order("id").Find(&ret).Error
+	return ret, err
+}
+
+// OperatorSession 登录后得到的会话，http 请求通过 X-Admin-Token 带上 Token
+type OperatorSession struct {
+	Token    string    `json:"token"`
+	Operator string    `json:"operator"`
+	Role     string    `json:"role"`
+	Expires  time.Time `json:"expires"`
+}
+
+func (session *OperatorSession) IsManager() bool {
+	return session.Role == OperatorRoleManager
+}
+
+// operatorSessions 在 http goroutine 和主循环中都会用到
+type operatorSessions struct {
+	l        *sync.Mutex
+	sessions map[string]*OperatorSession
+}
+
+func newOperatorSessions() *operatorSessions {
+	o := operatorSessions{}
+	o.l = new(sync.Mutex)
+	o.sessions = make(map[string]*OperatorSession)
+	return &o
+}
+
+func (o *operatorSessions) add(session *OperatorSession) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	now := time.Now()
+	for token, old := range o.sessions {
+		if now.After(old.Expires) {
+			delete(o.sessions, token)
+		}
+	}
+	o.sessions[session.Token] = session
+}
+
+func (o *operatorSessions) get(token string) *OperatorSession {
+	o.l.Lock()
+	defer o.l.Unlock()
+	session := o.sessions[token]
+	if session == nil || time.Now().After(session.Expires) {
+		return nil
+	}
+	return session
+}
+
+func (o *operatorSessions) remove(token string) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	delete(o.sessions, token)
+}
+
+// Login 检查用户名密码并创建会话，成功和失败都记入审计
+func (s *Srv) Login(name string, password string, source string, remote string) (*OperatorSession, error) {
+	op, err := s.db.FindOperator(name)
+	if err != nil || op.Disabled || !op.checkPassword(password) {
+		s.Audit(AdminAudit{Operator: name, Source: source, Remote: remote, Op: "login", Result: "invalid operator or password"})
+		return nil, errors.New("invalid operator or password")
+	}
+	timeout := GetOptions().AdminApi.SessionTimeout
+	if timeout <= 0 {
+		timeout = operatorSessionDefaultTimeout
+	}
+	session := OperatorSession{Token: randomHex(16), Operator: op.Name, Role: op.Role}
+	session.Expires = time.Now().Add(time.Duration(timeout) * time.Minute)
+	s.operatorSessions.add(&session)
+	s.Audit(AdminAudit{Operator: name, Source: source, Remote: remote, Op: "login", Result: "ok"})
+	return &session, nil
+}
+
+func (s *Srv) Logout(session *OperatorSession, source string, remote string) {
+	s.operatorSessions.remove(session.Token)
+	s.Audit(AdminAudit{Operator: session.Operator, Source: source, Remote: remote, Op: "logout", Result: "ok"})
+}
+
+// OperatorSession token 无效或已过期时返回 nil
+func (s *Srv) OperatorSession(token string) *OperatorSession {
+	return s.operatorSessions.get(token)
+}
+
+// AddOperator 由值班经理调用
+func (s *Srv) AddOperator(manager *OperatorSession, name string, password string, role string, source string, remote string) (*Operator, error) {
+	var op *Operator
+	err := validateOperator(name, password, role)
+	if err == nil {
+		op, err = s.db.AddOperator(name, password, role)
+	}
+	params, _ := json.Marshal(map[string]string{"name": name, "role": role})
+	audit := AdminAudit{Operator: manager.Operator, Source: source, Remote: remote, Op: "addOperator", Params: string(params), Result: "ok"}
+	if err != nil {
+		audit.Result = err.Error()
+	}
+	s.Audit(audit)
+	return op, err
+}
+
+func (s *Srv) Operators() ([]Operator, error) {
+	return s.db.Operators()
+}
+
+func validateOperator(name string, password string, role string) error {
+	if name == "" || password == "" {
+		return errors.New("name and password are required")
+	}
+	if role != OperatorRoleStaff && role != OperatorRoleManager {
+		return errors.New("role must be staff or manager")
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	OutboxStatusPending   = "pending"
+	OutboxStatusDelivered = "delivered"
+	OutboxStatusFailed    = "failed"
+)
+
+// 每条记录都带着这个参数上传，后台据此去重，保证重试不会产生重复数据
+const idempotencyKeyParam = "idempotency_key"
+
+// OutboxRecord 是一条等待上传到后台的数据，保存在 sqlite 中，服务器重启后继续上传
+type OutboxRecord struct {
+	ID             uint      `gorm:"primary_key" json:"id"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	IdempotencyKey string    `gorm:"unique_index" json:"key"`
+	Api            string    `json:"api"`
+	Params         string    `json:"params"`
+	Msg            string    `json:"-"`
+	Status         string    `gorm:"index" json:"status"`
+	Attempts       int       `json:"attempts"`
+	NextAttemptAt  time.Time `json:"nextAttemptAt"`
+	LastError      string    `json:"lastError"`
+}
+
+type Outbox struct {
+	s      *Srv
+	db     *DB
+	wakeCh chan struct{}
+}
+
+func NewOutbox(s *Srv, db *DB) *Outbox {
+	o := Outbox{}
+	o.s = s
+	o.db = db
+	o.wakeCh = make(chan struct{}, 1)
+	return &o
+}
+
+func (o *Outbox) Run() {
+	tickChan := time.Tick(1 * time.Second)
+	for {
+		select {
+		case <-tickChan:
+		case <-o.wakeCh:
+		}
+		o.deliverDue()
+	}
+}
+
+// Enqueue 保存一条上传记录，由 Run 所在的 goroutine 负责投递
+func (o *Outbox) Enqueue(api string, params map[string]string, msg *InboxMessage) error {
+	//调用方可以指定 key，同一个业务操作重复入队时后台只处理一次
+	key := params[idempotencyKeyParam]
+	if key == "" {
+		key = newIdempotencyKey()
+		params[idempotencyKeyParam] = key
+	}
+	p, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	rec := OutboxRecord{}
+	rec.IdempotencyKey = key
+	rec.Api = api
+	rec.Params = string(p)
+	if msg != nil {
+		if m, err := msg.Marshal(); err == nil {
+			rec.Msg = string(m)
+		}
+	}
+	rec.Status = OutboxStatusPending
+	rec.NextAttemptAt = time.Now()
+	if err := o.db.conn.Create(&rec).Error; err != nil {
+		return err
+	}
+	log.Println("outbox enqueue:", api, "key:", key)
+	o.wake()
+	return nil
+}
+
+// Records 返回指定状态的记录，status 为空时返回所有未送达的记录
+func (o *Outbox) Records(status string) ([]OutboxRecord, error) {
+	records := make([]OutboxRecord, 0)
+	q := o.db.conn.Order("id")
+	if status == "" {
+		q = q.Where("status <> ?", OutboxStatusDelivered)
+	} else {
+		q = q.Where("status = ?", status)
+	}
+	err := q.Find(&records).Error
+	return records, err
+}
+
+// Drain 忽略退避时间，立即重新投递所有未送达(包括已放弃)的记录
+func (o *Outbox) Drain() (int, error) {
+	q := o.db.conn.Model(&OutboxRecord{}).
+		Where("status <> ?", OutboxStatusDelivered).
+		Updates(map[string]interface{}{"status": OutboxStatusPending, "next_attempt_at": time.Now()})
+	if q.Error != nil {
+		return 0, q.Error
+	}
+	log.Println("outbox drain:", q.RowsAffected, "records")
+	o.wake()
+	return int(q.RowsAffected), nil
+}
+
+func (o *Outbox) wake() {
+	select {
+	case o.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) deliverDue() {
+	var records []OutboxRecord
+	err := o.db.conn.Where("status = ? AND next_attempt_at <= ?", OutboxStatusPending, time.Now()).
+		Order("id").Find(&records).Error
+	if err != nil {
+		log.Println("outbox query error:", err)
+		return
+	}
+	for i := range records {
+		o.deliver(&records[i])
+	}
+}
+
+func (o *Outbox) deliver(rec *OutboxRecord) {
+	params := make(map[string]string)
+	json.Unmarshal([]byte(rec.Params), &params)
+	msg := NewInboxMessage()
+	if rec.Msg != "" {
+		json.Unmarshal([]byte(rec.Msg), &msg.Data)
+	}
+	request := NewHttpRequest(o.s)
+	request.SetApi(rec.Api)
+	request.SetParams(params)
+	request.SetMsg(msg)
+	hr := request.post()
+	rec.Attempts++
+	if reason := outboxFailReason(hr); reason == "" {
+		rec.Status = OutboxStatusDelivered
+		rec.LastError = ""
+		log.Println("outbox delivered:", rec.Api, "key:", rec.IdempotencyKey)
+	} else {
+		rec.LastError = reason
+		maxAttempts := GetOptions().OutboxMaxAttempts
+		if maxAttempts > 0 && rec.Attempts >= maxAttempts {
+			rec.Status = OutboxStatusFailed
+			log.Println("outbox give up:", rec.Api, "key:", rec.IdempotencyKey, "error:", reason)
+		} else {
+			rec.NextAttemptAt = time.Now().Add(outboxBackoff(rec.Attempts))
+			log.Println("outbox retry later:", rec.Api, "key:", rec.IdempotencyKey, "error:", reason)
+		}
+	}
+	if err := o.db.conn.Save(rec).Error; err != nil {
+		log.Println("outbox save error:", err)
+	}
+	if hr != nil {
+		o.s.OnHttpRequest(hr)
+	}
+}
+
+// 后台返回 200 且 return 为 true 才算送达
+func outboxFailReason(hr *HttpResponse) string {
+	if hr == nil {
+		return "invalid request"
+	}
+	if hr.StatusCode != http.StatusOK {
+		return fmt.Sprintf("status code %v", hr.StatusCode)
+	}
+	if res, ok := hr.Get("return").(bool); !ok {
+		return "malformed response: " + hr.Data
+	} else if !res {
+		return "return false"
+	}
+	return ""
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	opt := GetOptions()
+	sec := opt.OutboxRetryInterval * math.Pow(2, float64(attempts-1))
+	sec = math.Min(sec, opt.OutboxMaxRetryInterval)
+	return time.Duration(sec * float64(time.Second))
+}
+
+func newIdempotencyKey() string {
+	return fmt.Sprintf("%x-%x", time.Now().UnixNano(), rand.Int63())
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	RankModeGold     = "g" // 赏金
+	RankModeSurvival = "s" // 生存
+)
+
+const (
+	rankMaxTeamSize    = 4
+	rankDefaultPerPage = 8 // 排行榜页面最多显示8条
+	rankMaxPerPage     = 100
+)
+
+// MatchData 对应数据库中的 matches 表，一条记录是一局激光游戏的结果
+type MatchData struct {
+	ID           uint         `gorm:"primary_key" json:"id"`
+	CreatedAt    time.Time    `gorm:"index" json:"createdAt"`
+	Mode         string       `json:"mode"`
+	Elasped      float64      `json:"elasped"`
+	Gold         int          `json:"gold"`
+	RampageCount int          `json:"rampageCount"`
+	AnswerType   int          `json:"answerType"`
+	TeamID       string       `json:"teamId"`
+	ExternalID   string       `gorm:"index" json:"externalId"`
+	Grade        string       `json:"grade"`
+	Players      []PlayerData `gorm:"ForeignKey:MatchID" json:"players"`
+}
+
+func (MatchData) TableName() string {
+	return "matches"
+}
+
+// PlayerData 对应数据库中的 players 表，一局游戏中每个玩家一条记录
+type PlayerData struct {
+	ID           uint      `gorm:"primary_key" json:"id"`
+	CreatedAt    time.Time `json:"createdAt"`
+	MatchID      uint      `gorm:"index" json:"matchId"`
+	ExternalID   string    `gorm:"index" json:"externalId"`
+	Name         string    `json:"name"`
+	Gold         int       `json:"gold"`
+	LostGold     int       `json:"lostGold"`
+	Energy       float64   `json:"energy"`
+	Combo        int       `json:"combo"`
+	Grade        string    `json:"grade"`
+	Level        int       `json:"level"`
+	LevelData    string    `json:"levelData"`
+	HitCount     int       `json:"hitCount"`
+	ControllerID string    `json:"controllerId"`
+	QuestionInfo string    `json:"questionInfo"`
+	Answered     int       `json:"answered"`
+}
+
+func (PlayerData) TableName() string {
+	return "players"
+}
+
+// RankQuery 描述一次排行榜查询，Year 为0时查询全部时间，Month 为0时查询全年
+type RankQuery struct {
+	Mode     string
+	TeamSize int // 1-4，为0时查询所有人数
+	Year     int
+	Month    int
+	Page     int // 从1开始
+	PerPage  int
+}
+
+type RankUser struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// RankEntry 的格式与 rank.jsx 使用的一致，赏金模式显示 gold，生存模式显示 time
+type RankEntry struct {
+	MatchId   uint       `json:"match_id"`
+	Users     []RankUser `json:"users"`
+	Gold      *int       `json:"gold,omitempty"`
+	Time      *float64   `json:"time,omitempty"`
+	MatchTime int64      `json:"match_time"` // 毫秒，网页直接用于 new Date()
+}
+
+func (q *RankQuery) normalize() {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.PerPage < 1 {
+		q.PerPage = rankDefaultPerPage
+	} else if q.PerPage > rankMaxPerPage {
+		q.PerPage = rankMaxPerPage
+	}
+}
+
+func (q *RankQuery) timeRange() (time.Time, time.Time, bool) {
+	if q.Year == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	if q.Month < 1 || q.Month > 12 {
+		from := time.Date(q.Year, 1, 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(1, 0, 0), true
+	}
+	from := time.Date(q.Year, time.Month(q.Month), 1, 0, 0, 0, 0, time.Local)
+	return from, from.AddDate(0, 1, 0), true
+}
+
+// Season 返回赛季名，例如 2016年7月为 S201607
+func (q *RankQuery) Season() string {
+	if q.Year == 0 {
+		return ""
+	}
+	if q.Month < 1 || q.Month > 12 {
+		return fmt.Sprintf("S%d", q.Year)
+	}
+	return fmt.Sprintf("S%d%02d", q.Year, q.Month)
+}
+
+// Rank 按赏金模式金币、生存模式时间从高到低排序
+func (db *DB) Rank(q RankQuery) ([]RankEntry, error) {
+	q.normalize()
+	order := "gold desc, id"
+	if q.Mode == RankModeSurvival {
+		order = "elasped desc, id"
+	}
+	query := db.conn.Where("mode = ?", q.Mode)
+	if q.TeamSize > 0 {
+		query = query.Where("(SELECT COUNT(*) FROM players WHERE players.match_id = matches.id) = ?", q.TeamSize)
+	}
+	if from, to, ok := q.timeRange(); ok {
+		query = query.Where("created_at >= ? AND created_at < ?", from, to)
+	}
+	var matches []MatchData
+	err := query.Order(order).Offset((q.Page - 1) * q.PerPage).Limit(q.PerPage).Find(&matches).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]RankEntry, 0, len(matches))
+	if len(matches) == 0 {
+		return ret, nil
+	}
+	ids := make([]uint, len(matches))
+	for i, m := range matches {
+		ids[i] = m.ID
+	}
+	var players []PlayerData
+	if err := db.conn.Where("match_id in (?)", ids).Order("id").Find(&players).Error; err != nil {
+		return nil, err
+	}
+	users := make(map[uint][]RankUser)
+	for _, p := range players {
+		users[p.MatchID] = append(users[p.MatchID], RankUser{p.ExternalID, p.Name})
+	}
+	for i := range matches {
+		m := &matches[i]
+		entry := RankEntry{}
+		entry.MatchId = m.ID
+		entry.Users = users[m.ID]
+		if entry.Users == nil {
+			entry.Users = make([]RankUser, 0)
+		}
+		if m.Mode == RankModeSurvival {
+			entry.Time = &m.Elasped
+		} else {
+			entry.Gold = &m.Gold
+		}
+		entry.MatchTime = m.CreatedAt.UnixNano() / int64(time.Millisecond)
+		ret = append(ret, entry)
+	}
+	return ret, nil
+}
+
+// RankByTeamSize 返回 {"1p": [...], ..., "4p": [...]}，q.TeamSize 不为0时只返回对应人数
+func (db *DB) RankByTeamSize(q RankQuery) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+	for size := 1; size <= rankMaxTeamSize; size++ {
+		if q.TeamSize != 0 && q.TeamSize != size {
+			continue
+		}
+		sq := q
+		sq.TeamSize = size
+		entries, err := db.Rank(sq)
+		if err != nil {
+			return nil, err
+		}
+		ret[fmt.Sprintf("%dp", size)] = entries
+	}
+	return ret, nil
+}
+
+// RankHistory 只读数据库，可以在 http goroutine 中直接调用
+func (s *Srv) RankHistory(q RankQuery) (map[string]interface{}, error) {
+	return s.db.RankByTeamSize(q)
+}
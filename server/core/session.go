@@ -0,0 +1,151 @@
+package core
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+const (
+	SessionWaiting  = "waiting"  // 已刷卡，等待后台确认门票
+	SessionLoggedIn = "loggedIn" // 至少一个玩家门票有效，等待游戏开始
+	SessionPlaying  = "playing"
+	SessionEnded    = "ended"
+	SessionUploaded = "uploaded"
+)
+
+const sessionMaxQueue = 2 // 同一个房间最多一组在玩、一组排队
+
+// 随消息一起传递的会话ID，后台返回和outbox记录都据此找到对应的会话
+const sessionIdKey = "SESSION"
+
+// ticket_check 被拒绝时的原因
+const (
+	SessionRejectUnknownGame = "unknownGame"
+	SessionRejectFull        = "full"
+	SessionRejectDuplicate   = "duplicate"
+)
+
+// GameSession 是一组玩家在一个游戏房间的一局游戏，从刷卡开始到数据上传结束
+type GameSession struct {
+	ID        int       `json:"id"`
+	GameId    int       `json:"gameId"`
+	ArduinoId string    `json:"arduinoId"`
+	State     string    `json:"state"`
+	Players   []string  `json:"players"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"` // 最后一次刷卡或登录的时间，游戏开始前据此判断会话是否过期
+	Game      Game      `json:"-"`
+
+	pending map[string]bool // 正在等待后台确认门票的卡号
+}
+
+// NewGameSession playerNum 为第一个刷卡消息中的 P，决定这一局的人数
+func NewGameSession(id int, gameId int, arduinoId string, playerNum int) *GameSession {
+	gs := GameSession{}
+	gs.ID = id
+	gs.GameId = gameId
+	gs.ArduinoId = arduinoId
+	gs.State = SessionWaiting
+	gs.Players = make([]string, 0)
+	gs.CreatedAt = time.Now()
+	gs.UpdatedAt = gs.CreatedAt
+	gs.Game = NewGame(gameId)
+	gs.Game.GetLoginInfo().SetPlayerNum(playerNum)
+	gs.pending = make(map[string]bool)
+	return &gs
+}
+
+func sessionKey(gameId int, arduinoId string) string {
+	return strconv.Itoa(gameId) + ":" + arduinoId
+}
+
+func (gs *GameSession) Key() string {
+	return sessionKey(gs.GameId, gs.ArduinoId)
+}
+
+// HasCard 卡号已经登录或正在等待后台确认
+func (gs *GameSession) HasCard(cardId string) bool {
+	if gs.pending[cardId] {
+		return true
+	}
+	for _, c := range gs.Players {
+		if c == cardId {
+			return true
+		}
+	}
+	return false
+}
+
+// CanJoin 游戏开始前且人数未满时可以继续刷卡
+func (gs *GameSession) CanJoin() bool {
+	if gs.State != SessionWaiting && gs.State != SessionLoggedIn {
+		return false
+	}
+	return len(gs.Players)+len(gs.pending) < gs.Game.GetLoginInfo().Capacity()
+}
+
+// Reserve 在请求后台之前占住位置，避免同时刷卡的玩家超过人数
+func (gs *GameSession) Reserve(cardId string) {
+	gs.pending[cardId] = true
+	gs.UpdatedAt = time.Now()
+}
+
+// Release 后台没有确认门票，释放占住的位置
+func (gs *GameSession) Release(cardId string) {
+	delete(gs.pending, cardId)
+}
+
+// Login 游戏的人数已满时返回 false，这张卡没有登录
+func (gs *GameSession) Login(cardId string, ticketId string) bool {
+	delete(gs.pending, cardId)
+	if !gs.Game.Login(cardId, ticketId) {
+		return false
+	}
+	gs.Players = append(gs.Players, cardId)
+	gs.State = SessionLoggedIn
+	gs.UpdatedAt = time.Now()
+	return true
+}
+
+// Expired 游戏开始前超过 timeout 没有新的刷卡，玩家可能已经离开，timeout 为0时不过期
+func (gs *GameSession) Expired(now time.Time, timeout time.Duration) bool {
+	if gs.State != SessionWaiting && gs.State != SessionLoggedIn {
+		return false
+	}
+	return timeout > 0 && now.Sub(gs.UpdatedAt) > timeout
+}
+
+// Idle 没有玩家也没有等待确认的刷卡，可以丢弃
+func (gs *GameSession) Idle() bool {
+	return gs.State == SessionWaiting && len(gs.pending) == 0
+}
+
+func (gs *GameSession) Start() bool {
+	if gs.State != SessionLoggedIn {
+		return false
+	}
+	gs.Game.Start()
+	gs.State = SessionPlaying
+	return true
+}
+
+func (gs *GameSession) End() bool {
+	if gs.State != SessionPlaying {
+		return false
+	}
+	gs.Game.End()
+	gs.State = SessionEnded
+	return true
+}
+
+// tag 在消息中记录会话ID
+func (gs *GameSession) tag(msg *InboxMessage) *InboxMessage {
+	if msg == nil {
+		msg = NewInboxMessage()
+	}
+	msg.Set(sessionIdKey, strconv.Itoa(gs.ID))
+	return msg
+}
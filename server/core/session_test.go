@@ -0,0 +1,148 @@
+package core
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// login 不经过后台直接登录，返回会话ID
+func (ts *testSrv) login(gameId int, arduinoId string, cardId string, ticketId string) int {
+	id := 0
+	ts.do(func() {
+		gs, reason := ts.joinSession(gameId, arduinoId, cardId, 1)
+		if gs == nil {
+			ts.t.Errorf("card %v rejected by %v: %v", cardId, arduinoId, reason)
+			return
+		}
+		gs.Reserve(cardId)
+		ts.loginTicket(ticketId, cardId, gs)
+		gs.Login(cardId, ticketId)
+		id = gs.ID
+	})
+	return id
+}
+
+func (ts *testSrv) sessionState(id int) string {
+	state := ""
+	ts.do(func() {
+		if gs := ts.findSession(strconv.Itoa(id)); gs != nil {
+			state = gs.State
+		}
+	})
+	return state
+}
+
+// 转发的开始命令来自房间的主控，会话属于刷卡的目标设备
+func TestForwardedStartUsesTargetSession(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	game := strconv.Itoa(ID_Hunter)
+	room1 := ts.login(ID_Hunter, "G-11-1", "card-1", "101")
+	room2 := ts.login(ID_Hunter, "G-11-2", "card-2", "102")
+
+	ts.send("G-11-0", "TYPE", GameStartForward, "GAME", game, "ARDUINO", "G-11-2", "P", "1")
+	waitFor(t, "room 2 playing", func() bool {
+		return ts.sessionState(room2) == SessionPlaying
+	})
+	if state := ts.sessionState(room1); state != SessionLoggedIn {
+		t.Errorf("room 1 state = %v, want %v", state, SessionLoggedIn)
+	}
+}
+
+// 命令来自房间里的另一个arduino时，使用状态符合的最早的会话
+func TestActiveSessionFallbackWithTwoRooms(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	room1 := ts.login(ID_Hunter, "G-11-1", "card-1", "101")
+	room2 := ts.login(ID_Hunter, "G-11-2", "card-2", "102")
+
+	ts.do(func() {
+		gs := ts.activeSession(ID_Hunter, "G-11-9", SessionLoggedIn)
+		if gs == nil || gs.ID != room1 {
+			t.Fatalf("active session = %+v, want %v", gs, room1)
+		}
+		gs.Start()
+		if gs := ts.activeSession(ID_Hunter, "G-11-9", SessionLoggedIn); gs == nil || gs.ID != room2 {
+			t.Errorf("logged in session = %+v, want %v", gs, room2)
+		}
+		if gs := ts.activeSession(ID_Hunter, "G-11-9", SessionPlaying); gs == nil || gs.ID != room1 {
+			t.Errorf("playing session = %+v, want %v", gs, room1)
+		}
+	})
+}
+
+func TestSessionLoginFull(t *testing.T) {
+	gs := NewGameSession(1, ID_Hunter, "G-11-1", 1)
+	if !gs.Login("card-1", "101") {
+		t.Fatal("first login failed")
+	}
+	if gs.Login("card-2", "102") {
+		t.Error("second login accepted by a one player session")
+	}
+	if len(gs.Players) != 1 || gs.HasCard("card-2") {
+		t.Errorf("players = %v, want only card-1", gs.Players)
+	}
+}
+
+// 放弃的登录过期后释放队列和门票
+func TestSessionExpiry(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.login(ID_Hunter, "G-11-1", "card-1", "101")
+	ts.login(ID_Hunter, "G-11-1", "card-2", "102")
+	ts.do(func() {
+		if _, reason := ts.joinSession(ID_Hunter, "G-11-1", "card-3", 1); reason != SessionRejectFull {
+			t.Errorf("third card reason = %q, want %v", reason, SessionRejectFull)
+		}
+	})
+
+	timeout := time.Duration(GetOptions().GameSessionTimeout * float64(time.Second))
+	ts.tickAt(time.Now().Add(timeout / 2))
+	ts.do(func() {
+		if n := len(ts.sessions[sessionKey(ID_Hunter, "G-11-1")]); n != 2 {
+			t.Errorf("sessions before timeout = %v, want 2", n)
+		}
+	})
+	ts.tickAt(time.Now().Add(timeout + time.Second))
+	ts.do(func() {
+		if len(ts.sessions) != 0 {
+			t.Errorf("sessions after timeout = %v, want none", ts.sessions)
+		}
+		if gs, _ := ts.joinSession(ID_Hunter, "G-11-1", "card-3", 1); gs == nil {
+			t.Error("card rejected after sessions expired")
+		}
+	})
+	if ticket, _ := ts.db.Ticket("101"); ticket != nil {
+		t.Errorf("ticket after timeout = %+v, want deleted", ticket)
+	}
+}
+
+// 一个字段不是数字时只丢弃这个字段，游戏照常结束并上传
+func TestGameEndDropsBadField(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	session := ts.login(2, "G-2-1", "card-1", "101")
+	ts.send("G-2-1", "TYPE", GameStart, "GAME", "2")
+	ts.send("G-2-1", "TYPE", GameEnd, "GAME", "2", "LR", "7?", "PR1", "3")
+	waitFor(t, "session uploaded", func() bool {
+		return ts.sessionState(session) == ""
+	})
+
+	records, err := ts.OutboxRecords("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params map[string]string
+	for _, rec := range records {
+		if rec.Api == GameDataFollowCreate {
+			if err := json.Unmarshal([]byte(rec.Params), &params); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if params == nil || params["last_round"] != "0" || params["card_ID1"] != "card-1" {
+		t.Errorf("upload params = %v, want last_round 0", params)
+	}
+}
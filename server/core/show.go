@@ -0,0 +1,190 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+)
+
+var _ = log.Printf
+
+const showsFile = "shows.toml"
+
+// ShowCue 是 show 中的一条定时命令，Payload 中的字段原样放进发给设备的消息
+type ShowCue struct {
+	At      float64
+	Device  string
+	Cmd     string
+	Payload map[string]interface{}
+}
+
+type Show struct {
+	Name string
+	Cues []ShowCue
+}
+
+var showsLock = new(sync.RWMutex)
+var shows map[string]*Show
+
+func GetShow(name string) *Show {
+	showsLock.RLock()
+	defer showsLock.RUnlock()
+	return shows[name]
+}
+
+// ReloadShows 重新读取 shows.toml，读取失败时保留原来的 show
+func ReloadShows() error {
+	return reloadShows(GetOptions().LapseTime)
+}
+
+// reloadShows 读取配置时 GetOptions 还不能调用，step 由调用方给出
+func reloadShows(step float64) error {
+	s, err := loadShows(showsFile, step)
+	if err != nil {
+		return err
+	}
+	showsLock.Lock()
+	defer showsLock.Unlock()
+	shows = s
+	log.Println("shows reloaded:", len(shows))
+	return nil
+}
+
+// loadShows 没有 at 的 cue 在上一条之后 step 秒，第一条为0
+func loadShows(path string, step float64) (map[string]*Show, error) {
+	var file struct {
+		Shows []struct {
+			Name string
+			Cues []map[string]interface{}
+		}
+	}
+	if _, err := toml.DecodeFile(path, &file); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]*Show)
+	for _, s := range file.Shows {
+		if s.Name == "" {
+			return nil, errors.New("show without name")
+		}
+		show := Show{Name: s.Name}
+		at := -step
+		for _, c := range s.Cues {
+			cue, err := newShowCue(c)
+			if err != nil {
+				return nil, errors.New("show " + s.Name + ": " + err.Error())
+			}
+			if _, ok := c["at"]; !ok {
+				cue.At = at + step
+			}
+			at = cue.At
+			show.Cues = append(show.Cues, cue)
+		}
+		sort.SliceStable(show.Cues, func(i, j int) bool {
+			return show.Cues[i].At < show.Cues[j].At
+		})
+		ret[s.Name] = &show
+	}
+	return ret, nil
+}
+
+func newShowCue(c map[string]interface{}) (ShowCue, error) {
+	cue := ShowCue{Payload: make(map[string]interface{})}
+	for k, v := range c {
+		switch k {
+		case "at":
+			switch t := v.(type) {
+			case float64:
+				cue.At = t
+			case int64:
+				cue.At = float64(t)
+			default:
+				return cue, errors.New("cue at must be a number")
+			}
+			if cue.At < 0 {
+				return cue, errors.New("cue at must not be negative")
+			}
+		case "device":
+			cue.Device, _ = v.(string)
+		case "cmd":
+			cue.Cmd, _ = v.(string)
+		default:
+			cue.Payload[k] = v
+		}
+	}
+	if cue.Device == "" || cue.Cmd == "" {
+		return cue, errors.New("cue needs device and cmd")
+	}
+	if att(cue.Device) == InboxAddressTypeUnknown {
+		return cue, errors.New("unknown device " + cue.Device)
+	}
+	return cue, nil
+}
+
+// address 返回 cue 的目标，"N-*" 这样以*结尾的表示同类型的所有设备
+func (cue *ShowCue) address() InboxAddress {
+	if strings.HasSuffix(cue.Device, "*") {
+		return InboxAddress{att(cue.Device), ""}
+	}
+	return InboxAddress{att(cue.Device), cue.Device}
+}
+
+func (cue *ShowCue) message() *InboxMessage {
+	msg := NewInboxMessage()
+	msg.SetCmd(cue.Cmd)
+	for k, v := range cue.Payload {
+		msg.Set(k, v)
+	}
+	return msg
+}
+
+// ShowPlayer 按时间播放一个 show，由调用者的 goroutine 驱动 Tick
+type ShowPlayer struct {
+	show    *Show
+	elapsed float64
+	next    int
+	paused  bool
+	aborted bool
+}
+
+func NewShowPlayer(show *Show) *ShowPlayer {
+	p := ShowPlayer{}
+	p.show = show
+	return &p
+}
+
+// Tick 推进 sec 秒，返回这段时间内到点的 cue
+func (p *ShowPlayer) Tick(sec float64) []ShowCue {
+	if p.paused || p.Done() {
+		return nil
+	}
+	p.elapsed += sec
+	start := p.next
+	for p.next < len(p.show.Cues) && p.show.Cues[p.next].At <= p.elapsed {
+		p.next++
+	}
+	return p.show.Cues[start:p.next]
+}
+
+func (p *ShowPlayer) Pause() {
+	p.paused = true
+}
+
+func (p *ShowPlayer) Resume() {
+	p.paused = false
+}
+
+func (p *ShowPlayer) Abort() {
+	p.aborted = true
+}
+
+func (p *ShowPlayer) Paused() bool {
+	return p.paused
+}
+
+func (p *ShowPlayer) Done() bool {
+	return p.aborted || p.next >= len(p.show.Cues)
+}
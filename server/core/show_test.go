@@ -0,0 +1,47 @@
+package core
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// 没有 at 的 cue 按文件中的顺序，在上一条之后间隔 lapseTime 秒
+func TestShowCueDefaultStep(t *testing.T) {
+	path := filepath.Join(testDir, "shows.toml")
+	data := `
+[[shows]]
+name = "steps"
+[[shows.cues]]
+device = "D-1"
+cmd = "light_ctrl"
+[[shows.cues]]
+device = "D-1"
+cmd = "light_ctrl"
+[[shows.cues]]
+at = 5.0
+device = "N-*"
+cmd = "led_ctrl"
+[[shows.cues]]
+device = "N-*"
+cmd = "led_ctrl"
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	step := GetOptions().LapseTime
+	shows, err := loadShows(path, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{0, step, 5, 5 + step}
+	cues := shows["steps"].Cues
+	if len(cues) != len(want) {
+		t.Fatalf("cues = %+v", cues)
+	}
+	for i, cue := range cues {
+		if cue.At != want[i] {
+			t.Errorf("cue %v at = %v, want %v", i, cue.At, want[i])
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+const matchUpdateInterval = 100 * time.Millisecond // 推送场地状态的间隔
+
+// SimulatorPlayer 连接到服务器的网页模拟器玩家，hall.jsx 显示在线的玩家
+type SimulatorPlayer struct {
+	Address InboxAddress `json:"address"`
+	Status  int          `json:"status"`
+}
+
+// Simulator 无头的场地模拟器，没有硬件时用网页上的虚拟玩家调试玩法参数
+// 场地状态通过 updateMatch 推送给模拟器网页和游戏中屏幕
+type Simulator struct {
+	srv   *Srv
+	arena *Arena
+
+	msgCh   chan *InboxMessage
+	closeCh chan bool
+}
+
+func NewSimulator(s *Srv, id int, mode string, cids []string) *Simulator {
+	sim := Simulator{}
+	sim.srv = s
+	sim.arena = NewArena(id, mode, cids)
+	sim.msgCh = make(chan *InboxMessage, 1000)
+	sim.closeCh = make(chan bool)
+	log.Println("simulator match:", id, "mode:", mode, "players:", cids)
+	return &sim
+}
+
+func (sim *Simulator) ID() int {
+	return sim.arena.ID
+}
+
+// Run 在单独的 goroutine 中运行，只能通过 srv.onMatchEvent 通知主循环，不能直接修改 Srv
+func (sim *Simulator) Run() {
+	dt := 10 * time.Millisecond
+	ticker := time.NewTicker(dt)
+	defer ticker.Stop()
+	defer close(sim.closeCh)
+	lastUpdate := time.Now()
+	for {
+		<-ticker.C
+		sim.handleInputs()
+		sim.arena.Tick(dt.Seconds())
+		if sim.arena.Done() {
+			sim.sendStop()
+			log.Println("simulator match:", sim.ID(), "stop!")
+			sim.srv.onMatchEvent(MatchEvent{Type: MatchEventTypeSimulatorEnd, Data: sim})
+			return
+		}
+		if time.Since(lastUpdate) >= matchUpdateInterval {
+			lastUpdate = time.Now()
+			sim.sendUpdate()
+		}
+	}
+}
+
+func (sim *Simulator) OnMatchCmdArrived(cmd *InboxMessage) {
+	go func() {
+		select {
+		case sim.msgCh <- cmd:
+		case <-sim.closeCh:
+		}
+	}()
+}
+
+func (sim *Simulator) handleInputs() {
+	for {
+		select {
+		case msg := <-sim.msgCh:
+			sim.handleInput(msg)
+		default:
+			return
+		}
+	}
+}
+
+func (sim *Simulator) handleInput(msg *InboxMessage) {
+	cid := ""
+	if msg.Address != nil {
+		cid = msg.Address.ID
+	}
+	switch msg.GetCmd() {
+	case "playerMove":
+		sim.arena.Move(cid, msg.GetStr("dir"))
+	case "playerStop":
+		sim.arena.Move(cid, "")
+	case "stopMatch":
+		sim.arena.Stop()
+	}
+}
+
+// sendUpdate data 为 json 字符串，与网页端的解析方式一致
+func (sim *Simulator) sendUpdate() {
+	b, err := json.Marshal(sim.arena)
+	if err != nil {
+		log.Println("marshal arena error:", err.Error())
+		return
+	}
+	sim.srv.sendMsgs("updateMatch", string(b), InboxAddressTypeSimulatorDevice, InboxAddressTypeIngameDevice)
+}
+
+func (sim *Simulator) sendStop() {
+	data := matchStopData(sim.ID(), sim.arena.Result())
+	sim.srv.sendMsgs("matchStop", data, InboxAddressTypeSimulatorDevice, InboxAddressTypeIngameDevice)
+}
+
+// handleSimulatorMessage 模拟器网页的消息，只有以 -simulator 启动时才处理
+func (s *Srv) handleSimulatorMessage(msg *InboxMessage) {
+	switch msg.GetCmd() {
+	case "init":
+		data := map[string]interface{}{"options": GetOptions(), "ID": msg.Address.ID}
+		s.sendMsg("init", data, msg.Address.ID, msg.Address.Type)
+		s.sendSimulatorPlayers()
+	case "startMatch":
+		if s.simulator != nil {
+			s.sendMsg("error", "simulator match is going", msg.Address.ID, msg.Address.Type)
+			return
+		}
+		mode := msg.GetStr("mode")
+		if mode != MatchModeGold && mode != MatchModeSurvival {
+			s.sendMsg("error", "unknown mode:"+mode, msg.Address.ID, msg.Address.Type)
+			return
+		}
+		s.simulatorId++
+		s.simulator = NewSimulator(s, s.simulatorId, mode, s.simulatorPlayers)
+		go s.simulator.Run()
+		s.sendMsgs("newMatch", s.simulatorId, InboxAddressTypeSimulatorDevice)
+	case "playerMove", "playerStop", "stopMatch":
+		if s.simulator != nil && msg.GetStr("matchID") == strconv.Itoa(s.simulator.ID()) {
+			s.simulator.OnMatchCmdArrived(msg)
+		}
+	}
+}
+
+// updateSimulatorPlayers 模拟器网页连接和断开时调用
+func (s *Srv) updateSimulatorPlayers(msg *InboxMessage) {
+	if addr := msg.RemoveAddress; addr != nil && addr.Type == InboxAddressTypeSimulatorDevice {
+		if i := StrSlice(s.simulatorPlayers).Pos(addr.ID); i >= 0 {
+			s.simulatorPlayers = append(s.simulatorPlayers[:i], s.simulatorPlayers[i+1:]...)
+		}
+		if s.simulator != nil {
+			stop := NewInboxMessage()
+			stop.SetCmd("playerStop")
+			stop.Address = addr
+			s.simulator.OnMatchCmdArrived(stop)
+		}
+		s.sendSimulatorPlayers()
+	}
+	if addr := msg.AddAddress; addr != nil && addr.Type == InboxAddressTypeSimulatorDevice {
+		if StrSlice(s.simulatorPlayers).Pos(addr.ID) < 0 {
+			s.simulatorPlayers = append(s.simulatorPlayers, addr.ID)
+		}
+	}
+}
+
+func (s *Srv) sendSimulatorPlayers() {
+	players := make([]SimulatorPlayer, len(s.simulatorPlayers))
+	for i, id := range s.simulatorPlayers {
+		players[i] = SimulatorPlayer{InboxAddress{InboxAddressTypeSimulatorDevice, id}, 1}
+	}
+	s.sendMsgs("ControllerData", players, InboxAddressTypeSimulatorDevice)
+}
@@ -1,10 +1,15 @@
 package core
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"runtime/debug"
 
+	"challenger/server/protocol"
 	"golang.org/x/net/websocket"
 	"math/rand"
 	"reflect"
@@ -13,25 +18,25 @@ import (
 	"time"
 )
 
-//Arduino msg type
+//Arduino msg type，字段见 protocol 包
 const (
 	UnKnown          = "unknown"
-	Hbt              = "0"
-	GameStartForward = "1"
-	GameStart        = "2"
-	GameEndForward   = "3"
-	GameEnd          = "4"
-	GameData         = "5"
-	AuthorityCheck   = "6"
-	TicketGet        = "7"
-	BoxStatus        = "8"
-	ResetGame        = "9"
-	Event            = "10"
-	DJControl        = "11"
-	MineControl      = "12"
-	BoxStatusGet     = "13"
-	GameReset        = "14"
-	GameRealStart    = "15"
+	Hbt              = protocol.TypeHeartbeat
+	GameStartForward = protocol.TypeGameStartForward
+	GameStart        = protocol.TypeGameStart
+	GameEndForward   = protocol.TypeGameEndForward
+	GameEnd          = protocol.TypeGameEnd
+	GameData         = protocol.TypeGameData
+	AuthorityCheck   = protocol.TypeAuthorityCheck
+	TicketGet        = protocol.TypeTicketGet
+	BoxStatus        = protocol.TypeBoxStatus
+	ResetGame        = protocol.TypeResetGame
+	Event            = protocol.TypeEvent
+	DJControl        = protocol.TypeDJControl
+	MineControl      = protocol.TypeMineControl
+	BoxStatusGet     = protocol.TypeBoxStatusGet
+	GameReset        = protocol.TypeGameReset
+	GameRealStart    = protocol.TypeGameRealStart
 )
 
 var _ = log.Println
@@ -41,40 +46,71 @@ type Srv struct {
 	inboxMessageChan chan *InboxMessage
 	mChan            chan MatchEvent
 	httpResChan      chan *HttpResponse
+	boxChan          chan boxEvent
+	doChan           chan func()
 	aDict            map[string]*ArduinoController
 	match            *Match
 	isSimulator      bool
+	db               *DB
+	outbox           *Outbox
+	authority        *AuthorityCache
 	//--------game info------------
-	boxes        []HunterBox
-	adivainacion *Adivainacion
-	bang         *Bang
-	follow       *Follow
-	greeting     *Greeting
-	highnoon     *Highnoon
-	hunter       *Hunter
-	marksman     *Marksman
-	miner        *Miner
-	privity      *Privity
-	russian      *Russian
-}
-
-func NewSrv(isSimulator bool) *Srv {
+	boxes     []HunterBox
+	sessions  map[string][]*GameSession //同一个房间的会话按刷卡先后排队，第一个是当前会话
+	sessionId int
+	startedAt time.Time
+	adminChan chan *AdminCommand
+	//--------operator------------
+	operatorSessions *operatorSessions
+	adminLogins      map[string]*OperatorSession //管理端 websocket 地址登录的操作员
+	//--------simulator------------
+	laserMatch       *LaserMatch
+	laserMatchId     int
+	simulator        *Simulator
+	simulatorId      int
+	simulatorPlayers []string
+	//--------queue------------
+	teams        []*Team
+	teamId       int
+	queueHistory []MatchData
+}
+
+func NewSrv(isSimulator bool, dbPath string) *Srv {
 	s := Srv{}
 	s.isSimulator = isSimulator
+	s.startedAt = time.Now()
+	db, err := NewDb(dbPath)
+	if err != nil {
+		log.Println("open db error:", err.Error())
+		os.Exit(1)
+	}
+	s.db = db
+	s.outbox = NewOutbox(&s, db)
+	s.authority = NewAuthorityCache(db)
+	if s.laserMatchId, err = db.LastMatchID(); err != nil {
+		log.Println("load last match error:", err.Error())
+	}
 	s.inbox = NewInbox(&s)
 	s.inboxMessageChan = make(chan *InboxMessage, 1)
 	s.mChan = make(chan MatchEvent)
 	s.httpResChan = make(chan *HttpResponse, 1)
+	s.boxChan = make(chan boxEvent)
+	s.doChan = make(chan func())
+	s.adminChan = make(chan *AdminCommand)
+	s.operatorSessions = newOperatorSessions()
+	s.adminLogins = make(map[string]*OperatorSession)
+	s.simulatorPlayers = make([]string, 0)
 	s.aDict = make(map[string]*ArduinoController)
 	s.initArduinoControllers()
 	s.initGameInfo()
+	s.initQueue()
 	return &s
 }
 
-func (s *Srv) Run(tcpAddr string, adminAddr string, dbPath string) {
+func (s *Srv) Run(tcpAddr string, adminAddr string) {
 	go s.listenTcp(tcpAddr)
 	go s.listenTcp(adminAddr)
-	go s.watchBoxStatus()
+	go s.outbox.Run()
 	s.mainLoop()
 }
 
@@ -83,21 +119,61 @@ func (s *Srv) ListenWebSocket(conn *websocket.Conn) {
 	s.inbox.ListenConnection(NewInboxWsConnection(conn))
 }
 
+// OutboxRecords 和 DrainOutbox 只访问数据库，可以在 http goroutine 中直接调用
+func (s *Srv) OutboxRecords(status string) ([]OutboxRecord, error) {
+	return s.outbox.Records(status)
+}
+
+func (s *Srv) DrainOutbox() (int, error) {
+	return s.outbox.Drain()
+}
+
 // http interface
 
 func (s *Srv) mainLoop() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	s.run(ticker.C, nil)
+}
+
+// run 主循环，Srv 的状态只在这里读写，tick 触发每秒的检查，stop 关闭时返回
+func (s *Srv) run(tick <-chan time.Time, stop <-chan struct{}) {
 	for {
 		select {
+		case now := <-tick:
+			s.checkDeviceHealth(now)
+			s.checkSessionExpiry(now)
+			s.refreshWaitTime()
+			s.refreshAuthority(now)
+			s.updateGauges()
+		case evt := <-s.boxChan:
+			s.handleBoxEvent(evt)
 		case httpRes := <-s.httpResChan:
 			s.handleHttpMessage(httpRes)
 		case msg := <-s.inboxMessageChan:
 			s.handleInboxMessage(msg)
 		case evt := <-s.mChan:
 			s.handleMatchEvent(evt)
+		case cmd := <-s.adminChan:
+			s.handleAdminCommand(cmd)
+		case f := <-s.doChan:
+			f()
+		case <-stop:
+			return
 		}
 	}
 }
 
+// do 在主循环中执行 f，返回时 f 已经执行完
+func (s *Srv) do(f func()) {
+	done := make(chan struct{})
+	s.doChan <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
 func (s *Srv) listenTcp(address string) {
 	tcpAddress, err := net.ResolveTCPAddr("tcp", address)
 	if err != nil {
@@ -148,6 +224,28 @@ func (s *Srv) listenAdmin(address string) {
 	}
 }
 
+// recoverMessage 由处理单个消息的函数 defer 调用，固件或后台发来的异常数据引起的panic
+// 只丢弃这一条消息，记录下来源设备和内容，不影响整个场馆
+func (s *Srv) recoverMessage(source string, device string, payload interface{}) {
+	if err := recover(); err != nil {
+		log.Printf("panic handling %v message from %v: %v\npayload:%v\n%s", source, device, err, payload, debug.Stack())
+		metrics.Inc(MetricPanics, "source", source, "device", device)
+	}
+}
+
+func inboxDevice(msg *InboxMessage) string {
+	if msg.Address != nil {
+		return msg.Address.String()
+	}
+	if msg.AddAddress != nil {
+		return msg.AddAddress.String()
+	}
+	if msg.RemoveAddress != nil {
+		return msg.RemoveAddress.String()
+	}
+	return ""
+}
+
 func (s *Srv) onInboxMessageArrived(msg *InboxMessage) {
 	s.inboxMessageChan <- msg
 }
@@ -162,91 +260,29 @@ func (s *Srv) OnHttpRequest(msg *HttpResponse) {
 
 //http msg type
 func (s *Srv) handleHttpMessage(httpRes *HttpResponse) {
+	defer s.recoverMessage("http", httpRes.Msg.GetStr("ID"), httpRes.JsonData)
 	log.Println("data server res:", httpRes.JsonData)
-	switch httpRes.Api {
-	case GameDataAdivinacionCreate:
-		fallthrough
-	case GameDataAdivinacionModify:
-		fallthrough
-	case GameDataBangCreate:
-		fallthrough
-	case GameDataBangModify:
-		fallthrough
-	case GameDataFollowCreate:
-		fallthrough
-	case GameDataFollowModify:
-		fallthrough
-	case GameDataGreetingCreate:
-		fallthrough
-	case GameDataGreetingModify:
-		fallthrough
-	case GameDataHighnoonCreate:
-		fallthrough
-	case GameDataHighnoonModify:
-		fallthrough
-	case GameDataHunterCreate:
-		fallthrough
-	case GameDataHunterModify:
-		fallthrough
-	case GameDataMarksmanCreate:
-		fallthrough
-	case GameDataMarksmanModify:
-		fallthrough
-	case GameDataMinerCreate:
-		fallthrough
-	case GameDataMinerModify:
-		fallthrough
-	case GameDataPrivityCreate:
-		fallthrough
-	case GameDataPrivityModify:
-		fallthrough
-	case GameDataRussianCreate:
-		fallthrough
-	case GameDataRussianModify:
-		if res, ok := httpRes.Get("return").(bool); ok {
+	if isGameUploadApi(httpRes.Api) {
+		//游戏数据已保存在outbox中，上传失败时由outbox负责重试
+		if res, ok := httpRes.Get("return").(bool); !ok || !res {
 			gameId, _ := strconv.Atoi(httpRes.Msg.GetStr("GAME"))
-			if !res {
-				//s.uploadGameInfo(httpRes.Msg, gameId)
-				log.Println("upload game ", gameId, " failed!")
-			} else {
-				s.resetGame(gameId)
-			}
+			log.Println("upload game ", gameId, " failed! outbox will retry")
 		}
+		return
+	}
+	switch httpRes.Api {
 	case AuthorityGet:
-		if httpRes.StatusCode != 200 {
-			arduinoId := httpRes.Msg.GetStr("ID")
-			arduinoType := at(arduinoId)
-			addr := InboxAddress{arduinoType, arduinoId}
-			msg := NewInboxMessage()
-			msg.SetCmd("authority_check")
-			msg.Set("return", "false")
-			s.sendToOne(msg, addr)
-			log.Println("request error:", httpRes.StatusCode)
-			return
-		}
-
-		if res, ok := httpRes.Get("return").(bool); ok {
-			arduinoId := httpRes.Msg.GetStr("ID")
-			arduinoType := at(arduinoId)
-			addr := InboxAddress{arduinoType, arduinoId}
-			msg := NewInboxMessage()
-			msg.SetCmd("authority_check")
-			if res {
-				msg.Set("return", "true")
-			} else {
-				msg.Set("return", "false")
-			}
-			s.sendToOne(msg, addr)
-		}
+		s.handleAuthorityResponse(httpRes)
 	case TicketUse:
 		if res, ok := httpRes.Get("return").(bool); ok {
 			gameId, _ := strconv.Atoi(httpRes.Msg.GetStr("GAME"))
 			if !res {
-				log.Println("Modify Ticket failed!Game ", gameId, "start failed!")
-				//s.gameStart(gameId, httpRes.Msg)
+				log.Println("Modify Ticket failed!Game ", gameId, "start failed! outbox will retry")
 			}
 		}
 	case TicketCheck:
+		gs := s.findSession(httpRes.Msg.GetStr(sessionIdKey))
+		cardId := httpRes.Msg.GetStr("CARD_ID")
 		if httpRes.StatusCode != 200 {
 			arduinoId := httpRes.Msg.GetStr("ID")
 			arduinoType := at(arduinoId)
@@ -255,6 +291,7 @@ func (s *Srv) handleHttpMessage(httpRes *HttpResponse) {
 			msg.SetCmd("ticket_check")
 			msg.Set("return", "false")
 			s.sendToOne(msg, addr)
+			s.releaseSession(gs, cardId)
 			log.Println("request error:", httpRes.StatusCode)
 			return
 		}
@@ -265,15 +302,36 @@ func (s *Srv) handleHttpMessage(httpRes *HttpResponse) {
 		msg := NewInboxMessage()
 		msg.SetCmd("ticket_check")
 		if ticketId, ok := httpRes.Get("id").(float64); ok {
-			if ticketId != -1 {
-				s.loginGame(strconv.FormatFloat(ticketId, 'f', 0, 64), gameId, httpRes.Msg)
-				msg.Set("return", "true")
-				log.Println("it has ticket:", ticketId, " gameId:", gameId)
+			ticket := strconv.FormatFloat(ticketId, 'f', 0, 64)
+			if ticketId != -1 && gs != nil {
+				if reason := s.loginTicket(ticket, cardId, gs); reason != "" {
+					//同一张门票已登录其他会话或已经核销
+					msg.Set("return", TicketCheckRepeat)
+					msg.Set("reason", reason)
+					s.releaseSession(gs, cardId)
+					log.Println("ticket:", ticket, "of card:", cardId, "rejected:", reason)
+				} else if !gs.Login(cardId, ticket) {
+					//人数已满，门票留给其他会话
+					msg.Set("return", TicketCheckFalse)
+					msg.Set("reason", SessionRejectFull)
+					s.releaseTicket(ticket)
+					s.releaseSession(gs, cardId)
+					log.Println("ticket:", ticket, "of card:", cardId, "rejected: session", gs.ID, "is full")
+				} else {
+					msg.Set("return", TicketCheckTrue)
+					log.Println("it has ticket:", ticketId, " gameId:", gameId, " session:", gs.ID)
+				}
+			} else if ticketId != -1 {
+				//等待后台返回时会话已被重置
+				msg.Set("return", "false")
+				log.Println("session of ticket:", ticketId, "has been reset!")
 			} else {
 				msg.Set("return", "false")
+				s.releaseSession(gs, cardId)
 				log.Println("it has'n ticket!")
 			}
 		} else {
+			s.releaseSession(gs, cardId)
 			log.Println("ticketId is'n int!", reflect.TypeOf(ticketId), "ticketId:", ticketId)
 		}
 		res := httpRes.Data
@@ -282,8 +340,7 @@ func (s *Srv) handleHttpMessage(httpRes *HttpResponse) {
 	case BoxUpload:
 		if res, ok := httpRes.Get("return").(bool); ok {
 			if !res {
-				log.Println("Modify BoxStatus failed!")
-				//s.uploadBoxStatus(boxId)
+				log.Println("Modify BoxStatus failed! outbox will retry")
 			} else {
 				log.Println("box has been upload!")
 			}
@@ -292,38 +349,69 @@ func (s *Srv) handleHttpMessage(httpRes *HttpResponse) {
 }
 
 func (s *Srv) handleMatchEvent(evt MatchEvent) {
+	defer s.recoverMessage("match", "", evt.Type)
 	switch evt.Type {
-	//case MatchEventTypeEnd:
+	case MatchEventTypeEnd:
+		//已经被新的match替换的不用处理
+		if m, ok := evt.Data.(*Match); ok && m == s.match {
+			s.match = nil
+		}
 	//case MatchEventTypeUpdate:
+	case MatchEventTypeLaserEnd:
+		if s.laserMatch != nil && uint(s.laserMatch.ID) == evt.ID {
+			s.laserMatch = nil
+		}
+		if result, ok := evt.Data.(*MatchData); ok {
+			s.saveMatch(result)
+			s.onTeamMatchEnd(result)
+		}
+	case MatchEventTypeSimulatorEnd:
+		if sim, ok := evt.Data.(*Simulator); ok && sim == s.simulator {
+			s.simulator = nil
+		}
 	}
 }
 
 func (s *Srv) handleInboxMessage(msg *InboxMessage) {
+	defer s.recoverMessage("inbox", inboxDevice(msg), msg.Data)
 	if msg.RemoveAddress != nil && msg.RemoveAddress.Type.IsArduinoControllerType() {
 		id := msg.RemoveAddress.String()
 		if controller := s.aDict[id]; controller != nil {
-			controller.Online = false
+			s.setOnline(controller, false)
 		}
-		//s.sendMsgs("removeTCP", msg.RemoveAddress, InboxAddressTypeArduinoTestDevice)
+		s.sendMsgs("removeTCP", msg.RemoveAddress, InboxAddressTypeAdminDevice)
+	}
+	if msg.RemoveAddress != nil && msg.RemoveAddress.Type == InboxAddressTypeAdminDevice {
+		delete(s.adminLogins, msg.RemoveAddress.String())
+	}
+	if s.isSimulator {
+		s.updateSimulatorPlayers(msg)
 	}
 
 	if msg.AddAddress != nil && msg.AddAddress.Type.IsArduinoControllerType() {
 		if controller := s.aDict[msg.AddAddress.String()]; controller != nil {
-			controller.Online = true
+			s.setOnline(controller, true)
 		} else {
 			log.Printf("Warning: get arduino connection not belong to list:%v\n", msg.AddAddress.String())
 		}
-		//s.sendMsgs("addTCP", msg.AddAddress, InboxAddressTypeArduinoTestDevice)
+		if msg.AddAddress.Type == InboxAddressTypeBoxArduinoDevice {
+			s.reconcileBox(msg.AddAddress.ID)
+		}
+		s.sendMsgs("addTCP", msg.AddAddress, InboxAddressTypeAdminDevice)
 	}
 	if msg.Address == nil {
 		log.Printf("message has no address:%v\n", msg.Data)
 		return
 	}
+	if controller := s.aDict[msg.Address.String()]; controller != nil {
+		s.deviceSeen(controller, time.Now())
+	}
 	cmd := msg.GetCmd()
 	if len(cmd) == 0 {
 		log.Printf("message has no cmd:%v\n", msg.Data)
 		return
 	}
+	metrics.Inc(MetricInboxMessages, "type", cmd, "device", msg.Address.ID)
 	switch msg.Address.Type {
 	case InboxAddressTypeAdminDevice:
 		s.handleAdminMessage(msg)
@@ -335,124 +423,139 @@ func (s *Srv) handleInboxMessage(msg *InboxMessage) {
 		s.handleArduinoMessage(msg)
 	case InboxAddressTypeDjArduino:
 		s.handleArduinoMessage(msg)
+	case InboxAddressTypeMainArduinoDevice:
+		s.handleArduinoMessage(msg)
+	case InboxAddressTypeQueueDevice:
+		s.handleQueueMessage(msg)
+	case InboxAddressTypeSimulatorDevice:
+		if s.isSimulator {
+			s.handleSimulatorMessage(msg)
+		} else {
+			s.handlePostGameMessage(msg)
+		}
+	default:
+		//网页端(排队、游戏中)等只需要回复init
+		s.handlePostGameMessage(msg)
 	}
 }
 
 func (s *Srv) handleArduinoMessage(msg *InboxMessage) {
-	cmd := msg.GetCmd()
-	switch cmd {
-	case UnKnown:
-		log.Println(msg.GetStr("ID"), "send UnKnown cmd!")
-	case Hbt:
-		//log.Println("Receive htb:", msg.GetStr("ID"),msg.GetStr("CARD_ID"))
-	case GameStartForward:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		arduino := msg.GetStr("ARDUINO")
-		var playerNum string
-		if msg.GetStr("P") != "" {
-			playerNum = msg.GetStr("P")
+	m, err := protocol.Decode(arduinoFrame(msg))
+	if err != nil {
+		log.Println("reject frame from", msg.Address.ID, ":", err.Error())
+		return
+	}
+	switch m := m.(type) {
+	case *protocol.Heartbeat:
+		//log.Println("Receive htb:", m.ID, m.Extra["CARD_ID"])
+	case *protocol.GameStartForward:
+		playerNum := "1"
+		if m.P != 0 {
+			playerNum = strconv.Itoa(m.P)
 			log.Println("rev playerNum:", playerNum)
 		} else {
-			playerNum = "1"
 			log.Println(("this game did't need playerNum!"))
 		}
-		log.Println("Game:", gameId, "start and forward to ", arduino, "! operator:", admin)
-		s.gameControl("1", arduino, playerNum)
-		s.gameStart(gameId, msg)
-	case GameStart:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		log.Println("Game:", gameId, "start! operator:", admin)
-		s.gameStart(gameId, msg)
-	case GameEndForward:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		arduino := msg.GetStr("ARDUINO")
-		log.Println("Game:", gameId, "end and forward to ", arduino, "! operator:", admin)
+		log.Println("Game:", m.Game, "start and forward to ", m.Arduino, "! operator:", m.Admin)
+		//会话属于刷卡的设备，转发的开始命令按目标设备查找
+		if !s.playerNumAllowed(m.Game, m.Arduino, msg) {
+			return
+		}
+		s.auditArduino(msg, "gameStartForward", m.Arduino, m.Game)
+		s.gameControl("1", m.Arduino, playerNum)
+		s.gameStart(m.Game, m.Arduino, msg)
+	case *protocol.GameStart:
+		log.Println("Game:", m.Game, "start! operator:", m.Admin)
+		s.auditArduino(msg, "gameStart", m.ID, m.Game)
+		s.gameStart(m.Game, m.ID, msg)
+	case *protocol.GameEndForward:
+		log.Println("Game:", m.Game, "end and forward to ", m.Arduino, "! operator:", m.Admin)
+		s.auditArduino(msg, "gameEndForward", m.Arduino, m.Game)
 		//不处理数据，只进行转发
-		s.gameControl("0", arduino, "0")
-	case GameEnd:
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		s.gameEnd(msg, gameId)
-		log.Println("Game:", gameId, "end!")
-	case GameData:
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		log.Println("Receive Game:", gameId, "'s data!")
-		s.updateGameInfo(msg, gameId)
-	case AuthorityCheck:
-		arduinoId := msg.GetStr("ID") //创建request的时候需要放入
-		cardId := msg.GetStr("CARD_ID")
-		authorityId := msg.GetStr("AR")
-		log.Println("Get the card:", cardId, "  AuthrorityId:", authorityId, " ArduinoId:", arduinoId)
-		request := NewHttpRequest(s)
-		request.SetApi(AuthorityGet)
-		params := make(map[string]string)
-		params["card_Uid"] = cardId
-		params["authority_ID"] = authorityId
-		params["op"] = "validate_authid"
-		request.SetParams(params)
-		request.SetMsg(msg)
-		request.DoGet()
-	case TicketGet:
-		admin := msg.GetStr("ADMIN")
-		gameId := msg.GetStr("GAME")
-		cardId := msg.GetStr("CARD_ID")
-		log.Println("Ticket Get：  CardId:", cardId, "GameId:", gameId, " Admin:", admin)
+		s.gameControl("0", m.Arduino, "0")
+	case *protocol.GameEnd:
+		s.dropFields(msg, m.Dropped)
+		s.gameEnd(msg, m.Game)
+		log.Println("Game:", m.Game, "end!")
+	case *protocol.GameData:
+		log.Println("Receive Game:", m.Game, "'s data!")
+		s.dropFields(msg, m.Dropped)
+		s.updateGameInfo(msg, m.Game)
+	case *protocol.AuthorityCheck:
+		log.Println("Get the card:", m.CardId, "  AuthrorityId:", m.AR, " ArduinoId:", m.ID)
+		s.requestAuthority(m.CardId, m.AR, msg, false)
+	case *protocol.TicketGet:
+		log.Println("Ticket Get：  CardId:", m.CardId, "GameId:", m.Game, " Admin:", m.Admin)
+		gs, reason := s.joinSession(m.Game, m.ID, m.CardId, m.P)
+		if gs == nil {
+			log.Println("card:", m.CardId, "rejected by game:", m.Game, "reason:", reason)
+			addr := InboxAddress{InboxAddressTypeGameArduinoDevice, m.ID}
+			res := NewInboxMessage()
+			res.SetCmd("ticket_check")
+			if reason == SessionRejectDuplicate {
+				res.Set("return", TicketCheckRepeat)
+			} else {
+				res.Set("return", TicketCheckFalse)
+			}
+			res.Set("reason", reason)
+			s.sendToOne(res, addr)
+			return
+		}
+		gs.Reserve(m.CardId)
+		gs.tag(msg)
 		request := NewHttpRequest(s)
 		request.SetApi(TicketCheck)
 		params := make(map[string]string)
-		params["card_Uid"] = cardId
-		params["game_ID"] = gameId
+		params["card_Uid"] = m.CardId
+		params["game_ID"] = strconv.Itoa(m.Game)
 		params["op"] = "get_ticket_game_id"
 		request.SetParams(params)
 		request.SetMsg(msg)
 		request.DoGet()
-	case BoxStatus:
-		boxId, _ := strconv.Atoi(msg.GetStr("BOX_ID"))
-		boxStatus, _ := strconv.Atoi(msg.GetStr("ST"))
+	case *protocol.BoxStatus:
 		for k := range s.boxes {
-			if s.boxes[k].Box_ID == boxId {
-				s.boxes[k].Box_status = boxStatus
-				switch boxStatus {
+			if s.boxes[k].Box_ID == m.BoxId {
+				if s.boxReported(k, m.ST) {
+					break
+				}
+				s.boxes[k].Box_status = m.ST
+				switch m.ST {
 				case 0:
 					s.uploadBoxStatus(k)
 					s.boxes[k].Reset()
-					log.Println("Box:", boxId, "has'n been opened by player，and reset the box！")
+					log.Println("Box:", m.BoxId, "has'n been opened by player，and reset the box！")
 				case 1:
 					s.uploadBoxStatus(k)
-					log.Println("Box:", boxId, "has been opened by player! Watting reset!")
+					log.Println("Box:", m.BoxId, "has been opened by player! Watting reset!")
 				case 2:
+					s.auditArduino(msg, "resetBox", "B-"+strconv.Itoa(m.BoxId), 0)
 					s.boxes[k].Reset()
-					log.Println("Box:", boxId, "has been reset by admin!")
+					log.Println("Box:", m.BoxId, "has been reset by admin!")
 				}
+				s.saveBox(k)
 				break
 			}
 		}
-	case ResetGame:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		s.resetGame(gameId)
-		log.Println("Admin:", admin, " reset the game:", gameId, "!")
-	case Event:
-		event, _ := strconv.Atoi(msg.GetStr("EVENT"))
-		s.startNewMatch(event)
-	case DJControl:
-		dj, _ := strconv.Atoi(msg.GetStr("DJ"))
-		s.startNewMatch(dj)
-		log.Println("DJ:", dj)
-	case MineControl:
-		mineNum := msg.GetStr("M")
-		control := msg.GetStr("CTRL")
-
+	case *protocol.ResetGame:
+		s.resetGame(m.Game)
+		log.Println("Admin:", m.Admin, " reset the game:", m.Game, "!")
+		s.auditArduino(msg, "resetGame", m.ID, m.Game)
+	case *protocol.Event:
+		s.auditArduino(msg, "event", m.ID, 0)
+		s.startNewMatch(m.Event)
+	case *protocol.DJControl:
+		s.auditArduino(msg, "djControl", m.ID, 0)
+		s.startNewMatch(m.DJ)
+		log.Println("DJ:", m.DJ)
+	case *protocol.MineControl:
 		addr := InboxAddress{InboxAddressTypeGameArduinoDevice, "G-9-2"}
+		s.auditArduino(msg, "mineControl", addr.ID, ID_Miner)
 		msg := NewInboxMessage()
 		msg.SetCmd("mine_ctrl")
-		msg.Set("num", mineNum)
-		msg.Set("ctrl", control)
+		msg.Set("num", m.M)
+		msg.Set("ctrl", m.CTRL)
 		s.sendToOne(msg, addr)
-	case BoxStatusGet:
-		arduinoId := msg.GetStr("ID")
+	case *protocol.BoxStatusGet:
 		box := make([]map[string]string, 0)
 		for i := range s.boxes {
 			var status int
@@ -469,25 +572,83 @@ func (s *Srv) handleArduinoMessage(msg *InboxMessage) {
 				map[string]string{"box_n": strconv.Itoa(s.boxes[i].Box_ID), "box_s": strconv.Itoa(status)},
 			)
 		}
-		addr := InboxAddress{InboxAddressTypeGameArduinoDevice, arduinoId}
+		addr := InboxAddress{InboxAddressTypeGameArduinoDevice, m.ID}
 		msg := NewInboxMessage()
 		msg.SetCmd("box_status")
 		msg.Set("box", box)
 		s.sendToOne(msg, addr)
-	case GameReset:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		arduino := msg.GetStr("ARDUINO")
-		log.Println("Game:", gameId, "reset and forward to ", arduino, "! operator:", admin)
+	case *protocol.GameReset:
+		log.Println("Game:", m.Game, "reset and forward to ", m.Arduino, "! operator:", m.Admin)
+		s.auditArduino(msg, "gameReset", m.Arduino, m.Game)
 		//不处理数据，只进行转发
-		s.gameControl("2", arduino, "0")
-	case GameRealStart:
-		admin := msg.GetStr("ADMIN")
-		gameId, _ := strconv.Atoi(msg.GetStr("GAME"))
-		arduino := msg.GetStr("ARDUINO")
-		log.Println("Game:", gameId, "real start and start time and forward to ", arduino, "! operator:", admin)
+		s.gameControl("2", m.Arduino, "0")
+	case *protocol.GameRealStart:
+		log.Println("Game:", m.Game, "real start and start time and forward to ", m.Arduino, "! operator:", m.Admin)
+		s.auditArduino(msg, "gameRealStart", m.Arduino, m.Game)
 		//不处理数据，只进行转发
-		s.gameControl("3", arduino, "0")
+		s.gameControl("3", m.Arduino, "0")
+	case *protocol.ButtonPress:
+		s.forwardLaserMatch("buttonPress", msg)
+	case *protocol.LaserHit:
+		s.forwardLaserMatch("laserHit", msg)
+	}
+}
+
+// arduinoFrame 把消息还原为设备发送的帧，cmd 是连接根据 TYPE 设置的
+// dropFields 删除解码时丢弃的字段，游戏按没有上报处理，不会把错误的值上传给后台
+func (s *Srv) dropFields(msg *InboxMessage, dropped []*protocol.FieldError) {
+	for _, e := range dropped {
+		log.Println("drop field from", msg.Address.ID, ":", e.Error())
+		delete(msg.Data, e.Field)
+		metrics.Inc(MetricGameDataDropped, "type", e.Type, "device", msg.Address.ID)
+	}
+}
+
+func arduinoFrame(msg *InboxMessage) protocol.Frame {
+	f := make(protocol.Frame)
+	for k, v := range msg.Data {
+		if k == "cmd" {
+			continue
+		}
+		f[k] = fmt.Sprint(v)
+	}
+	return f
+}
+
+func (s *Srv) setOnline(controller *ArduinoController, online bool) {
+	v := 0.0
+	if online {
+		controller.connect(time.Now())
+		v = 1
+	} else {
+		controller.disconnect()
+	}
+	metrics.Set(MetricArduinoOnline, v, "device", controller.Address.ID, "type", strconv.Itoa(int(controller.Address.Type)))
+}
+
+// updateGauges 在主循环中每秒刷新一次需要读取 Srv 状态的指标
+func (s *Srv) updateGauges() {
+	metrics.Set(MetricBoxesTotal, float64(len(s.boxes)))
+	metrics.Set(MetricBoxesAssigned, float64(len(s.boxes)-s.countNotAssignedBoxes()))
+	active := 0.0
+	if s.match != nil {
+		active++
+	}
+	if s.laserMatch != nil {
+		active++
+	}
+	if s.simulator != nil {
+		active++
+	}
+	metrics.Set(MetricMatchesActive, active)
+	states := map[string]int{SessionWaiting: 0, SessionLoggedIn: 0, SessionPlaying: 0, SessionEnded: 0}
+	for _, list := range s.sessions {
+		for _, gs := range list {
+			states[gs.State]++
+		}
+	}
+	for state, n := range states {
+		metrics.Set(MetricGameSessions, float64(n), "state", state)
 	}
 }
 
@@ -498,23 +659,168 @@ func (s *Srv) handlePostGameMessage(msg *InboxMessage) {
 	}
 }
 
+func (s *Srv) sendGameInfo(addr InboxAddress) {
+	msg := NewInboxMessage()
+	msg.SetCmd("GameInfo")
+	msg.Set("ArduinoList", s.arduinoSnapshot())
+	s.sendToOne(msg, addr)
+}
+
+// arduinoSnapshot 按ID排序，客户端每次收到的列表顺序一致
+func (s *Srv) arduinoSnapshot() []ArduinoController {
+	now := time.Now()
+	arduinolist := make([]ArduinoController, 0, len(s.aDict))
+	for _, controller := range s.aDict {
+		arduinolist = append(arduinolist, controller.snapshot(now))
+	}
+	sort.Slice(arduinolist, func(i, j int) bool {
+		return arduinolist[i].ID < arduinolist[j].ID
+	})
+	return arduinolist
+}
+
+// 改变状态的管理端命令，需要先 login
+var adminLoginRequired = map[string]bool{
+	AdminOpGameCtrl:          true,
+	AdminOpEvent:             true,
+	AdminOpResetBox:          true,
+	AdminOpResetSession:      true,
+	AdminOpLaserStart:        true,
+	AdminOpLaserStop:         true,
+	AdminOpOutboxDrain:       true,
+	AdminOpBackendReload:     true,
+	AdminOpShowsReload:       true,
+	AdminOpTeamAdd:           true,
+	AdminOpQueueReset:        true,
+	AdminOpTeamAddPlayer:     true,
+	AdminOpTeamRemovePlayer:  true,
+	AdminOpTeamCall:          true,
+	AdminOpTeamCutLine:       true,
+	AdminOpTeamDelay:         true,
+	AdminOpTeamPrepare:       true,
+	AdminOpTeamCancelPrepare: true,
+	AdminOpTeamChangeMode:    true,
+	AdminOpTeamStart:         true,
+	AdminOpTeamRemove:        true,
+	"playShow":               true,
+	"showPause":              true,
+	"showResume":             true,
+	"showAbort":              true,
+	"queryGameInfo":          true,
+	"queryHallData":          true,
+	"queryOutbox":            true,
+	"queryAudits":            true,
+	"queryAuthority":         true,
+	"queryIncidents":         true,
+	"querySessions":          true,
+}
+
 func (s *Srv) handleAdminMessage(msg *InboxMessage) {
+	operator := s.adminOperator(msg)
+	if adminLoginRequired[msg.GetCmd()] && operator == nil {
+		s.sendAdminResult(msg, nil, errors.New("login required"))
+		return
+	}
 	switch msg.GetCmd() {
 	case "init":
+		//管理端连上或重连后，在init的回复中带上所有arduino的当前状态
+		//每条消息由单独的goroutine发送，分开发送时客户端收到的顺序不确定
+		msg1 := NewInboxMessage()
+		msg1.SetCmd("init")
+		msg1.Set("data", msg.Address)
+		msg1.Set("ArduinoList", s.arduinoSnapshot())
+		s.sendToOne(msg1, *msg.Address)
 	case "gameStart":
 	case "queryGameInfo":
+		s.sendGameInfo(*msg.Address)
+	case "queryHallData":
+		s.sendMsg("HallData", s.teamSnapshot(), msg.Address.ID, msg.Address.Type)
+	case "queryOutbox":
+		records, err := s.outbox.Records(msg.GetStr("status"))
+		if err != nil {
+			log.Println("query outbox error:", err.Error())
+			return
+		}
 		msg1 := NewInboxMessage()
-		msg1.SetCmd("GameInfo")
-		arduinolist := make([]ArduinoController, len(s.aDict))
-		i := 0
-		for _, controller := range s.aDict {
-			arduinolist[i] = *controller
-			i += 1
+		msg1.SetCmd("OutboxInfo")
+		msg1.Set("records", records)
+		s.sendToOne(msg1, *msg.Address)
+	case "login":
+		session, err := s.Login(msg.GetStr("name"), msg.GetStr("password"), "ws", msg.Address.ID)
+		if err == nil {
+			s.adminLogins[msg.Address.String()] = session
+		}
+		s.sendAdminResult(msg, session, err)
+	case "logout":
+		if operator != nil {
+			s.Logout(operator, "ws", msg.Address.ID)
+			delete(s.adminLogins, msg.Address.String())
+		}
+	case AdminOpDevices, AdminOpGameCtrl, AdminOpEvent, AdminOpResetBox, AdminOpResetSession, AdminOpLaserStart, AdminOpLaserStop,
+		AdminOpOutboxDrain, AdminOpBackendReload, AdminOpShowsReload,
+		AdminOpTeamAdd, AdminOpQueueReset, AdminOpTeamAddPlayer, AdminOpTeamRemovePlayer, AdminOpTeamCall, AdminOpTeamCutLine,
+		AdminOpTeamDelay, AdminOpTeamPrepare, AdminOpTeamCancelPrepare, AdminOpTeamChangeMode, AdminOpTeamStart, AdminOpTeamRemove:
+		//与 http 管理接口相同的操作，结果通过 adminResult 返回
+		cmd := AdminCommand{Op: msg.GetCmd(), Params: adminParams(msg), Source: "ws", Remote: msg.Address.ID}
+		if operator != nil {
+			cmd.Operator = operator.Operator
+		}
+		data, err := s.execAdminCommand(&cmd)
+		s.sendAdminResult(msg, data, err)
+	case "queryAudits":
+		if !operator.IsManager() {
+			s.sendAdminResult(msg, nil, errors.New("manager only"))
+			return
+		}
+		q, err := ParseAuditQuery(msg.GetStr)
+		if err != nil {
+			s.sendAdminResult(msg, nil, err)
+			return
+		}
+		audits, err := s.db.Audits(q)
+		if err != nil {
+			log.Println("query audits error:", err.Error())
+			return
+		}
+		msg1 := NewInboxMessage()
+		msg1.SetCmd("AuditInfo")
+		msg1.Set("audits", audits)
+		s.sendToOne(msg1, *msg.Address)
+	case "queryAuthority":
+		limit, _ := strconv.Atoi(msg.GetStr("limit"))
+		decisions, err := s.db.AuthorityDecisions(msg.GetStr("card"), limit)
+		if err != nil {
+			log.Println("query authority decisions error:", err.Error())
+			return
+		}
+		msg1 := NewInboxMessage()
+		msg1.SetCmd("AuthorityInfo")
+		msg1.Set("decisions", decisions)
+		s.sendToOne(msg1, *msg.Address)
+	case "queryIncidents":
+		limit, _ := strconv.Atoi(msg.GetStr("limit"))
+		incidents, err := s.db.Incidents(msg.GetStr("device"), limit)
+		if err != nil {
+			log.Println("query incidents error:", err.Error())
+			return
+		}
+		msg1 := NewInboxMessage()
+		msg1.SetCmd("IncidentInfo")
+		msg1.Set("incidents", incidents)
+		s.sendToOne(msg1, *msg.Address)
+	case "querySessions":
+		msg1 := NewInboxMessage()
+		msg1.SetCmd("SessionInfo")
+		msg1.Set("sessions", s.sessionSnapshot())
+		s.sendToOne(msg1, *msg.Address)
+	case "playShow":
+		s.auditAdminMessage(msg, operator)
+		s.startShow(msg.GetStr("name"))
+	case "showPause", "showResume", "showAbort":
+		s.auditAdminMessage(msg, operator)
+		if s.match != nil {
+			s.match.OnMatchCmdArrived(msg)
 		}
-		msg1.Set("ArduinoList", arduinolist)
-		//log.Println(msg)
-		addr := InboxAddress{msg.Address.Type, msg.Address.ID}
-		s.sendToOne(msg1, addr)
 	case "nextStep":
 	case "gameOver":
 	case "completed":
@@ -523,29 +829,68 @@ func (s *Srv) handleAdminMessage(msg *InboxMessage) {
 	}
 }
 
-func (s *Srv) startNewMatch(event int) {
-	if s.match != nil {
-		if s.match.IsGoing {
-			return
-		} else if event != s.match.Event {
-			s.stopMatch()
-			m := NewMatch(s, event)
-			s.match = m
-			go m.Run()
+// adminOperator 返回管理端 websocket 登录的操作员，没有登录或已过期时返回 nil
+func (s *Srv) adminOperator(msg *InboxMessage) *OperatorSession {
+	session := s.adminLogins[msg.Address.String()]
+	if session == nil {
+		return nil
+	}
+	if s.operatorSessions.get(session.Token) == nil {
+		delete(s.adminLogins, msg.Address.String())
+		return nil
+	}
+	return session
+}
+
+func (s *Srv) sendAdminResult(msg *InboxMessage, data interface{}, err error) {
+	msg1 := NewInboxMessage()
+	msg1.SetCmd("adminResult")
+	msg1.Set("op", msg.GetCmd())
+	msg1.Set("data", data)
+	if err != nil {
+		msg1.Set("error", err.Error())
+	}
+	s.sendToOne(msg1, *msg.Address)
+}
+
+// auditAdminMessage 记录没有对应 AdminOp 的管理端命令
+func (s *Srv) auditAdminMessage(msg *InboxMessage, operator *OperatorSession) {
+	params, _ := json.Marshal(adminParams(msg))
+	s.Audit(AdminAudit{Operator: operator.Operator, Source: "ws", Remote: msg.Address.ID, Op: msg.GetCmd(), Params: string(params), Result: "ok"})
+}
+
+func adminParams(msg *InboxMessage) map[string]string {
+	params := make(map[string]string)
+	for k := range msg.Data {
+		if k != "cmd" {
+			params[k] = msg.GetStr(k)
 		}
-	} else {
-		m := NewMatch(s, event)
-		s.match = m
-		go m.Run()
 	}
+	return params
 }
 
-func (s *Srv) stopMatch() {
+func (s *Srv) startNewMatch(event int) {
+	//match结束后会通过 MatchEventTypeEnd 清空 s.match，不为空说明还在进行
 	if s.match != nil {
-		s.match.Stop()
-		s.match = nil
+		return
 	}
+	m := NewMatch(s, event)
+	s.match = m
+	go m.Run()
+}
 
+func (s *Srv) startShow(name string) {
+	if GetShow(name) == nil {
+		log.Println("show not found:", name)
+		return
+	}
+	if s.match != nil {
+		log.Println("show:", s.match.ShowName, "is playing, ignore show:", name)
+		return
+	}
+	m := newShowMatch(s, name)
+	s.match = m
+	go m.Run()
 }
 
 func (s *Srv) sendMsg(cmd string, data interface{}, id string, t InboxAddressType) {
@@ -641,23 +986,27 @@ func (s *Srv) initArduinoControllers() {
 		controller := NewArduinoController(addr)
 		s.aDict[addr.String()] = controller
 	}
+	for _, controller := range s.aDict {
+		s.setOnline(controller, false)
+	}
 }
 
 func (s *Srv) initGameInfo() {
-	s.adivainacion = NewAdivainacion()
-	s.bang = NewBang()
-	s.follow = NewFollow()
-	s.greeting = NewGreeting()
-	s.highnoon = NewHighnoon()
-	s.hunter = NewHunter()
-	s.marksman = NewMarksman()
-	s.miner = NewMiner()
-	s.privity = NewPrivity()
-	s.russian = NewRussian()
+	s.sessions = make(map[string][]*GameSession)
 	s.boxes = make([]HunterBox, GetOptions().BoxNum)
 	for i := range s.boxes {
 		s.boxes[i].Box_ID = i
 	}
+	//恢复重启前的宝箱分配，宝箱arduino连上后再同步
+	if err := s.db.LoadBoxes(s.boxes); err != nil {
+		log.Println("load boxes error:", err.Error())
+	}
+	for i := range s.boxes {
+		if s.boxes[i].IsAssigned {
+			s.watchBoxExpiry(&s.boxes[i])
+		}
+	}
+	log.Println(s.getNotAssignedBoxTotalNum(), "boxes free after restore")
 }
 
 func (s *Srv) bgmControl(music string) {
@@ -667,758 +1016,307 @@ func (s *Srv) bgmControl(music string) {
 	s.sends(msg, InboxAddressTypeDjArduino)
 }
 
-func (s *Srv) loginGame(ticketId string, gameId int, msg *InboxMessage) {
-	//log.Println("login:", msg)
-	cardId := msg.GetStr("CARD_ID")
-	switch gameId {
-	case ID_Russian:
-		s.russian.LoginInfo.setCardId(cardId)
-		s.russian.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Adivainacion:
-		s.adivainacion.LoginInfo.setCardId(cardId)
-		s.adivainacion.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Bang:
-		s.bang.LoginInfo.setCardId(cardId)
-		s.bang.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Follow:
-		s.follow.LoginInfo.setCardId(cardId)
-		s.follow.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Greeting:
-		s.greeting.LoginInfo.setCardId(cardId)
-		s.greeting.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Highnoon:
-		s.highnoon.LoginInfo.setCardId(cardId)
-		s.highnoon.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Hunter:
-		s.hunter.LoginInfo.setCardId(cardId)
-		s.hunter.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Marksman:
-		s.marksman.LoginInfo.setCardId(cardId)
-		s.marksman.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Miner:
-		s.miner.LoginInfo.setCardId(cardId)
-		s.miner.LoginInfo.setTicket(cardId, ticketId)
-	case ID_Privity:
-		s.privity.LoginInfo.setCardId(cardId)
-		s.privity.LoginInfo.setTicket(cardId, ticketId)
-	}
-}
-
-func (s *Srv) gameStart(gameId int, msg *InboxMessage) {
+func (s *Srv) gameStart(gameId int, arduinoId string, msg *InboxMessage) {
+	if !s.playerNumAllowed(gameId, arduinoId, msg) {
+		return
+	}
+	gs := s.activeSession(gameId, arduinoId, SessionLoggedIn)
+	if gs == nil || !gs.Start() {
+		log.Println("game:", gameId, "start without logged in session, ignored!")
+		return
+	}
 	admin := msg.GetStr("ADMIN")
-	request := NewHttpRequest(s)
-	request.SetMsg(msg)
-	request.SetApi(TicketUse)
-	params := make(map[string]string)
-	params["op"] = "set_exchanger_id"
-	switch gameId {
-	case ID_Russian:
-		s.russian.Time_start = currentTime()
-		s.russian.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.russian.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.russian.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.russian.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.russian.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Adivainacion:
-		s.adivainacion.Time_start = currentTime()
-		s.adivainacion.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.adivainacion.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.adivainacion.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.adivainacion.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.adivainacion.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Bang:
-		s.bang.Time_start = currentTime()
-		s.bang.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.bang.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.bang.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.bang.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.bang.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Follow:
-		s.follow.Time_start = currentTime()
-		s.follow.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.follow.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.follow.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.follow.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.follow.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
+	info := gs.Game.GetLoginInfo()
+	//每个玩家的门票分别核销
+	for _, cardId := range info.Cards() {
+		ticketId := info.CardTicketInfo[cardId]
+		if !s.redeemTicket(ticketId, gs) {
+			log.Println("ticket:", ticketId, "of card:", cardId, "has been redeemed, skip!")
+			continue
 		}
-	case ID_Greeting:
-		s.greeting.Time_start = currentTime()
-		s.greeting.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.greeting.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.greeting.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.greeting.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.greeting.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Highnoon:
-		s.highnoon.Time_start = currentTime()
-		s.highnoon.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.highnoon.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.highnoon.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.highnoon.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.highnoon.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Hunter:
-		s.hunter.Time_start = currentTime()
-		s.hunter.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.hunter.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.hunter.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.hunter.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.hunter.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Marksman:
-		s.marksman.Time_start = currentTime()
-		s.marksman.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.marksman.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.marksman.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.marksman.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.marksman.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Miner:
-		s.miner.Time_start = currentTime()
-		s.miner.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.miner.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.miner.LoginInfo.PlayerCardInfo["2p"]
-		params["game_ID"] = strconv.Itoa(gameId)
-		params["exchanger_ID"] = admin
-		params["id"] = s.miner.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.miner.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
-	case ID_Privity:
-		s.privity.Time_start = currentTime()
-		s.privity.LoginInfo.IsUploadInfo = true
-		cardId_1p := s.privity.LoginInfo.PlayerCardInfo["1p"]
-		cardId_2p := s.privity.LoginInfo.PlayerCardInfo["2p"]
+		params := make(map[string]string)
+		params["op"] = "set_exchanger_id"
 		params["game_ID"] = strconv.Itoa(gameId)
 		params["exchanger_ID"] = admin
-		params["id"] = s.privity.LoginInfo.CardTicketInfo[cardId_1p]
-		request.SetParams(params)
-		request.DoPost()
-		if cardId_2p != "" {
-			request2 := NewHttpRequest(s)
-			request2.SetMsg(msg)
-			request2.SetApi(TicketUse)
-			params2 := make(map[string]string)
-			params2["op"] = "set_exchanger_id"
-			params2["game_ID"] = strconv.Itoa(gameId)
-			params2["exchanger_ID"] = admin
-			params2["id"] = s.privity.LoginInfo.CardTicketInfo[cardId_2p]
-			request2.SetParams(params2)
-			request2.DoPost()
-		}
+		params["id"] = ticketId
+		//后台按 idempotency_key 去重，同一张门票的核销重试多少次都只生效一次
+		params[idempotencyKeyParam] = "ticket-use-" + ticketId
+		s.upload(TicketUse, params, gs.tag(msg))
 	}
 }
 
+// playerNumAllowed 开始命令带 P 时，登录的人数不能超过 P
+func (s *Srv) playerNumAllowed(gameId int, arduinoId string, msg *InboxMessage) bool {
+	playerNum, err := strconv.Atoi(msg.GetStr("P"))
+	if err != nil {
+		return true
+	}
+	gs := s.activeSession(gameId, arduinoId, SessionLoggedIn)
+	if gs != nil && len(gs.Players) > playerNum {
+		log.Println("game:", gameId, "has", len(gs.Players), "players logged in, more than P:", playerNum, "start rejected!")
+		return false
+	}
+	return true
+}
+
 func (s *Srv) gameEnd(msg *InboxMessage, gameId int) {
-	//s.hunter.LoginInfo.IsUploadInfo = true
-	//s.hunter.Time_start = currentTime()
-	//s.hunter.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B1104848EBDED9FF70"
-	//s.hunter.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104848EBDED9FF70"] = "ticketId1"
-	//s.hunter.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-	//s.hunter.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-	//s.hunter.Time_firstButton = "5"
-	//s.hunter.Box_ID = 4
-	s.updateGameInfo(msg, gameId)
-	/*            test code
-		switch gameId {
-		case ID_Russian:
-			s.russian.LoginInfo.IsUploadInfo = true
-			s.russian.Time_start = currentTime()
-			//s.russian.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.russian.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.russian.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.russian.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.russian.Bullet_trigger = "3"
-			//s.russian.Desk_num = "5"
-		case ID_Adivainacion:
-			s.adivainacion.LoginInfo.IsUploadInfo = true
-			s.adivainacion.Time_start = currentTime()
-			//s.adivainacion.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.adivainacion.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.adivainacion.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.adivainacion.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-		case ID_Bang:
-			s.bang.LoginInfo.IsUploadInfo = true
-			s.bang.Time_start = currentTime()
-			//s.bang.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.bang.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.bang.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.bang.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.bang.Point_round[1] = "6"
-			//s.bang.Point_round[2] = "5"
-			//s.bang.Point_round[3] = "4"
-		case ID_Follow:
-			s.follow.LoginInfo.IsUploadInfo = true
-			s.follow.Time_start = currentTime()
-			//s.follow.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.follow.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.follow.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.follow.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.follow.Last_round = "10"
-		case ID_Greeting:
-			s.greeting.LoginInfo.IsUploadInfo = true
-			s.greeting.Time_start = currentTime()
-			//s.greeting.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.greeting.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.greeting.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.greeting.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-		case ID_Highnoon:
-			s.highnoon.LoginInfo.IsUploadInfo = true
-			s.highnoon.Time_start = currentTime()
-			//s.highnoon.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.highnoon.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.highnoon.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.highnoon.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.highnoon.Result_round_1p[1] = "0.11"
-			//s.highnoon.Result_round_2p[1] = "0.12"
-			//s.highnoon.Result_round_1p[2] = "0.21"
-			//s.highnoon.Result_round_2p[2] = "0.22"
-			//s.highnoon.Result_round_1p[3] = "0.31"
-			//s.highnoon.Result_round_2p[3] = "0.32"
-			//s.highnoon.Result_round_1p[4] = "0.41"
-			//s.highnoon.Result_round_2p[4] = "0.42"
-			//s.highnoon.Result_round_1p[5] = "0.51"
-			//s.highnoon.Result_round_2p[5] = "0.52"
-			//s.highnoon.Result_round_1p[6] = "0.61"
-			//s.highnoon.Result_round_2p[6] = "0.62"
-			//log.Println(s.highnoon.Result_round_1p)
-		case ID_Hunter:
-			s.hunter.LoginInfo.IsUploadInfo = true
-			s.hunter.Time_start = currentTime()
-			s.hunter.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			s.hunter.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			s.hunter.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			s.hunter.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			s.hunter.Time_firstButton = "5"
-			s.hunter.Box_ID = 1
-		case ID_Marksman:
-			s.marksman.LoginInfo.IsUploadInfo = true
-			s.marksman.Time_start = currentTime()
-			//s.marksman.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.marksman.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.marksman.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.marksman.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.marksman.Point_right = "10"
-			//s.marksman.Point_left = "20"
-		case ID_Miner:
-			s.miner.LoginInfo.IsUploadInfo = true
-			s.miner.Time_start = currentTime()
-			//s.miner.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.miner.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.miner.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.miner.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-		case ID_Privity:
-			s.privity.LoginInfo.IsUploadInfo = true
-			s.privity.Time_start = currentTime()
-			//s.privity.LoginInfo.PlayerCardInfo["1p"] = "00FF0FF000FFCF4D54B110484DBDBBB104D0"
-			//s.privity.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B110484DBDBBB104D0"] = "ticketId1"
-			//s.privity.LoginInfo.PlayerCardInfo["2p"] = "00FF0FF000FFCF4D54B1104846B4FBC10480"
-			//s.privity.LoginInfo.CardTicketInfo["00FF0FF000FFCF4D54B1104846B4FBC10480"] = "ticketId2"
-			//s.privity.Num_right = "10"
-			//s.privity.Num_question = "20"
-		}
-	                test      code                */
-	switch gameId {
-	case ID_Russian:
-		s.russian.Time_end = currentTime()
-	case ID_Adivainacion:
-		s.adivainacion.Time_end = currentTime()
-	case ID_Bang:
-		s.bang.Time_end = currentTime()
-	case ID_Follow:
-		s.follow.Time_end = currentTime()
-	case ID_Greeting:
-		s.greeting.Time_end = currentTime()
-	case ID_Highnoon:
-		s.highnoon.Time_end = currentTime()
-	case ID_Hunter:
-		s.hunter.Time_end = currentTime()
-	case ID_Marksman:
-		s.marksman.Time_end = currentTime()
-	case ID_Miner:
-		s.miner.Time_end = currentTime()
-	case ID_Privity:
-		s.privity.Time_end = currentTime()
-	}
-	s.uploadGameInfo(msg, gameId)
+	gs := s.activeSession(gameId, msg.GetStr("ID"), SessionPlaying)
+	if gs == nil || gs.State != SessionPlaying {
+		log.Println("game:", gameId, "end without playing session, ignored!")
+		return
+	}
+	gs.Game.ApplyData(s, msg)
+	gs.End()
+	s.uploadGameInfo(msg, gs)
 }
 
+// resetGame 丢弃这个游戏所有房间的会话，包括排队中的
 func (s *Srv) resetGame(gameId int) {
-	switch gameId {
-	case ID_Russian:
-		s.russian.Reset()
-	case ID_Adivainacion:
-		s.adivainacion.Reset()
-	case ID_Bang:
-		s.bang.Reset()
-	case ID_Follow:
-		s.follow.Reset()
-	case ID_Greeting:
-		s.greeting.Reset()
-	case ID_Highnoon:
-		s.highnoon.Reset()
-	case ID_Hunter:
-		s.hunter.Reset()
-	case ID_Marksman:
-		s.marksman.Reset()
-	case ID_Miner:
-		s.miner.Reset()
-	case ID_Privity:
-		s.privity.Reset()
+	for key, list := range s.sessions {
+		if len(list) > 0 && list[0].GameId == gameId {
+			for _, gs := range list {
+				s.releaseTickets(gs)
+			}
+			delete(s.sessions, key)
+		}
 	}
 }
 
 func (s *Srv) updateGameInfo(msg *InboxMessage, gameId int) {
-	switch gameId {
-	case ID_Russian:
-		if msg.GetStr("BT") != "" {
-			s.russian.Bullet_trigger = msg.GetStr("BT")
-		} else {
-			s.russian.Bullet_trigger = "0"
-		}
+	gs := s.activeSession(gameId, msg.GetStr("ID"), SessionPlaying)
+	if gs == nil || gs.State != SessionPlaying {
+		log.Println("game:", gameId, "data without playing session, ignored!")
+		return
+	}
+	gs.Game.ApplyData(s, msg)
+}
 
-		if msg.GetStr("DN") != "" {
-			s.russian.Desk_num = msg.GetStr("DN")
-		} else {
-			s.russian.Desk_num = "0"
-		}
-	case ID_Adivainacion:
-	case ID_Bang:
-		if msg.GetStr("PR1") != "" {
-			s.bang.Point_round[1] = msg.GetStr("PR1")
-		} else {
-			s.bang.Point_round[1] = "0"
-		}
+func (s *Srv) uploadGameInfo(msg *InboxMessage, gs *GameSession) {
+	if gs.Game.GetLoginInfo().IsUploadInfo {
+		s.upload(gs.Game.UploadApi(), gs.Game.BuildUpload(), gs.tag(msg))
+	}
+	//数据已交给outbox，会话结束，排队的下一组成为当前会话
+	gs.State = SessionUploaded
+	s.removeSession(gs)
+}
 
-		if msg.GetStr("PR2") != "" {
-			s.bang.Point_round[2] = msg.GetStr("PR2")
-		} else {
-			s.bang.Point_round[2] = "0"
-		}
-		if msg.GetStr("PR3") != "" {
-			s.bang.Point_round[3] = msg.GetStr("PR3")
-		} else {
-			s.bang.Point_round[3] = "0"
-		}
-	case ID_Follow:
-		if msg.GetStr("LR") != "" {
-			s.follow.Last_round = msg.GetStr("LR")
-		} else {
-			s.follow.Last_round = "0"
-		}
-	case ID_Greeting:
-	case ID_Highnoon:
-		if msg.GetStr("R1P1") != "" {
-			s.highnoon.Result_round_1p[1] = msg.GetStr("R1P1")
-		} else {
-			s.highnoon.Result_round_1p[1] = "0"
-		}
+// upload 把数据交给outbox持久化后再上传，数据库不可用时退回到直接上传
+func (s *Srv) upload(api string, params map[string]string, msg *InboxMessage) {
+	if err := s.outbox.Enqueue(api, params, msg); err != nil {
+		log.Println("outbox enqueue error:", err.Error())
+		request := NewHttpRequest(s)
+		request.SetApi(api)
+		request.SetMsg(msg)
+		request.SetParams(params)
+		request.DoPost()
+	}
+}
 
-		if msg.GetStr("R1P2") != "" {
-			s.highnoon.Result_round_2p[1] = msg.GetStr("R1P2")
-		} else {
-			s.highnoon.Result_round_2p[1] = "0"
+// joinSession 为刷卡的玩家找到可以加入的会话，人数已满时新建一个排队，队列也满时拒绝
+func (s *Srv) joinSession(id int, arduinoId string, cardId string, playerNum int) (*GameSession, string) {
+	if NewGame(id) == nil {
+		return nil, SessionRejectUnknownGame
+	}
+	key := sessionKey(id, arduinoId)
+	list := s.sessions[key]
+	for _, gs := range list {
+		if gs.HasCard(cardId) {
+			return nil, SessionRejectDuplicate
 		}
-
-		if msg.GetStr("R2P1") != "" {
-			s.highnoon.Result_round_1p[2] = msg.GetStr("R2P1")
-		} else {
-			s.highnoon.Result_round_1p[2] = "0"
+	}
+	for _, gs := range list {
+		if gs.CanJoin() {
+			return gs, ""
 		}
+	}
+	if len(list) >= sessionMaxQueue {
+		return nil, SessionRejectFull
+	}
+	s.sessionId++
+	gs := NewGameSession(s.sessionId, id, arduinoId, playerNum)
+	s.sessions[key] = append(list, gs)
+	log.Println("new session:", gs.ID, "game:", id, "arduino:", arduinoId)
+	return gs, ""
+}
 
-		if msg.GetStr("R2P2") != "" {
-			s.highnoon.Result_round_2p[2] = msg.GetStr("R2P2")
-		} else {
-			s.highnoon.Result_round_2p[2] = "0"
+// activeSession 返回房间的当前会话，开始、结束命令可能来自房间里的另一个arduino，
+// 这时使用这个游戏中状态为 state 的当前会话，有多个房间时取最早创建的
+func (s *Srv) activeSession(gameId int, arduinoId string, state string) *GameSession {
+	if list := s.sessions[sessionKey(gameId, arduinoId)]; len(list) > 0 {
+		return list[0]
+	}
+	var ret *GameSession
+	for _, list := range s.sessions {
+		if len(list) == 0 || list[0].GameId != gameId || list[0].State != state {
+			continue
 		}
-
-		if msg.GetStr("R3P1") != "" {
-			s.highnoon.Result_round_1p[3] = msg.GetStr("R3P1")
-		} else {
-			s.highnoon.Result_round_1p[3] = "0"
+		if ret == nil || list[0].ID < ret.ID {
+			ret = list[0]
 		}
+	}
+	return ret
+}
 
-		if msg.GetStr("R3P2") != "" {
-			s.highnoon.Result_round_2p[3] = msg.GetStr("R3P2")
-		} else {
-			s.highnoon.Result_round_2p[3] = "0"
+// checkSessionExpiry 丢弃游戏开始前长时间没有动作的会话，避免放弃的登录一直占着队列
+func (s *Srv) checkSessionExpiry(now time.Time) {
+	timeout := time.Duration(GetOptions().GameSessionTimeout * float64(time.Second))
+	expired := make([]*GameSession, 0)
+	for _, list := range s.sessions {
+		for _, gs := range list {
+			if gs.Expired(now, timeout) {
+				expired = append(expired, gs)
+			}
 		}
+	}
+	for _, gs := range expired {
+		log.Println("session:", gs.ID, "game:", gs.GameId, "arduino:", gs.ArduinoId, "expired!")
+		s.removeSession(gs)
+	}
+}
 
-		if msg.GetStr("R4P1") != "" {
-			s.highnoon.Result_round_1p[4] = msg.GetStr("R4P1")
-		} else {
-			s.highnoon.Result_round_1p[4] = "0"
+func (s *Srv) findSession(id string) *GameSession {
+	for _, list := range s.sessions {
+		for _, gs := range list {
+			if strconv.Itoa(gs.ID) == id {
+				return gs
+			}
 		}
+	}
+	return nil
+}
 
-		if msg.GetStr("R4P2") != "" {
-			s.highnoon.Result_round_2p[4] = msg.GetStr("R4P2")
-		} else {
-			s.highnoon.Result_round_2p[4] = "0"
-		}
+// releaseSession 门票没有确认时释放位置，没有玩家的会话直接丢弃
+func (s *Srv) releaseSession(gs *GameSession, cardId string) {
+	if gs == nil {
+		return
+	}
+	gs.Release(cardId)
+	if gs.Idle() {
+		s.removeSession(gs)
+	}
+}
 
-		if msg.GetStr("R5P1") != "" {
-			s.highnoon.Result_round_1p[5] = msg.GetStr("R5P1")
-		} else {
-			s.highnoon.Result_round_1p[5] = "0"
+func (s *Srv) removeSession(gs *GameSession) {
+	s.releaseTickets(gs)
+	key := gs.Key()
+	list := s.sessions[key]
+	for i := range list {
+		if list[i] == gs {
+			list = append(list[:i], list[i+1:]...)
+			break
 		}
+	}
+	if len(list) == 0 {
+		delete(s.sessions, key)
+	} else {
+		s.sessions[key] = list
+	}
+}
 
-		if msg.GetStr("R5P2") != "" {
-			s.highnoon.Result_round_2p[5] = msg.GetStr("R5P2")
-		} else {
-			s.highnoon.Result_round_2p[5] = "0"
-		}
+func (s *Srv) sessionSnapshot() []*GameSession {
+	ret := make([]*GameSession, 0)
+	for _, list := range s.sessions {
+		ret = append(ret, list...)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].ID < ret[j].ID
+	})
+	return ret
+}
 
-		if msg.GetStr("R6P1") != "" {
-			s.highnoon.Result_round_1p[6] = msg.GetStr("R6P1")
-		} else {
-			s.highnoon.Result_round_1p[6] = "0"
-		}
+// 寻宝游戏按下第一个按钮后，为玩家分配宝箱
+func (s *Srv) assignHunterBox(game *Hunter) {
+	cards := game.LoginInfo.Cards()
+	rBoxID := s.setBox(cards)
+	if rBoxID == -1 {
+		return
+	}
+	game.Box_ID = s.boxes[rBoxID].Box_ID
+	s.sendBoxSet(&s.boxes[rBoxID])
+	log.Println(s.boxes)
+	log.Println("assigned box ~ cards:", cards)
+}
 
-		if msg.GetStr("R6P2") != "" {
-			s.highnoon.Result_round_2p[6] = msg.GetStr("R6P2")
-		} else {
-			s.highnoon.Result_round_2p[6] = "0"
-		}
+func (s *Srv) sendBoxSet(box *HunterBox) {
+	arduinoId := returnBox(box.Box_ID)
+	if arduinoId == "" {
+		return
+	}
+	addr := InboxAddress{InboxAddressTypeBoxArduinoDevice, arduinoId}
+	msg := NewInboxMessage()
+	msg.SetCmd("box_set")
+	msg.Set("cardId1", box.Card_ID1)
+	if box.Card_ID2 != "" {
+		msg.Set("cardId2", box.Card_ID2)
+	} else {
+		log.Println("none cardId2")
+	}
+	//3、4人的卡号只在 cardIds 中，旧的固件只读 cardId1 和 cardId2
+	msg.Set("cardIds", box.Cards())
+	s.sendToOne(msg, addr)
+}
 
-		if msg.GetStr("R7P1") != "" {
-			s.highnoon.Result_round_1p[7] = msg.GetStr("R7P1")
-		} else {
-			s.highnoon.Result_round_1p[7] = "0"
-		}
+// 宝箱上线后等待上报状态的时间
+const boxReconcileTimeout = 10 * time.Second
 
-		if msg.GetStr("R7P2") != "" {
-			s.highnoon.Result_round_2p[7] = msg.GetStr("R7P2")
-		} else {
-			s.highnoon.Result_round_2p[7] = "0"
-		}
-	case ID_Hunter:
-		s.hunter.Time_firstButton = msg.GetStr("FB")
-		if s.hunter.Time_firstButton != "0" && s.hunter.Time_firstButton != "" {
-			//choose box
-			cardId1 := s.hunter.LoginInfo.PlayerCardInfo["1p"]
-			cardId2 := s.hunter.LoginInfo.PlayerCardInfo["2p"]
-			rBoxID := s.setBox(cardId1, cardId2)
-			if rBoxID != -1 {
-				s.hunter.Box_ID = s.boxes[rBoxID].Box_ID
-				arduinoId := returnBox(s.hunter.Box_ID)
-				if arduinoId != "" {
-					addr := InboxAddress{InboxAddressTypeBoxArduinoDevice, arduinoId}
-					msg := NewInboxMessage()
-					msg.SetCmd("box_set")
-					msg.Set("cardId1", cardId1)
-					if cardId2 != "" {
-						msg.Set("cardId2", cardId2)
-					} else {
-						log.Println("none cardId2")
-					}
-					s.sendToOne(msg, addr)
-				}
-				log.Println(s.boxes)
-				log.Println("assigned box ~ cardId1:", cardId1, " cardId2:", cardId2)
-			}
-		} else {
-			s.hunter.Time_firstButton = "0"
-		}
-	case ID_Marksman:
-		if msg.GetStr("PR") != "" {
-			s.marksman.Point_right = msg.GetStr("PR")
-		} else {
-			s.marksman.Point_right = "0"
+// reconcileBox 宝箱arduino上线时先发送 box_status_get 查询宝箱的状态，重启或断线期间宝箱可能丢失了卡号，
+// 也可能已经被打开，宝箱通过 BoxStatus 上报后再决定是否重发分配
+func (s *Srv) reconcileBox(arduinoId string) {
+	found := false
+	for i := range s.boxes {
+		if box := &s.boxes[i]; returnBox(box.Box_ID) == arduinoId {
+			box.reconcileAt = time.Now().Add(boxReconcileTimeout)
+			s.afterBox(boxEvent{BoxID: box.Box_ID, Reconcile: true, At: box.reconcileAt})
+			found = true
 		}
+	}
+	if !found {
+		return
+	}
+	log.Println("query box status of:", arduinoId)
+	msg := NewInboxMessage()
+	msg.SetCmd("box_status_get")
+	s.sendToOne(msg, InboxAddress{InboxAddressTypeBoxArduinoDevice, arduinoId})
+}
 
-		if msg.GetStr("PL") != "" {
-			s.marksman.Point_left = msg.GetStr("PL")
-		} else {
-			s.marksman.Point_left = "0"
-		}
-	case ID_Miner:
-	case ID_Privity:
-		if msg.GetStr("NR") != "" {
-			s.privity.Num_right = msg.GetStr("NR")
-		} else {
-			s.privity.Num_right = "0"
-		}
+// boxReported 处理宝箱上线后的第一次上报，返回 true 时不再按普通的状态变化处理
+// 宝箱关闭(ST 0)只说明还没有被打开，分配没有过期时重发 box_set，离线期间过期的重发 box_reset
+// 打开(ST 1)和管理员重置(ST 2)与平时一样处理
+func (s *Srv) boxReported(k int, st int) bool {
+	box := &s.boxes[k]
+	if box.reconcileAt.IsZero() {
+		return false
+	}
+	box.reconcileAt = time.Time{}
+	if st != 0 {
+		return false
+	}
+	log.Println("box:", box.Box_ID, "reported closed")
+	s.resendBox(box)
+	return true
+}
 
-		if msg.GetStr("NQ") != "" {
-			s.privity.Num_question = msg.GetStr("NQ")
-		} else {
-			s.privity.Num_question = "0"
-		}
+// resendBox 宝箱重新上线后补发离线期间丢失的分配或重置
+func (s *Srv) resendBox(box *HunterBox) {
+	if !box.IsAssigned || box.Box_status == 1 {
+		return
+	}
+	if boxExpired(box, time.Now()) {
+		s.sendBoxReset(box)
+	} else {
+		s.sendBoxSet(box)
 	}
 }
 
-func (s *Srv) uploadGameInfo(msg *InboxMessage, gameId int) {
-	switch gameId {
-	case ID_Russian:
-		if !s.russian.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Adivainacion:
-		if !s.adivainacion.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Bang:
-		if !s.bang.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Follow:
-		if !s.follow.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Greeting:
-		if !s.greeting.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Highnoon:
-		if !s.highnoon.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Hunter:
-		if !s.hunter.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Marksman:
-		if !s.marksman.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Miner:
-		if !s.miner.LoginInfo.IsUploadInfo {
-			return
-		}
-	case ID_Privity:
-		if !s.privity.LoginInfo.IsUploadInfo {
-			return
-		}
+func boxExpired(box *HunterBox, now time.Time) bool {
+	validityTime, err := time.ParseInLocation("2006-01-02 15:04:05", box.Time_validity, time.Local)
+	return err == nil && !validityTime.After(now)
+}
+
+func (s *Srv) saveBox(k int) {
+	if err := s.db.SaveBox(&s.boxes[k]); err != nil {
+		log.Println("save box error:", err.Error())
 	}
-	//arduinoId := msg.GetStr("ID")
-	params := make(map[string]string)
-	request := NewHttpRequest(s)
-	switch gameId {
-	case ID_Russian:
-		request.SetApi(GameDataRussianCreate)
-		params["card_ID1"] = s.russian.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.russian.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.russian.Time_start
-		params["time_end"] = s.russian.Time_end
-		params["desk_no"] = s.russian.Desk_num
-		params["bullet_trigger"] = s.russian.Bullet_trigger
-		params["op"] = "set_russian"
-	case ID_Adivainacion:
-		request.SetApi(GameDataAdivinacionCreate)
-		params["card_ID"] = s.adivainacion.LoginInfo.PlayerCardInfo["1p"]
-		params["time_start"] = s.adivainacion.Time_start
-		params["time_end"] = s.adivainacion.Time_end
-		params["op"] = "set_adivinacion"
-	case ID_Bang:
-		request.SetApi(GameDataBangCreate)
-		params["card_ID"] = s.bang.LoginInfo.PlayerCardInfo["1p"]
-		params["time_start"] = s.bang.Time_start
-		params["time_end"] = s.bang.Time_end
-		params["point_round1"] = s.bang.Point_round[1]
-		params["point_round2"] = s.bang.Point_round[2]
-		params["point_round3"] = s.bang.Point_round[3]
-		params["op"] = "set_bang"
-	case ID_Follow:
-		request.SetApi(GameDataFollowCreate)
-		params["card_ID1"] = s.follow.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.follow.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.follow.Time_start
-		params["time_end"] = s.follow.Time_end
-		params["last_round"] = s.follow.Last_round
-		params["op"] = "set_follow"
-	case ID_Greeting:
-		request.SetApi(GameDataGreetingCreate)
-		params["card_ID1"] = s.greeting.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.greeting.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.greeting.Time_start
-		params["time_end"] = s.greeting.Time_end
-		params["op"] = "set_greeting"
-	case ID_Highnoon:
-		request.SetApi(GameDataHighnoonCreate)
-		params["card_ID1"] = s.highnoon.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.highnoon.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.highnoon.Time_start
-		params["time_end"] = s.highnoon.Time_end
-		params["1p_result_round1"] = s.highnoon.Result_round_1p[1]
-		params["2p_result_round1"] = s.highnoon.Result_round_2p[1]
-		params["1p_result_round2"] = s.highnoon.Result_round_1p[2]
-		params["2p_result_round2"] = s.highnoon.Result_round_2p[2]
-		params["1p_result_round3"] = s.highnoon.Result_round_1p[3]
-		params["2p_result_round3"] = s.highnoon.Result_round_2p[3]
-		params["1p_result_round4"] = s.highnoon.Result_round_1p[4]
-		params["2p_result_round4"] = s.highnoon.Result_round_2p[4]
-		params["1p_result_round5"] = s.highnoon.Result_round_1p[5]
-		params["2p_result_round5"] = s.highnoon.Result_round_2p[5]
-		params["1p_result_round6"] = s.highnoon.Result_round_1p[6]
-		params["2p_result_round6"] = s.highnoon.Result_round_2p[6]
-		params["1p_result_round7"] = s.highnoon.Result_round_1p[7]
-		params["2p_result_round7"] = s.highnoon.Result_round_2p[7]
-		params["op"] = "set_highnoon"
-	case ID_Hunter:
-		request.SetApi(GameDataHunterCreate)
-		params["card_ID1"] = s.hunter.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.hunter.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.hunter.Time_start
-		params["time_end"] = s.hunter.Time_end
-		params["time_firstbutton"] = s.hunter.Time_firstButton
-		params["box_ID"] = strconv.Itoa(s.hunter.Box_ID + 1)
-		params["op"] = "set_hunter"
-	case ID_Marksman:
-		request.SetApi(GameDataMarksmanCreate)
-		params["card_ID1"] = s.marksman.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.marksman.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.marksman.Time_start
-		params["time_end"] = s.marksman.Time_end
-		params["point_left"] = s.marksman.Point_left
-		params["point_right"] = s.marksman.Point_right
-		params["op"] = "set_marksman"
-	case ID_Miner:
-		request.SetApi(GameDataMinerCreate)
-		params["card_ID1"] = s.miner.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.miner.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.miner.Time_start
-		params["time_end"] = s.miner.Time_end
-		params["op"] = "set_miner"
-	case ID_Privity:
-		request.SetApi(GameDataPrivityCreate)
-		params["card_ID1"] = s.privity.LoginInfo.PlayerCardInfo["1p"]
-		params["card_ID2"] = s.privity.LoginInfo.PlayerCardInfo["2p"]
-		params["time_start"] = s.privity.Time_start
-		params["time_end"] = s.privity.Time_end
-		params["number_question"] = s.privity.Num_question
-		params["number_right"] = s.privity.Num_right
-		params["op"] = "set_privity"
-	}
-	//request.SetArduinoId(arduinoId)
-	request.SetMsg(msg)
-	request.SetParams(params)
-	request.DoPost()
 }
 
 func (s *Srv) uploadBoxStatus(boxNum int) {
@@ -1428,12 +1326,14 @@ func (s *Srv) uploadBoxStatus(boxNum int) {
 	params["time_validity"] = s.boxes[boxNum].Time_validity
 	params["card_ID1"] = s.boxes[boxNum].Card_ID1
 	params["card_ID2"] = s.boxes[boxNum].Card_ID2
+	for i, cardId := range s.boxes[boxNum].Cards() {
+		if i >= 2 {
+			params["card_ID"+strconv.Itoa(i+1)] = cardId
+		}
+	}
 	params["box_status"] = strconv.Itoa(s.boxes[boxNum].Box_status)
 	params["op"] = "set_hunter_box"
-	request := NewHttpRequest(s)
-	request.SetApi(BoxUpload)
-	request.SetParams(params)
-	request.DoPost()
+	s.upload(BoxUpload, params, nil)
 }
 
 //根据num 返回boxId
@@ -1463,7 +1363,7 @@ func returnBox(boxNum int) string {
 	return ""
 }
 
-func (s *Srv) setBox(cardId1, cardId2 string) int {
+func (s *Srv) setBox(cards []string) int {
 	boxId := s.getRandomBoxId()
 	//for k := range s.boxes {
 	//	if s.boxes[k].Box_ID == 0 && !s.boxes[k].IsAssigned {
@@ -1475,12 +1375,13 @@ func (s *Srv) setBox(cardId1, cardId2 string) int {
 	} else {
 		s.boxes[boxId].IsAssigned = true
 		s.boxes[boxId].Box_status = -1
-		s.boxes[boxId].Card_ID1 = cardId1
-		s.boxes[boxId].Card_ID2 = cardId2
+		s.boxes[boxId].setCards(cards)
 		s.boxes[boxId].Time_build = currentTime()
 		s.boxes[boxId].Time_validity = boxLastTime()
+		s.watchBoxExpiry(&s.boxes[boxId])
 		log.Println("BoxId:", s.boxes[boxId].Box_ID, " is assigned!")
 		log.Println("BoxInfo:", s.boxes[boxId])
+		s.saveBox(boxId)
 	}
 	return boxId
 }
@@ -1496,14 +1397,20 @@ func (s *Srv) getRandomBoxId() int {
 
 //获得没有被分配出去的宝箱数量
 func (s *Srv) getNotAssignedBoxTotalNum() int {
-	var totalNum int = 0
+	totalNum := s.countNotAssignedBoxes()
+	log.Println(totalNum, " boxes is not assigned!")
+	return totalNum
+}
+
+// countNotAssignedBoxes 与 getNotAssignedBoxTotalNum 相同但不打日志，每秒更新指标时使用
+func (s *Srv) countNotAssignedBoxes() int {
+	n := 0
 	for i := range s.boxes {
 		if !s.boxes[i].IsAssigned {
-			totalNum++
+			n++
 		}
 	}
-	log.Println(totalNum, " boxes is not assigned!")
-	return totalNum
+	return n
 }
 
 //从没有被分配出去的宝箱中挑选一个
@@ -1517,36 +1424,71 @@ func (s *Srv) generateRandomNumber(boxTotalNum int) int {
 	return num
 }
 
-func (s *Srv) watchBoxStatus() {
-	dt := 1000 * time.Millisecond
-	tickChan := time.Tick(dt)
-	for {
-		<-tickChan
-		for i := range s.boxes {
-			if s.boxes[i].IsAssigned && s.boxes[i].Box_status != 1 {//宝箱被分配出去，且没有被打开过，则需要检查
-				loc, _ := time.LoadLocation("Local")
-				validityTime, err := time.ParseInLocation("2006-01-02 15:04:05", s.boxes[i].Time_validity, loc)
-				//log.Println("validityTime:", validityTime)
-				if err == nil {
-					lastTime := validityTime.Unix()
-					timeNow := time.Now().Unix()
-					if lastTime <= timeNow {
-						//log.Println("boxNum:",s.boxes[i].Box_ID," now:", timeNow, " endTime", lastTime)
-						//s.boxes[i].Box_status = 0
-						var arduinoId string
-						arduinoId = returnBox(s.boxes[i].Box_ID)
-						log.Println("arduinoId:",arduinoId)
-						addr := InboxAddress{InboxAddressTypeBoxArduinoDevice, arduinoId}
-						msg := NewInboxMessage()
-						msg.SetCmd("box_reset")
-						msg.Set("num", strconv.Itoa(i))
-						s.sendToOne(msg, addr)
-					}
-				}
-			}
+// boxEvent 宝箱的定时事件，由 time.AfterFunc 发到主循环
+// At 与宝箱当前的截止时间不同时，说明宝箱已经重新分配或上线，事件作废
+type boxEvent struct {
+	BoxID     int
+	Reconcile bool // true 为上线后等待上报超时，false 为分配过期
+	At        time.Time
+}
+
+func (s *Srv) afterBox(evt boxEvent) {
+	time.AfterFunc(time.Until(evt.At), func() {
+		s.boxChan <- evt
+	})
+}
+
+// watchBoxExpiry 分配宝箱或重启恢复分配后调用，过期时通知宝箱重置一次
+func (s *Srv) watchBoxExpiry(box *HunterBox) {
+	validity, err := time.ParseInLocation("2006-01-02 15:04:05", box.Time_validity, time.Local)
+	if err != nil {
+		log.Println("box:", box.Box_ID, "bad validity:", box.Time_validity)
+		return
+	}
+	s.afterBox(boxEvent{BoxID: box.Box_ID, At: validity})
+}
+
+func (s *Srv) findBox(boxId int) *HunterBox {
+	for i := range s.boxes {
+		if s.boxes[i].Box_ID == boxId {
+			return &s.boxes[i]
+		}
+	}
+	return nil
+}
 
+// handleBoxEvent 宝箱被分配出去且没有被打开过，过期后通知宝箱重置
+// 上线后没有按时上报状态的宝箱(不支持 box_status_get 的固件)直接补发
+func (s *Srv) handleBoxEvent(evt boxEvent) {
+	box := s.findBox(evt.BoxID)
+	if box == nil {
+		return
+	}
+	if evt.Reconcile {
+		if box.reconcileAt.IsZero() || !box.reconcileAt.Equal(evt.At) {
+			return
 		}
+		box.reconcileAt = time.Time{}
+		log.Println("box:", box.Box_ID, "did not report status")
+		s.resendBox(box)
+		return
+	}
+	if !box.IsAssigned || box.Box_status == 1 || box.Time_validity != evt.At.Format("2006-01-02 15:04:05") {
+		return
+	}
+	s.sendBoxReset(box)
+}
+
+func (s *Srv) sendBoxReset(box *HunterBox) {
+	arduinoId := returnBox(box.Box_ID)
+	if arduinoId == "" {
+		return
 	}
+	log.Println("box:", box.Box_ID, "expired, reset", arduinoId)
+	msg := NewInboxMessage()
+	msg.SetCmd("box_reset")
+	msg.Set("num", strconv.Itoa(box.Box_ID))
+	s.sendToOne(msg, InboxAddress{InboxAddressTypeBoxArduinoDevice, arduinoId})
 }
 
 func currentTime() string {
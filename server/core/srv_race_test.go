@@ -0,0 +1,238 @@
+package core
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 这些测试让多个设备同时发消息，用 go test -race 运行才能发现数据竞争
+
+func panicCount() float64 {
+	return metricValue(MetricPanics)
+}
+
+// metricValue 返回所有标签的合计
+func metricValue(name string) float64 {
+	n := 0.0
+	for _, c := range GetMetrics().Counters() {
+		if c.Name == name {
+			n += c.Value
+		}
+	}
+	return n
+}
+
+// ticker 模拟主循环的每秒检查，直到 stop 关闭
+func (ts *testSrv) ticker(stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(2 * time.Millisecond):
+			ts.tickAt(time.Now())
+		}
+	}
+}
+
+// heartbeats 所有设备不停地发送心跳，直到 stop 关闭
+func (ts *testSrv) heartbeats(ids []string, stop chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		for _, id := range ids {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ts.send(id, "TYPE", Hbt)
+		}
+	}
+}
+
+// playHunter 一个寻宝房间从刷卡到上传，按下第一个按钮时分配宝箱
+func (ts *testSrv) playHunter(t *testing.T, arduino string, card string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	conn := ts.connect(InboxAddressTypeGameArduinoDevice, arduino)
+	ts.send(arduino, "TYPE", TicketGet, "GAME", strconv.Itoa(ID_Hunter), "CARD_ID", card, "P", "1")
+	if m := conn.waitReceived(t, "ticket_check", 1)[0]; m["return"] != TicketCheckTrue {
+		t.Errorf("%v ticket_check = %v", arduino, m)
+		return
+	}
+	ts.send(arduino, "TYPE", GameStart, "GAME", strconv.Itoa(ID_Hunter), "P", "1")
+	ts.send(arduino, "TYPE", GameData, "GAME", strconv.Itoa(ID_Hunter), "FB", "12")
+	ts.send(arduino, "TYPE", GameEnd, "GAME", strconv.Itoa(ID_Hunter))
+}
+
+func TestConcurrentBoxAssignmentAndExpiry(t *testing.T) {
+	_, closeMock := newMockBackend(t)
+	defer closeMock()
+	ts := newTestSrv(t)
+	defer ts.close()
+	go ts.outbox.Run()
+	panics := panicCount()
+
+	boxes := make(map[string]*testConn)
+	for _, id := range GetOptions().BoxArduino {
+		boxes[id] = ts.connectBox(id)
+	}
+	//上线时没有分配，宝箱上报的状态不改变任何东西
+	for id, c := range boxes {
+		c.waitReceived(t, "box_status_get", 1)
+		ts.send(id, "TYPE", BoxStatus, "BOX_ID", strconv.Itoa(boxNum(id)), "ST", "0")
+	}
+
+	stop := make(chan struct{})
+	bg := new(sync.WaitGroup)
+	bg.Add(2)
+	go ts.ticker(stop, bg)
+	go ts.heartbeats(append(GetOptions().GameArduino, GetOptions().BoxArduino...), stop, bg)
+
+	const rooms = 4
+	wg := new(sync.WaitGroup)
+	for i := 1; i <= rooms; i++ {
+		wg.Add(1)
+		go ts.playHunter(t, "G-11-"+strconv.Itoa(i), "card-"+strconv.Itoa(i), wg)
+	}
+	wg.Wait()
+
+	//每个房间分到不同的宝箱
+	var assigned map[string]string
+	waitFor(t, "boxes assigned", func() bool {
+		assigned = make(map[string]string)
+		ts.do(func() {
+			for _, box := range ts.boxes {
+				if box.IsAssigned {
+					assigned[returnBox(box.Box_ID)] = box.Card_ID1
+				}
+			}
+		})
+		return len(assigned) == rooms
+	})
+	cards := make(map[string]bool)
+	for id, card := range assigned {
+		cards[card] = true
+		if m := boxes[id].waitReceived(t, "box_set", 1)[0]; m["cardId1"] != card {
+			t.Errorf("%v box_set = %v, want card %v", id, m, card)
+		}
+	}
+	if len(cards) != rooms {
+		t.Errorf("assigned cards = %v, want %v different cards", assigned, rooms)
+	}
+
+	//分配过期后宝箱收到 box_reset，重置后上报关闭
+	ts.do(func() {
+		for i := range ts.boxes {
+			if ts.boxes[i].IsAssigned {
+				ts.boxes[i].Time_validity = time.Now().Add(-time.Minute).Format("2006-01-02 15:04:05")
+				ts.watchBoxExpiry(&ts.boxes[i])
+			}
+		}
+	})
+	for id := range assigned {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			if m := boxes[id].waitReceived(t, "box_reset", 1)[0]; m["num"] != strconv.Itoa(boxNum(id)) {
+				t.Errorf("%v box_reset = %v, want num %v", id, m, boxNum(id))
+			}
+			ts.send(id, "TYPE", BoxStatus, "BOX_ID", strconv.Itoa(boxNum(id)), "ST", "0")
+		}(id)
+	}
+	wg.Wait()
+	waitFor(t, "boxes reset", func() bool {
+		n := 0
+		ts.do(func() {
+			n = len(ts.boxes) - ts.countNotAssignedBoxes()
+		})
+		return n == 0
+	})
+	close(stop)
+	bg.Wait()
+	if n := panicCount() - panics; n != 0 {
+		t.Errorf("%v panics while handling messages", n)
+	}
+}
+
+func boxNum(id string) int {
+	for i := range GetOptions().BoxArduino {
+		if returnBox(i) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestConcurrentLaserMatchStartStop(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	panics := panicCount()
+	ingame := ts.connect(InboxAddressTypeIngameDevice, "ingame")
+	mains := make([]string, 0)
+	for _, info := range GetOptions().MainArduinoInfo {
+		mains = append(mains, info.ID)
+	}
+
+	stop := make(chan struct{})
+	bg := new(sync.WaitGroup)
+	bg.Add(3)
+	go ts.ticker(stop, bg)
+	go ts.heartbeats(append(mains, GetOptions().DjArduino...), stop, bg)
+	//比赛进行或结束时，主控一直上报按钮和碰激光
+	go func() {
+		defer bg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := mains[i%len(mains)]
+			ts.send(id, "TYPE", "16", "PLAYER", strconv.Itoa(i%2+1), "LV", strconv.Itoa(i%4))
+			ts.send(id, "TYPE", "17", "PLAYER", strconv.Itoa(i%2+1))
+		}
+	}()
+	//同时播放一个 show
+	ts.send(GetOptions().DjArduino[0], "TYPE", DJControl, "DJ", "1")
+
+	const matches = 5
+	for i := 1; i <= matches; i++ {
+		id, err := ts.Admin(AdminCommand{Op: AdminOpLaserStart, Params: map[string]string{"mode": MatchModeGold, "players": "a,b"}, Source: "test"})
+		if err != nil {
+			t.Fatal("laser start:", err)
+		}
+		//激光房间的比赛也计入进行中的 match
+		ts.do(func() {
+			want := 1.0
+			if ts.match != nil {
+				want++
+			}
+			ts.updateGauges()
+			if n := metricValue(MetricMatchesActive); ts.laserMatch != nil && n != want {
+				t.Errorf("active matches = %v, want %v", n, want)
+			}
+		})
+		if _, err := ts.Admin(AdminCommand{Op: AdminOpLaserStop, Source: "test"}); err != nil {
+			t.Fatal("laser stop:", err)
+		}
+		waitFor(t, "laser match end", func() bool {
+			running := true
+			ts.do(func() { running = ts.laserMatch != nil })
+			return !running
+		})
+		match, err := ts.Match(uint(id.(int)))
+		if err != nil || match == nil {
+			t.Fatalf("match %v not saved: %v", id, err)
+		}
+	}
+	close(stop)
+	bg.Wait()
+	if n := len(ingame.waitReceived(t, "matchStop", matches)); n != matches {
+		t.Errorf("matchStop = %v, want %v", n, matches)
+	}
+	if n := panicCount() - panics; n != 0 {
+		t.Errorf("%v panics while handling messages", n)
+	}
+}
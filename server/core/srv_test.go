@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// 所有测试的数据库都在这个目录，测试结束后删除，outbox 等 goroutine 在测试之间不会停止
+var testDir string
+
+func TestMain(m *testing.M) {
+	// cfg.toml、warmup.toml 和 shows.toml 在 server 目录，GetOptions 按当前目录读取
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	GetOptions()
+	dir, err := ioutil.TempDir("", "challenger-test")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+	code := m.Run()
+	os.RemoveAll(testDir)
+	os.Exit(code)
+}
+
+// testSrv 用临时数据库创建 Srv 并运行主循环，每秒的检查由测试通过 tick 触发
+type testSrv struct {
+	*Srv
+	t     *testing.T
+	tick  chan time.Time
+	stop  chan struct{}
+	l     *sync.Mutex
+	conns []*testConn
+}
+
+func newTestSrv(t *testing.T) *testSrv {
+	dir, err := ioutil.TempDir(testDir, "srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testSrv{t: t}
+	ts.Srv = NewSrv(false, filepath.Join(dir, "test.db"))
+	ts.l = new(sync.Mutex)
+	ts.tick = make(chan time.Time)
+	ts.stop = make(chan struct{})
+	go ts.run(ts.tick, ts.stop)
+	return ts
+}
+
+// close 停止循环，还在运行的 goroutine 不再有人接收，只在测试结束时调用
+func (ts *testSrv) close() {
+	ts.l.Lock()
+	for _, c := range ts.conns {
+		c.Close()
+	}
+	ts.l.Unlock()
+	close(ts.stop)
+}
+
+func (ts *testSrv) tickAt(now time.Time) {
+	ts.tick <- now
+}
+
+// connect 模拟一个已经连上的设备，记录发给它的消息
+func (ts *testSrv) connect(t InboxAddressType, id string) *testConn {
+	c := newTestConn(InboxAddress{t, id})
+	ts.l.Lock()
+	ts.conns = append(ts.conns, c)
+	ts.l.Unlock()
+	go ts.inbox.ListenConnection(c)
+	waitFor(ts.t, "connection of "+id, func() bool {
+		ts.inbox.l.RLock()
+		defer ts.inbox.l.RUnlock()
+		for _, cli := range ts.inbox.cdict {
+			if cli.conn == c {
+				return true
+			}
+		}
+		return false
+	})
+	return c
+}
+
+// send 模拟设备发来一帧，字段成对给出，cmd 与 tcp 连接一样取 TYPE
+func (ts *testSrv) send(id string, fields ...string) {
+	ts.onInboxMessageArrived(arduinoMsg(id, fields...))
+}
+
+func arduinoMsg(id string, fields ...string) *InboxMessage {
+	msg := NewInboxMessage()
+	msg.Set("ID", id)
+	for i := 0; i+1 < len(fields); i += 2 {
+		msg.Set(fields[i], fields[i+1])
+	}
+	msg.SetCmd(msg.GetStr("TYPE"))
+	msg.Address = &InboxAddress{at(id), id}
+	return msg
+}
+
+// waitFor 每10ms检查一次 cond，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testConn 实现 InboxConnection，只接收发给自己地址的消息
+type testConn struct {
+	addr   InboxAddress
+	l      *sync.Mutex
+	msgs   []map[string]interface{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newTestConn(addr InboxAddress) *testConn {
+	c := testConn{addr: addr}
+	c.l = new(sync.Mutex)
+	c.closed = make(chan struct{})
+	return &c
+}
+
+func (c *testConn) ReadJSON(v *InboxMessage) error {
+	<-c.closed
+	v.ShouldCloseConnection = true
+	return nil
+}
+
+// WriteJSON 与真实连接一样先序列化，保存的是发送时的内容
+func (c *testConn) WriteJSON(v *InboxMessage) error {
+	b, err := v.Marshal()
+	if err != nil {
+		return err
+	}
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(b, &data); err != nil {
+		return err
+	}
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.msgs = append(c.msgs, data)
+	return nil
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *testConn) Accept(addr InboxAddress) bool {
+	return addr.Type == c.addr.Type && (addr.ID == "" || addr.ID == c.addr.ID)
+}
+
+// received 返回收到的 cmd 相同的消息，按收到的顺序
+func (c *testConn) received(cmd string) []map[string]interface{} {
+	c.l.Lock()
+	defer c.l.Unlock()
+	ret := make([]map[string]interface{}, 0)
+	for _, m := range c.msgs {
+		if m["cmd"] == cmd {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// waitReceived 等待收到 n 条 cmd 相同的消息
+func (c *testConn) waitReceived(t *testing.T, cmd string, n int) []map[string]interface{} {
+	var ret []map[string]interface{}
+	waitFor(t, cmd+" to "+c.addr.ID, func() bool {
+		ret = c.received(cmd)
+		return len(ret) >= n
+	})
+	return ret
+}
@@ -0,0 +1,434 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+// TeamStatus 与 iOS 管理端 Team.swift 中的 TeamStatus 一致
+type TeamStatus int
+
+const (
+	TeamStatusWaiting  TeamStatus = iota // 排队中
+	TeamStatusPrepare                    // 准备中，讲解规则、穿戴装备
+	TeamStatusPlaying                    // 游戏中
+	TeamStatusAfter                      // 结算中，服务器目前不使用
+	TeamStatusFinished                   // 已离开队列
+)
+
+// 排队操作，前台取号页面、排队屏幕和 iOS 管理端共用
+const (
+	AdminOpTeamAdd           = "addTeam"
+	AdminOpQueueReset        = "resetQueue"
+	AdminOpTeamAddPlayer     = "teamAddPlayer"
+	AdminOpTeamRemovePlayer  = "teamRemovePlayer"
+	AdminOpTeamCall          = "teamCall"
+	AdminOpTeamCutLine       = "teamCutLine"
+	AdminOpTeamDelay         = "teamDelay"
+	AdminOpTeamPrepare       = "teamPrepare"
+	AdminOpTeamCancelPrepare = "teamCancelPrepare"
+	AdminOpTeamChangeMode    = "teamChangeMode"
+	AdminOpTeamStart         = "teamStart"
+	AdminOpTeamRemove        = "teamRemove"
+)
+
+const (
+	teamMaxDelay    = 4 // queue.jsx 只有 0-4 次推迟的图标
+	queueHistoryNum = 3 // 排队屏幕显示最近几局的成绩
+)
+
+// Team 对应数据库中的 teams 表，一条记录是前台取的一个号
+type Team struct {
+	ID         uint       `gorm:"primary_key" json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	TeamID     string     `gorm:"index" json:"id"` // 号码，重置队列后从1开始
+	Position   int        `json:"-"`               // 在队列中的顺序
+	Size       int        `json:"size"`
+	Mode       string     `json:"mode"`
+	Status     TeamStatus `gorm:"index" json:"status"`
+	DelayCount int        `json:"delayCount"`
+	Calling    int        `json:"calling"` // 叫号次数，推迟后清零
+	MatchID    uint       `json:"matchId"`
+	StartedAt  time.Time  `json:"-"`
+	WaitTime   int        `sql:"-" json:"waitTime"` // 预计等待的分钟数
+}
+
+func (Team) TableName() string {
+	return "teams"
+}
+
+func (db *DB) SaveTeam(team *Team) error {
+	return db.conn.Save(team).Error
+}
+
+func (db *DB) DeleteTeam(team *Team) error {
+	return db.conn.Delete(team).Error
+}
+
+// QueueTeams 还没有离开队列的号，按队列顺序
+func (db *DB) QueueTeams() ([]*Team, error) {
+	ret := make([]*Team, 0)
+	err := db.conn.Where("status < ?", TeamStatusFinished).Order("position, id").Find(&ret).Error
+	return ret, err
+}
+
+// ResetQueue 删除除了游戏中以外的所有号，之后取号从1开始
+func (db *DB) ResetQueue() error {
+	return db.conn.Where("status <> ?", TeamStatusPlaying).Delete(Team{}).Error
+}
+
+// LastTeamID 启动时用于继续编号
+func (db *DB) LastTeamID() (int, error) {
+	var ret []Team
+	if err := db.conn.Order("id desc").Limit(1).Find(&ret).Error; err != nil {
+		return 0, err
+	}
+	if len(ret) == 0 {
+		return 0, nil
+	}
+	id, _ := strconv.Atoi(ret[0].TeamID)
+	return id, nil
+}
+
+// initQueue 从数据库恢复队列，重启前游戏中的号已经无法结束，视为离开队列
+func (s *Srv) initQueue() {
+	s.teams = make([]*Team, 0)
+	s.queueHistory = make([]MatchData, 0)
+	teams, err := s.db.QueueTeams()
+	if err != nil {
+		log.Println("load queue error:", err.Error())
+	}
+	for _, team := range teams {
+		if team.Status == TeamStatusPlaying {
+			team.Status = TeamStatusFinished
+			s.saveTeam(team)
+			continue
+		}
+		s.teams = append(s.teams, team)
+	}
+	if s.teamId, err = s.db.LastTeamID(); err != nil {
+		log.Println("load last team error:", err.Error())
+	}
+	if history, err := s.db.Matches(MatchQuery{Limit: queueHistoryNum}); err != nil {
+		log.Println("load queue history error:", err.Error())
+	} else {
+		s.queueHistory = history
+	}
+	s.updateWaitTime()
+}
+
+func (s *Srv) findTeam(teamId string) *Team {
+	for _, team := range s.teams {
+		if team.TeamID == teamId {
+			return team
+		}
+	}
+	return nil
+}
+
+// waitingTeam 只有排队中的号可以修改人数、模式和顺序
+func (s *Srv) waitingTeam(teamId string) (*Team, error) {
+	team := s.findTeam(teamId)
+	if team == nil {
+		return nil, errors.New("team " + teamId + " not found")
+	}
+	if team.Status != TeamStatusWaiting {
+		return nil, errors.New("team " + teamId + " is not waiting")
+	}
+	return team, nil
+}
+
+func (s *Srv) runTeamOp(op string, params map[string]string) (interface{}, error) {
+	if op == AdminOpTeamAdd {
+		team, err := s.addTeam(params["count"], params["mode"])
+		if err != nil {
+			return nil, err
+		}
+		return *team, nil
+	}
+	if op == AdminOpQueueReset {
+		return nil, s.resetQueue()
+	}
+	teamId := params["teamID"]
+	switch op {
+	case AdminOpTeamPrepare:
+		if err := s.prepareTeam(teamId); err != nil {
+			return nil, err
+		}
+	case AdminOpTeamCancelPrepare:
+		team := s.findTeam(teamId)
+		if team == nil || team.Status != TeamStatusPrepare {
+			return nil, errors.New("team " + teamId + " is not preparing")
+		}
+		team.Status = TeamStatusWaiting
+	case AdminOpTeamStart:
+		return nil, s.startTeam(teamId, params["mode"], params["ids"])
+	default:
+		team, err := s.waitingTeam(teamId)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.changeWaitingTeam(op, team, params); err != nil {
+			return nil, err
+		}
+	}
+	s.queueChanged()
+	return nil, nil
+}
+
+// changeWaitingTeam 修改排队中的号，调用方负责 queueChanged
+func (s *Srv) changeWaitingTeam(op string, team *Team, params map[string]string) error {
+	i := s.teamIndex(team)
+	switch op {
+	case AdminOpTeamAddPlayer:
+		if team.Size >= loginMaxPlayers {
+			return errors.New("team is full")
+		}
+		team.Size++
+	case AdminOpTeamRemovePlayer:
+		if team.Size <= 1 {
+			return errors.New("team has only one player")
+		}
+		team.Size--
+	case AdminOpTeamChangeMode:
+		mode := params["mode"]
+		if mode != MatchModeGold && mode != MatchModeSurvival {
+			return errors.New("mode must be g or s")
+		}
+		team.Mode = mode
+	case AdminOpTeamCall:
+		team.Calling++
+	case AdminOpTeamDelay:
+		//和后面第一个排队中的号交换，最后一个号不能推迟
+		if team.DelayCount >= teamMaxDelay {
+			return errors.New("team has delayed " + strconv.Itoa(teamMaxDelay) + " times")
+		}
+		if i == len(s.teams)-1 {
+			return errors.New("team is the last one")
+		}
+		s.teams[i], s.teams[i+1] = s.teams[i+1], s.teams[i]
+		team.DelayCount++
+		team.Calling = 0
+	case AdminOpTeamCutLine:
+		//插到第一个排队中的号前面
+		first := 0
+		for first < len(s.teams) && s.teams[first].Status != TeamStatusWaiting {
+			first++
+		}
+		copy(s.teams[first+1:i+1], s.teams[first:i])
+		s.teams[first] = team
+	case AdminOpTeamRemove:
+		s.teams = append(s.teams[:i], s.teams[i+1:]...)
+		if err := s.db.DeleteTeam(team); err != nil {
+			log.Println("delete team error:", err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *Srv) teamIndex(team *Team) int {
+	for i, t := range s.teams {
+		if t == team {
+			return i
+		}
+	}
+	return -1
+}
+
+// addTeam 前台取号，count 为人数
+func (s *Srv) addTeam(count string, mode string) (*Team, error) {
+	size, err := strconv.Atoi(count)
+	if err != nil || size < 1 || size > loginMaxPlayers {
+		return nil, errors.New("count must be 1-" + strconv.Itoa(loginMaxPlayers))
+	}
+	if mode != MatchModeGold && mode != MatchModeSurvival {
+		return nil, errors.New("mode must be g or s")
+	}
+	s.teamId++
+	team := &Team{TeamID: strconv.Itoa(s.teamId), Size: size, Mode: mode, Status: TeamStatusWaiting}
+	s.teams = append(s.teams, team)
+	s.queueChanged()
+	return team, nil
+}
+
+func (s *Srv) resetQueue() error {
+	if err := s.db.ResetQueue(); err != nil {
+		return err
+	}
+	// 游戏中的号保留，新号从保留的最大号之后开始，避免重号
+	teams := make([]*Team, 0)
+	s.teamId = 0
+	for _, team := range s.teams {
+		if team.Status == TeamStatusPlaying {
+			teams = append(teams, team)
+			if id, _ := strconv.Atoi(team.TeamID); id > s.teamId {
+				s.teamId = id
+			}
+		}
+	}
+	s.teams = teams
+	s.queueChanged()
+	return nil
+}
+
+// prepareTeam 只有排在最前面的号可以准备，同一时间只能有一个号在准备
+func (s *Srv) prepareTeam(teamId string) error {
+	team, err := s.waitingTeam(teamId)
+	if err != nil {
+		return err
+	}
+	for _, t := range s.teams {
+		if t.Status == TeamStatusPrepare {
+			return errors.New("team " + t.TeamID + " is preparing")
+		}
+		if t.Status == TeamStatusWaiting && t != team {
+			return errors.New("team " + t.TeamID + " is in front")
+		}
+		if t == team {
+			break
+		}
+	}
+	team.Status = TeamStatusPrepare
+	team.Calling = 0
+	return nil
+}
+
+// startTeam 准备中的号开始激光房间的一局，ids 为选中的玩家控制器，数量必须与人数相同，为空时按 1-n 编号
+func (s *Srv) startTeam(teamId string, mode string, ids string) error {
+	team := s.findTeam(teamId)
+	if team == nil || team.Status != TeamStatusPrepare {
+		return errors.New("team " + teamId + " is not preparing")
+	}
+	if mode == "" {
+		mode = team.Mode
+	}
+	players := splitPlayers(ids)
+	if len(players) == 0 {
+		for i := 1; i <= team.Size; i++ {
+			players = append(players, strconv.Itoa(i))
+		}
+	}
+	if len(players) != team.Size {
+		return errors.New("ids must match team size " + strconv.Itoa(team.Size))
+	}
+	if err := s.startLaserMatch(mode, players, nil, team.TeamID); err != nil {
+		return err
+	}
+	team.Mode = mode
+	team.Status = TeamStatusPlaying
+	team.MatchID = uint(s.laserMatchId)
+	team.StartedAt = time.Now()
+	s.sendMsgs("newMatch", s.laserMatchId, InboxAddressTypeAdminDevice)
+	s.queueChanged()
+	return nil
+}
+
+// onTeamMatchEnd 激光房间一局结束后在主循环中调用，对应的号离开队列，成绩进入排队屏幕的历史
+func (s *Srv) onTeamMatchEnd(result *MatchData) {
+	s.queueHistory = append([]MatchData{*result}, s.queueHistory...)
+	if len(s.queueHistory) > queueHistoryNum {
+		s.queueHistory = s.queueHistory[:queueHistoryNum]
+	}
+	for i, team := range s.teams {
+		if team.Status == TeamStatusPlaying && team.MatchID == result.ID {
+			team.Status = TeamStatusFinished
+			s.saveTeam(team)
+			s.teams = append(s.teams[:i], s.teams[i+1:]...)
+			break
+		}
+	}
+	s.queueChanged()
+}
+
+func (s *Srv) saveTeam(team *Team) {
+	if err := s.db.SaveTeam(team); err != nil {
+		log.Println("save team error:", err.Error())
+	}
+}
+
+// queueChanged 队列有变化时保存所有的号，重新估计等待时间，并推送给管理端和排队屏幕
+func (s *Srv) queueChanged() {
+	for i, team := range s.teams {
+		team.Position = i
+		s.saveTeam(team)
+	}
+	s.updateWaitTime()
+	s.sendMsgs("HallData", s.teamSnapshot(), InboxAddressTypeAdminDevice)
+	s.sendMsgs("matchData", s.queueData(), InboxAddressTypeQueueDevice)
+}
+
+// updateWaitTime 按 cfg.toml 中每局的估计时间累加前面所有号的时间，游戏中的号减去已经开始的时间
+func (s *Srv) updateWaitTime() {
+	opt := GetOptions()
+	wait := 0.0
+	for _, team := range s.teams {
+		team.WaitTime = int(math.Ceil(wait / 60))
+		t := opt.TeamMatchTime[0]
+		if team.Mode == MatchModeSurvival {
+			t = opt.TeamMatchTime[1]
+		}
+		if team.Status == TeamStatusPlaying {
+			t = math.Max(t-time.Since(team.StartedAt).Seconds(), 0)
+		}
+		wait += t
+	}
+}
+
+// refreshWaitTime 每秒调用，游戏中的号剩余时间减少，估计的分钟数变化时推送给管理端和排队屏幕
+func (s *Srv) refreshWaitTime() {
+	waits := make([]int, len(s.teams))
+	for i, team := range s.teams {
+		waits[i] = team.WaitTime
+	}
+	s.updateWaitTime()
+	for i, team := range s.teams {
+		if team.WaitTime != waits[i] {
+			s.sendMsgs("HallData", s.teamSnapshot(), InboxAddressTypeAdminDevice)
+			s.sendMsgs("matchData", s.queueData(), InboxAddressTypeQueueDevice)
+			return
+		}
+	}
+}
+
+// queueData 排队屏幕(queue.jsx)的数据，history 的格式与 updateMatch 相同
+func (s *Srv) queueData() map[string]interface{} {
+	history := make([]map[string]interface{}, len(s.queueHistory))
+	for i, m := range s.queueHistory {
+		member := make([]map[string]interface{}, len(m.Players))
+		for j, p := range m.Players {
+			member[j] = map[string]interface{}{"cid": p.ControllerID, "name": p.Name}
+		}
+		history[i] = map[string]interface{}{
+			"id":      m.ID,
+			"teamID":  m.TeamID,
+			"mode":    m.Mode,
+			"gold":    m.Gold,
+			"elasped": m.Elasped,
+			"member":  member,
+		}
+	}
+	return map[string]interface{}{"queue": s.teamSnapshot(), "history": history}
+}
+
+// teamSnapshot 消息在单独的 goroutine 中序列化，发送副本
+func (s *Srv) teamSnapshot() []Team {
+	teams := make([]Team, len(s.teams))
+	for i, team := range s.teams {
+		teams[i] = *team
+	}
+	return teams
+}
+
+// handleQueueMessage 排队屏幕连上后回复 init 和当前队列
+func (s *Srv) handleQueueMessage(msg *InboxMessage) {
+	switch msg.GetCmd() {
+	case "init":
+		s.sendMsg("init", nil, msg.Address.ID, msg.Address.Type)
+		s.sendMsg("matchData", s.queueData(), msg.Address.ID, msg.Address.Type)
+	}
+}
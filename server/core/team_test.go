@@ -0,0 +1,81 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+// 游戏中的号开始得越久，后面的号等待时间越短，变化时推送给排队屏幕
+func TestTeamWaitTimeFallsOnTick(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	queue := ts.connect(InboxAddressTypeQueueDevice, "queue")
+	matchTime := GetOptions().TeamMatchTime[0]
+	ts.do(func() {
+		ts.teams = []*Team{
+			{TeamID: "1", Mode: MatchModeGold, Status: TeamStatusPlaying, StartedAt: time.Now()},
+			{TeamID: "2", Mode: MatchModeGold, Status: TeamStatusWaiting},
+		}
+		ts.updateWaitTime()
+	})
+	before := 0
+	ts.do(func() { before = ts.teams[1].WaitTime })
+
+	ts.do(func() {
+		ts.teams[0].StartedAt = time.Now().Add(-time.Duration(matchTime/2) * time.Second)
+	})
+	ts.tickAt(time.Now())
+	after := 0
+	ts.do(func() { after = ts.teams[1].WaitTime })
+	if after >= before {
+		t.Errorf("wait time = %v after half a match, want less than %v", after, before)
+	}
+	queue.waitReceived(t, "matchData", 1)
+
+	//分钟数没有变化时不推送
+	ts.tickAt(time.Now())
+	time.Sleep(50 * time.Millisecond)
+	if n := len(queue.received("matchData")); n != 1 {
+		t.Errorf("matchData = %v, want 1", n)
+	}
+}
+
+// 改变队列的管理端命令需要先登录
+func TestTeamOpsRequireLogin(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	admin := ts.connect(InboxAddressTypeAdminDevice, "admin-1")
+	msg := NewInboxMessage()
+	msg.SetCmd(AdminOpTeamCall)
+	msg.Set("teamID", "1")
+	msg.Address = &InboxAddress{InboxAddressTypeAdminDevice, "admin-1"}
+	ts.onInboxMessageArrived(msg)
+	res := admin.waitReceived(t, "adminResult", 1)[0]
+	if res["error"] != "login required" {
+		t.Errorf("adminResult = %v, want login required", res)
+	}
+}
+
+// 重置队列保留游戏中的号，新号不能和它们重复
+func TestResetQueueKeepsPlayingIds(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.do(func() {
+		for i := 0; i < 3; i++ {
+			if _, err := ts.addTeam("1", MatchModeGold); err != nil {
+				t.Fatal(err)
+			}
+		}
+		ts.teams[1].Status = TeamStatusPlaying
+		if err := ts.resetQueue(); err != nil {
+			t.Fatal(err)
+		}
+		if len(ts.teams) != 1 || ts.teams[0].TeamID != "2" {
+			t.Fatalf("teams after reset = %v, want only 2", ts.teams)
+		}
+		team, err := ts.addTeam("1", MatchModeGold)
+		if err != nil || team.TeamID != "3" {
+			t.Errorf("new team = %+v, %v, want 3", team, err)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package core
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+var _ = log.Printf
+
+// ticket_check 的 return
+const (
+	TicketCheckTrue   = "true"
+	TicketCheckFalse  = "false"
+	TicketCheckRepeat = "repeat" // 重复刷卡，卡已经登录或门票已经使用，设备不应提示没有门票
+)
+
+const (
+	TicketLoggedIn = "loggedIn" // 已登录到会话，游戏开始前会话被重置时删除
+	TicketRedeemed = "redeemed" // 游戏已开始，已核销或正在等待 outbox 上传核销
+)
+
+// ticket_check 重复时的原因
+const (
+	TicketRejectLoggedIn = "ticketLoggedIn"
+	TicketRejectRedeemed = "ticketRedeemed"
+)
+
+// TicketRecord 对应数据库中的 tickets 表，保证同一张门票只登录一个会话、只核销一次
+// 核销上传成功前后台仍会返回这张门票，因此需要保存在本地
+type TicketRecord struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	CreatedAt  time.Time `json:"createdAt"`
+	TicketId   string    `gorm:"unique_index" json:"ticketId"`
+	CardId     string    `json:"cardId"`
+	GameId     int       `json:"gameId"`
+	SessionId  int       `json:"sessionId"`
+	State      string    `json:"state"`
+	RedeemedAt time.Time `json:"redeemedAt"`
+}
+
+func (TicketRecord) TableName() string {
+	return "tickets"
+}
+
+func (db *DB) Ticket(ticketId string) (*TicketRecord, error) {
+	var ret []TicketRecord
+	if err := db.conn.Where("ticket_id = ?", ticketId).Limit(1).Find(&ret).Error; err != nil {
+		return nil, err
+	}
+	if len(ret) == 0 {
+		return nil, nil
+	}
+	return &ret[0], nil
+}
+
+func (db *DB) SaveTicket(ticket *TicketRecord) error {
+	return db.conn.Save(ticket).Error
+}
+
+func (db *DB) DeleteTicket(ticket *TicketRecord) error {
+	return db.conn.Delete(ticket).Error
+}
+
+// loginTicket 门票没有被其他会话使用时记录下来，否则返回原因
+func (s *Srv) loginTicket(ticketId string, cardId string, gs *GameSession) string {
+	ticket, err := s.db.Ticket(ticketId)
+	if err != nil {
+		log.Println("query ticket error:", err.Error())
+	}
+	if ticket != nil {
+		if ticket.State == TicketRedeemed {
+			return TicketRejectRedeemed
+		}
+		//会话ID在服务器重启后重新计数，需要同时检查卡号
+		if other := s.findSession(strconv.Itoa(ticket.SessionId)); other != nil && other.HasCard(ticket.CardId) {
+			return TicketRejectLoggedIn
+		}
+		//会话已经不存在(例如服务器重启)，可以重新登录
+	} else {
+		ticket = &TicketRecord{TicketId: ticketId}
+	}
+	ticket.CardId = cardId
+	ticket.GameId = gs.GameId
+	ticket.SessionId = gs.ID
+	ticket.State = TicketLoggedIn
+	if err := s.db.SaveTicket(ticket); err != nil {
+		log.Println("save ticket error:", err.Error())
+	}
+	return ""
+}
+
+// redeemTicket 游戏开始时调用，已经核销过的返回 false，不再上传
+func (s *Srv) redeemTicket(ticketId string, gs *GameSession) bool {
+	ticket, err := s.db.Ticket(ticketId)
+	if err != nil {
+		log.Println("query ticket error:", err.Error())
+	}
+	if ticket == nil {
+		ticket = &TicketRecord{TicketId: ticketId, GameId: gs.GameId, SessionId: gs.ID}
+	}
+	if ticket.State == TicketRedeemed {
+		return false
+	}
+	ticket.State = TicketRedeemed
+	ticket.RedeemedAt = time.Now()
+	if err := s.db.SaveTicket(ticket); err != nil {
+		log.Println("save ticket error:", err.Error())
+	}
+	return true
+}
+
+// releaseTickets 会话在游戏开始前被丢弃，门票可以在其他会话中使用
+func (s *Srv) releaseTickets(gs *GameSession) {
+	if gs.State != SessionWaiting && gs.State != SessionLoggedIn {
+		return
+	}
+	info := gs.Game.GetLoginInfo()
+	for _, cardId := range info.Cards() {
+		s.releaseTicket(info.CardTicketInfo[cardId])
+	}
+}
+
+// releaseTicket 删除只登录、没有核销的门票记录
+func (s *Srv) releaseTicket(ticketId string) {
+	ticket, err := s.db.Ticket(ticketId)
+	if err != nil || ticket == nil || ticket.State != TicketLoggedIn {
+		return
+	}
+	if err := s.db.DeleteTicket(ticket); err != nil {
+		log.Println("delete ticket error:", err.Error())
+	}
+}
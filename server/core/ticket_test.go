@@ -0,0 +1,144 @@
+package core
+
+import (
+	"testing"
+
+	"challenger/server/mockapi"
+)
+
+// 同一张卡在后台返回前、登录后再刷都是重复刷卡，只请求一次后台
+func TestTicketDoubleSwipe(t *testing.T) {
+	mock, closeMock := newMockBackend(t)
+	defer closeMock()
+	ts := newTestSrv(t)
+	defer ts.close()
+
+	const arduino = "G-2-1"
+	game := ts.connect(InboxAddressTypeGameArduinoDevice, arduino)
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1", "P", "2")
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1")
+	checks := game.waitReceived(t, "ticket_check", 2)
+	returns := map[interface{}]int{}
+	for _, m := range checks {
+		returns[m["return"]]++
+	}
+	if returns[TicketCheckTrue] != 1 || returns[TicketCheckRepeat] != 1 {
+		t.Fatalf("ticket_check = %v, want one true and one repeat", checks)
+	}
+
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1")
+	if m := game.waitReceived(t, "ticket_check", 3)[2]; m["return"] != TicketCheckRepeat || m["reason"] != SessionRejectDuplicate {
+		t.Errorf("swipe after login = %v, want repeat %v", m, SessionRejectDuplicate)
+	}
+	if n := len(mock.Requests(mockapi.TicketGame)); n != 1 {
+		t.Errorf("ticket_game requests = %v, want 1", n)
+	}
+	ts.do(func() {
+		gs := ts.activeSession(2, arduino, SessionLoggedIn)
+		if gs == nil || len(gs.Players) != 1 || len(gs.pending) != 0 {
+			t.Errorf("session = %+v, want one player", gs)
+		}
+	})
+}
+
+// 同一张门票不能同时登录两个会话，核销过的不能再登录
+func TestLoginTicketTwice(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.do(func() {
+		gs1, _ := ts.joinSession(ID_Hunter, "G-11-1", "card-1", 1)
+		gs2, _ := ts.joinSession(ID_Hunter, "G-11-2", "card-2", 1)
+		if reason := ts.loginTicket("101", "card-1", gs1); reason != "" {
+			t.Fatalf("first login rejected: %v", reason)
+		}
+		gs1.Login("card-1", "101")
+		if reason := ts.loginTicket("101", "card-2", gs2); reason != TicketRejectLoggedIn {
+			t.Errorf("second login reason = %q, want %v", reason, TicketRejectLoggedIn)
+		}
+		gs1.Start()
+		if !ts.redeemTicket("101", gs1) {
+			t.Fatal("first redeem failed")
+		}
+		if reason := ts.loginTicket("101", "card-2", gs2); reason != TicketRejectRedeemed {
+			t.Errorf("login after redeem reason = %q, want %v", reason, TicketRejectRedeemed)
+		}
+	})
+}
+
+// 核销只上传一次，再次核销返回 false
+func TestRedeemTicketTwice(t *testing.T) {
+	ts := newTestSrv(t)
+	defer ts.close()
+	ts.do(func() {
+		gs := NewGameSession(1, ID_Hunter, "G-11-1", 1)
+		if !ts.redeemTicket("101", gs) {
+			t.Fatal("first redeem failed")
+		}
+		if ts.redeemTicket("101", gs) {
+			t.Error("ticket redeemed twice")
+		}
+	})
+	ticket, err := ts.db.Ticket("101")
+	if err != nil || ticket == nil || ticket.State != TicketRedeemed {
+		t.Errorf("ticket = %+v, %v, want redeemed", ticket, err)
+	}
+}
+
+// 核销被后台拒绝后 outbox 重试，idempotency_key 不变，重试前门票不能再次登录
+func TestTicketUseRetryKeepsKey(t *testing.T) {
+	mock, closeMock := newMockBackend(t)
+	defer closeMock()
+	ts := newTestSrv(t)
+	defer ts.close()
+	go ts.outbox.Run()
+	mock.Script(mockapi.TicketUpdate, mockapi.Deny)
+
+	const arduino = "G-2-1"
+	game := ts.connect(InboxAddressTypeGameArduinoDevice, arduino)
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1", "P", "1")
+	if m := game.waitReceived(t, "ticket_check", 1)[0]; m["return"] != TicketCheckTrue {
+		t.Fatalf("ticket_check = %v", m)
+	}
+	ts.send(arduino, "TYPE", GameStart, "GAME", "2", "ADMIN", "staff-1")
+	first := waitRequests(t, mock, mockapi.TicketUpdate, 1)[0]
+	if first.Behavior != mockapi.Deny {
+		t.Fatalf("first ticket_update = %+v, want denied", first)
+	}
+	waitFor(t, "outbox attempt", func() bool {
+		records, err := ts.OutboxRecords(OutboxStatusPending)
+		return err == nil && len(records) == 1 && records[0].Attempts == 1
+	})
+
+	//游戏结束后后台还会返回这张门票，本地记录已核销
+	ts.send(arduino, "TYPE", GameEnd, "GAME", "2", "LR", "3")
+	waitRequests(t, mock, "gamedata_follow.php", 1)
+	ts.send(arduino, "TYPE", TicketGet, "GAME", "2", "CARD_ID", "card-1")
+	if m := game.waitReceived(t, "ticket_check", 2)[1]; m["return"] != TicketCheckRepeat || m["reason"] != TicketRejectRedeemed {
+		t.Errorf("swipe before retry = %v, want repeat %v", m, TicketRejectRedeemed)
+	}
+
+	if n, err := ts.DrainOutbox(); err != nil || n < 1 {
+		t.Fatalf("drain = %v, %v", n, err)
+	}
+	uses := waitRequests(t, mock, mockapi.TicketUpdate, 2)
+	retry := uses[1]
+	if retry.Behavior != mockapi.Approve || retry.Duplicate {
+		t.Errorf("retry = %+v, want approved once", retry)
+	}
+	key := first.Params[idempotencyKeyParam]
+	if key == "" || retry.Params[idempotencyKeyParam] != key || retry.Params["id"] != first.Params["id"] {
+		t.Errorf("retry key = %v id = %v, want %v id = %v", retry.Params[idempotencyKeyParam], retry.Params["id"], key, first.Params["id"])
+	}
+	waitFor(t, "ticket use delivered", func() bool {
+		records, _ := ts.OutboxRecords(OutboxStatusDelivered)
+		for _, rec := range records {
+			if rec.IdempotencyKey == key {
+				return rec.Attempts == 2
+			}
+		}
+		return false
+	})
+	if ticket, _ := ts.db.Ticket(first.Params["id"]); ticket == nil || ticket.State != TicketRedeemed {
+		t.Errorf("ticket %v = %+v, want redeemed", first.Params["id"], ticket)
+	}
+}
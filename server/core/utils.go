@@ -2,6 +2,7 @@ package core
 
 import (
 	"math"
+	"strconv"
 )
 
 type StrSlice []string
@@ -32,3 +33,18 @@ func MaxInt(x, y int) int {
 	}
 	return y
 }
+
+// toStr 把 json 解码得到的值转换为字符串，数组、对象等无法转换的返回空字符串
+func toStr(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(t)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return ""
+}
@@ -0,0 +1,413 @@
+// device_sim 按 cfg.toml 中的 arduino 列表模拟整个场馆的硬件，
+// 每个设备一条 tcp 连接，定时发送心跳，并按场景文件发送消息、检查服务器下发的命令。
+//
+//	go run demo/device_sim/device_sim.go -scenario demo/device_sim/scenario.toml
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"challenger/server/protocol"
+	"github.com/BurntSushi/toml"
+)
+
+type deviceCfg struct {
+	GameArduino  []string
+	BoxArduino   []string
+	NightArduino []string
+	DjArduino    []string
+}
+
+func (c *deviceCfg) all() []string {
+	ret := make([]string, 0)
+	ret = append(ret, c.GameArduino...)
+	ret = append(ret, c.BoxArduino...)
+	ret = append(ret, c.NightArduino...)
+	ret = append(ret, c.DjArduino...)
+	return ret
+}
+
+// 场景中可以直接使用的动作，对应 arduino 消息的 TYPE
+var actions = map[string]map[string]string{
+	"heartbeat":  {"TYPE": "0"},
+	"card_swipe": {"TYPE": "7"},
+	"authority":  {"TYPE": "6"},
+	"game_start": {"TYPE": "2"},
+	"game_end":   {"TYPE": "4"},
+	"game_data":  {"TYPE": "5"},
+	"box_open":   {"TYPE": "8", "ST": "1"},
+	"box_close":  {"TYPE": "8", "ST": "0"},
+	"box_status": {"TYPE": "13"},
+	"event":      {"TYPE": "10"},
+
+	"game_start_forward": {"TYPE": "1"},
+	"game_end_forward":   {"TYPE": "3"},
+}
+
+type Step struct {
+	Wait     float64           // 距上一步的等待时间(秒)
+	Device   string            // 发送或接收消息的设备，检查命令时可以用 B-* 表示任意一个 B- 开头的设备
+	Action   string            // 要发送的动作，见 actions
+	Fields   map[string]string // 发送时附加的字段
+	Expect   string            // 期望设备收到的 cmd
+	Match    map[string]string // 期望命令中包含的字段
+	Timeout  float64           // 等待期望命令的时间(秒)
+	Mock     []string          // 发送前设置模拟后台的返回，格式 endpoint=behavior 或 endpoint=behavior*次数
+	Backend  string            // 检查模拟后台这个接口收到的请求
+	Requests int               // 期望后台至少收到的请求数，等待时间同 Timeout
+	Keys     int               // 这些请求中不同 idempotency_key 的数量，重试时 key 不变，为0时不检查
+}
+
+type Scenario struct {
+	Name  string
+	Steps []Step
+}
+
+type Command struct {
+	Device string                 `json:"device"`
+	Time   time.Time              `json:"time"`
+	Data   map[string]interface{} `json:"data"`
+	used   bool
+}
+
+type Device struct {
+	ID   string
+	conn net.Conn
+	wl   *sync.Mutex
+	fl   *sync.Mutex
+	cmds []*Command
+	rec  chan *Command
+}
+
+func NewDevice(id string, addr string, rec chan *Command) (*Device, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d := Device{ID: id, conn: conn, rec: rec}
+	d.wl = new(sync.Mutex)
+	d.fl = new(sync.Mutex)
+	d.cmds = make([]*Command, 0)
+	go d.read()
+	return &d, nil
+}
+
+// Send 按 <[ID]xx[TYPE]xx...> 的格式发送消息
+func (d *Device) Send(fields map[string]string) error {
+	f := protocol.Frame{protocol.KeyID: d.ID}
+	for k, v := range fields {
+		f[k] = v
+	}
+	d.wl.Lock()
+	defer d.wl.Unlock()
+	_, err := d.conn.Write([]byte("<" + f.String() + ">"))
+	return err
+}
+
+func (d *Device) heartbeat(interval time.Duration) {
+	for {
+		if err := d.Send(actions["heartbeat"]); err != nil {
+			log.Println(d.ID, "heartbeat error:", err)
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (d *Device) read() {
+	r := bufio.NewReader(d.conn)
+	for {
+		if _, err := r.ReadBytes('<'); err != nil {
+			log.Println(d.ID, "read error:", err)
+			return
+		}
+		b, err := r.ReadBytes('>')
+		if err != nil {
+			log.Println(d.ID, "read error:", err)
+			return
+		}
+		cmd := Command{Device: d.ID, Time: time.Now(), Data: make(map[string]interface{})}
+		if err := json.Unmarshal(b[:len(b)-1], &cmd.Data); err != nil {
+			log.Println(d.ID, "got non json frame:", string(b))
+			continue
+		}
+		d.fl.Lock()
+		d.cmds = append(d.cmds, &cmd)
+		d.fl.Unlock()
+		d.rec <- &cmd
+	}
+}
+
+// take 取出一条尚未被检查过且符合条件的命令
+func (d *Device) take(cmd string, match map[string]string) *Command {
+	d.fl.Lock()
+	defer d.fl.Unlock()
+	for _, c := range d.cmds {
+		if !c.used && commandMatch(c, cmd, match) {
+			c.used = true
+			return c
+		}
+	}
+	return nil
+}
+
+// expectAny 等待任意一个设备收到符合条件的命令
+func expectAny(devices []*Device, cmd string, match map[string]string, timeout time.Duration) (*Command, bool) {
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, d := range devices {
+			if c := d.take(cmd, match); c != nil {
+				return c, true
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, false
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func matchDevices(devices map[string]*Device, pattern string) []*Device {
+	ret := make([]*Device, 0)
+	if !strings.HasSuffix(pattern, "*") {
+		if d := devices[pattern]; d != nil {
+			ret = append(ret, d)
+		}
+		return ret
+	}
+	prefix := strings.TrimSuffix(pattern, "*")
+	for id, d := range devices {
+		if strings.HasPrefix(id, prefix) {
+			ret = append(ret, d)
+		}
+	}
+	return ret
+}
+
+func commandMatch(c *Command, cmd string, match map[string]string) bool {
+	if fmt.Sprint(c.Data["cmd"]) != cmd {
+		return false
+	}
+	for k, v := range match {
+		if fmt.Sprint(c.Data[k]) != v {
+			return false
+		}
+	}
+	return true
+}
+
+func record(ch chan *Command, path string, verbose bool) {
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = os.Create(path); err != nil {
+			log.Println("create record file error:", err)
+		}
+	}
+	for c := range ch {
+		b, _ := json.Marshal(c)
+		if f != nil {
+			f.Write(append(b, '\n'))
+		}
+		if verbose {
+			log.Println("recv:", string(b))
+		}
+	}
+}
+
+// scriptMock 通过 /_mock/script 设置服务器 -mockapi 启动的模拟后台
+func scriptMock(mockAddr string, script string) error {
+	kv := strings.SplitN(script, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("invalid mock script: %v", script)
+	}
+	bt := strings.SplitN(kv[1], "*", 2)
+	q := url.Values{}
+	q.Set("endpoint", kv[0])
+	q.Set("behavior", bt[0])
+	if len(bt) == 2 {
+		q.Set("times", bt[1])
+	}
+	res, err := http.PostForm("http://"+mockAddr+"/_mock/script", q)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("mock script %v: %v", script, res.Status)
+	}
+	return nil
+}
+
+// checkBackend 通过 /_mock/requests 等待模拟后台的 endpoint 收到至少 n 个请求
+func checkBackend(mockAddr string, endpoint string, n int, keys int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		var reqs []struct {
+			Params map[string]string `json:"params"`
+		}
+		res, err := http.Get("http://" + mockAddr + "/_mock/requests?endpoint=" + url.QueryEscape(endpoint))
+		if err != nil {
+			return err
+		}
+		err = json.NewDecoder(res.Body).Decode(&reqs)
+		res.Body.Close()
+		if err != nil {
+			return err
+		}
+		if len(reqs) >= n {
+			distinct := make(map[string]bool)
+			for _, r := range reqs {
+				distinct[r.Params["idempotency_key"]] = true
+			}
+			if keys > 0 && len(distinct) != keys {
+				return fmt.Errorf("%v got %v requests with %v idempotency keys, want %v", endpoint, len(reqs), len(distinct), keys)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v got %v requests, want %v", endpoint, len(reqs), n)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func runScenario(sc *Scenario, devices map[string]*Device, mockAddr string) int {
+	failed := 0
+	for i, step := range sc.Steps {
+		time.Sleep(time.Duration(step.Wait * float64(time.Second)))
+		for _, script := range step.Mock {
+			if err := scriptMock(mockAddr, script); err != nil {
+				log.Printf("step %v: %v\n", i+1, err)
+				failed++
+			} else {
+				log.Printf("step %v: mock %v\n", i+1, script)
+			}
+		}
+		if step.Backend != "" {
+			timeout := step.Timeout
+			if timeout <= 0 {
+				timeout = 3
+			}
+			if err := checkBackend(mockAddr, step.Backend, step.Requests, step.Keys, time.Duration(timeout*float64(time.Second))); err != nil {
+				log.Printf("step %v: FAIL, %v\n", i+1, err)
+				failed++
+			} else {
+				log.Printf("step %v: ok, %v got %v requests\n", i+1, step.Backend, step.Requests)
+			}
+		}
+		if step.Device == "" && (len(step.Mock) > 0 || step.Backend != "") {
+			continue
+		}
+		targets := matchDevices(devices, step.Device)
+		if len(targets) == 0 {
+			log.Printf("step %v: unknown device %v\n", i+1, step.Device)
+			failed++
+			continue
+		}
+		if step.Action != "" {
+			if len(targets) > 1 {
+				log.Printf("step %v: can not send to %v devices\n", i+1, step.Device)
+				failed++
+				continue
+			}
+			d := targets[0]
+			base, ok := actions[step.Action]
+			if !ok {
+				log.Printf("step %v: unknown action %v\n", i+1, step.Action)
+				failed++
+				continue
+			}
+			fields := make(map[string]string)
+			for k, v := range base {
+				fields[k] = v
+			}
+			for k, v := range step.Fields {
+				fields[k] = v
+			}
+			if err := d.Send(fields); err != nil {
+				log.Printf("step %v: send error:%v\n", i+1, err)
+				failed++
+			} else {
+				log.Printf("step %v: %v %v %v\n", i+1, step.Device, step.Action, step.Fields)
+			}
+		}
+		if step.Expect != "" {
+			timeout := step.Timeout
+			if timeout <= 0 {
+				timeout = 3
+			}
+			if c, ok := expectAny(targets, step.Expect, step.Match, time.Duration(timeout*float64(time.Second))); ok {
+				log.Printf("step %v: ok, %v got %v\n", i+1, c.Device, c.Data)
+			} else {
+				log.Printf("step %v: FAIL, %v did not get %v %v in %vs\n", i+1, step.Device, step.Expect, step.Match, timeout)
+				failed++
+			}
+		}
+	}
+	return failed
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:4000", "server tcp address")
+	cfgPath := flag.String("cfg", "cfg.toml", "server config with the arduino lists")
+	scenarioPath := flag.String("scenario", "", "scenario toml file, run heartbeats only when empty")
+	only := flag.String("devices", "", "comma separated device ids to simulate, default all")
+	hb := flag.Duration("hb", 500*time.Millisecond, "heartbeat interval")
+	recordPath := flag.String("record", "", "write every received command to this file as json lines")
+	verbose := flag.Bool("v", false, "log every received command")
+	mockAddr := flag.String("mockapi", "localhost:8090", "address of the server's mock gsaleapi, used by mock steps")
+	flag.Parse()
+
+	var cfg deviceCfg
+	if _, err := toml.DecodeFile(*cfgPath, &cfg); err != nil {
+		log.Println("parse cfg error:", err)
+		os.Exit(1)
+	}
+	ids := cfg.all()
+	if *only != "" {
+		ids = strings.Split(*only, ",")
+	}
+
+	rec := make(chan *Command, 1000)
+	go record(rec, *recordPath, *verbose)
+	devices := make(map[string]*Device)
+	for _, id := range ids {
+		d, err := NewDevice(id, *addr, rec)
+		if err != nil {
+			log.Println(id, "connect error:", err)
+			os.Exit(1)
+		}
+		devices[id] = d
+		go d.heartbeat(*hb)
+	}
+	log.Println("simulating", len(devices), "devices")
+
+	if *scenarioPath == "" {
+		select {}
+	}
+	var sc Scenario
+	if _, err := toml.DecodeFile(*scenarioPath, &sc); err != nil {
+		log.Println("parse scenario error:", err)
+		os.Exit(1)
+	}
+	// 等服务器通过心跳识别所有设备
+	time.Sleep(*hb * 2)
+	log.Println("run scenario:", sc.Name)
+	if failed := runScenario(&sc, devices, *mockAddr); failed > 0 {
+		log.Println("scenario failed steps:", failed)
+		os.Exit(1)
+	}
+	log.Println("scenario passed")
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"challenger/server/core"
-	"encoding/json"
+	"challenger/server/mockapi"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"syscall"
@@ -17,16 +19,15 @@ import (
 	"github.com/labstack/echo"
 	st "github.com/labstack/echo/engine/standard"
 	mw "github.com/labstack/echo/middleware"
+	"golang.org/x/net/websocket"
 )
 
 const (
-	host        = "localhost"
-	httpAddr    = host + ":3000"
-	tcpAddr     = host + ":4000"
-	adminAddr   = host + ":5000"
-	dbPath      = "./challenger.db"
-	isSimulator = false
-	testRank    = true
+	host      = "localhost"
+	httpAddr  = host + ":3000"
+	tcpAddr   = host + ":4000"
+	adminAddr = host + ":5000"
+	dbPath    = "./challenger.db"
 )
 
 func redirectStderr(f *os.File) {
@@ -36,22 +37,47 @@ func redirectStderr(f *os.File) {
 	}
 }
 
-func loadRankTestData() map[string]interface{} {
-	ret := make(map[string]interface{})
-	b, e := ioutil.ReadFile("./ranktest.json")
-	if e != nil {
-		log.Println("load rank test data error:%v\n", e)
-		os.Exit(1)
-	}
-	e = json.Unmarshal(b, &ret)
-	if e != nil {
-		log.Println("parse rank test data error:%v\n", e)
-		os.Exit(1)
+// 排行榜参数: year, month 为0或不传时不限时间，page 从1开始，size 每页条数，teamSize 1-4 只查询对应人数
+func rankQuery(c echo.Context, mode string) core.RankQuery {
+	q := core.RankQuery{Mode: mode}
+	q.Year, _ = strconv.Atoi(c.FormValue("year"))
+	q.Month, _ = strconv.Atoi(c.FormValue("month"))
+	q.Page, _ = strconv.Atoi(c.FormValue("page"))
+	q.PerPage, _ = strconv.Atoi(c.FormValue("size"))
+	q.TeamSize, _ = strconv.Atoi(c.FormValue("teamSize"))
+	return q
+}
+
+func watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if err := core.ReloadBackendOptions(); err != nil {
+			log.Println("reload backend error:", err.Error())
+		}
+		if err := core.ReloadShows(); err != nil {
+			log.Println("reload shows error:", err.Error())
+		}
 	}
-	return ret
+}
+
+func startMockApi(addr string) {
+	mock := mockapi.NewServer()
+	go func() {
+		log.Println("listen mock gsaleapi:", addr)
+		if err := http.ListenAndServe(addr, mock); err != nil {
+			log.Println("mock gsaleapi error:", err.Error())
+			os.Exit(1)
+		}
+	}()
+	core.SetBackendBaseUrl("http://" + addr + "/gsaleapi/")
 }
 
 func main() {
+	mockApiAddr := flag.String("mockapi", "", "run a local mock gsaleapi on this address, e.g. localhost:8090")
+	isSimulator := flag.Bool("simulator", false, "run the headless arena simulator, players join from the web simulator")
+	flag.Parse()
+
 	// setup log system
 	log.Println("start server")
 	logfileName := "log/" + time.Now().Local().Format("2006-01-02-15-04-05") + ".log"
@@ -79,47 +105,81 @@ func main() {
 		}
 	}()
 
-	var rankTestData map[string]interface{}
-
-	if testRank {
-		rankTestData = loadRankTestData()
-	}
-
 	core.GetOptions()
 
 	log.Println("reading cfg done")
+	go watchReloadSignal()
+	if *mockApiAddr != "" {
+		startMockApi(*mockApiAddr)
+	}
 
-	srv := core.NewSrv(isSimulator)
-	go srv.Run(tcpAddr, adminAddr, dbPath)
+	srv := core.NewSrv(*isSimulator, dbPath)
+	go srv.Run(tcpAddr, adminAddr)
 
 	// setup echo
 	ec := echo.New()
 	ec.Static("/", "public")
 	ec.Static("/api/asset/", "api_public")
 	ec.Use(mw.Logger())
+	ec.Get("/ws", st.WrapHandler(websocket.Handler(srv.ListenWebSocket)))
 	ec.Get("/api/allhistory", func(c echo.Context) error {
-		if rankTestData == nil {
-			return c.JSON(http.StatusOK, nil)
+		gold, err := srv.RankHistory(rankQuery(c, core.RankModeGold))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		survival, err := srv.RankHistory(rankQuery(c, core.RankModeSurvival))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
 		}
 		data := make(map[string]interface{})
-		data["mode0"] = rankTestData["gold"]
-		data["mode1"] = rankTestData["survival"]
+		data["mode0"] = gold
+		data["mode1"] = survival
 		data["code"] = "0"
 		data["error"] = ""
 		return c.JSON(http.StatusOK, data)
 	})
 	ec.Post("/api/mode1history", func(c echo.Context) error {
-		if rankTestData == nil {
-			return c.JSON(http.StatusOK, nil)
+		q := rankQuery(c, core.RankModeSurvival)
+		data, err := srv.RankHistory(q)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
 		}
-		month, _ := strconv.Atoi(c.FormValue("month"))
-		year, _ := strconv.Atoi(c.FormValue("year"))
-		data := rankTestData["survival"].(map[string]interface{})
-		data["season"] = fmt.Sprintf("S%d02%d", year, month)
+		data["season"] = q.Season()
 		data["code"] = "0"
 		data["error"] = ""
 		return c.JSON(http.StatusOK, data)
 	})
+	ec.Get("/api/match", func(c echo.Context) error {
+		id, err := strconv.Atoi(c.QueryParam("id"))
+		if err != nil || id <= 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": "id must be a number"})
+		}
+		match, err := srv.Match(uint(id))
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		if match == nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"code": "1", "error": "match not found"})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "match": match})
+	})
+	ec.Get("/api/matches", func(c echo.Context) error {
+		q, err := core.ParseMatchQuery(c.QueryParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"code": "1", "error": err.Error()})
+		}
+		matches, err := srv.Matches(q)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"code": "1", "error": err.Error()})
+		}
+		return c.JSON(http.StatusOK, map[string]interface{}{"code": "0", "error": "", "matches": matches})
+	})
+	registerAdminApi(ec, srv)
+	ec.Get("/metrics", func(c echo.Context) error {
+		var buf bytes.Buffer
+		core.GetMetrics().WritePrometheus(&buf)
+		return c.String(http.StatusOK, buf.String())
+	})
 	log.Println("listen http:", httpAddr)
 	ec.Run(st.New(httpAddr))
 }
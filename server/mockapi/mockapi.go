@@ -0,0 +1,251 @@
+// Package mockapi 是票务后台 gsaleapi 的本地模拟，用于开发调试和离线联调。
+//
+// 每个接口的返回可以通过 Script 或 HTTP 接口 /_mock/script 设置为
+// 通过(approve)、拒绝(deny)、超时(timeout)或返回错误的JSON(malformed)。
+package mockapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ = log.Printf
+
+type Behavior string
+
+const (
+	Approve   Behavior = "approve"
+	Deny      Behavior = "deny"
+	Timeout   Behavior = "timeout"
+	Malformed Behavior = "malformed"
+)
+
+const (
+	AuthorityList = "authority_list.php"
+	TicketGame    = "ticket_game.php"
+	TicketUpdate  = "ticket_update.php"
+	HunterBox     = "gamedata_hunter_box.php"
+	gameDataPre   = "gamedata_"
+)
+
+// Request 记录模拟后台收到的一次请求
+type Request struct {
+	Endpoint  string            `json:"endpoint"`
+	Method    string            `json:"method"`
+	Params    map[string]string `json:"params"`
+	Behavior  Behavior          `json:"behavior"`
+	Duplicate bool              `json:"duplicate"`
+	Time      time.Time         `json:"time"`
+}
+
+type Server struct {
+	TimeoutDelay time.Duration
+
+	l        *sync.Mutex
+	defaults map[string]Behavior
+	scripts  map[string][]Behavior
+	requests []Request
+	keys     map[string]bool
+	ticketId int
+	tickets  map[string]int // card_Uid:game_ID -> 还没有核销的门票，核销前重复查询返回同一张
+	closeCh  chan struct{}
+	mux      *http.ServeMux
+}
+
+func NewServer() *Server {
+	m := Server{}
+	m.TimeoutDelay = 5 * time.Second
+	m.l = new(sync.Mutex)
+	m.defaults = make(map[string]Behavior)
+	m.scripts = make(map[string][]Behavior)
+	m.requests = make([]Request, 0)
+	m.keys = make(map[string]bool)
+	m.ticketId = 1000
+	m.tickets = make(map[string]int)
+	m.closeCh = make(chan struct{})
+	m.mux = http.NewServeMux()
+	m.mux.HandleFunc("/_mock/script", m.handleScript)
+	m.mux.HandleFunc("/_mock/requests", m.handleRequests)
+	m.mux.HandleFunc("/_mock/reset", m.handleReset)
+	m.mux.HandleFunc("/", m.handleApi)
+	return &m
+}
+
+// Close 让所有正在模拟超时的请求立即返回
+func (m *Server) Close() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	select {
+	case <-m.closeCh:
+	default:
+		close(m.closeCh)
+	}
+}
+
+// SetDefault 设置接口在没有脚本时的默认返回，endpoint 为 "gamedata_*.php" 时对所有游戏数据接口生效
+func (m *Server) SetDefault(endpoint string, b Behavior) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.defaults[endpoint] = b
+}
+
+// Script 依次设置接口接下来几次请求的返回，用完后回到默认返回
+func (m *Server) Script(endpoint string, bs ...Behavior) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.scripts[endpoint] = append(m.scripts[endpoint], bs...)
+}
+
+func (m *Server) Requests(endpoint string) []Request {
+	m.l.Lock()
+	defer m.l.Unlock()
+	ret := make([]Request, 0)
+	for _, r := range m.requests {
+		if endpoint == "" || r.Endpoint == endpoint {
+			ret = append(ret, r)
+		}
+	}
+	return ret
+}
+
+func (m *Server) Reset() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.defaults = make(map[string]Behavior)
+	m.scripts = make(map[string][]Behavior)
+	m.requests = make([]Request, 0)
+	m.keys = make(map[string]bool)
+	m.tickets = make(map[string]int)
+}
+
+func (m *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mux.ServeHTTP(w, r)
+}
+
+func (m *Server) nextBehavior(endpoint string) Behavior {
+	for _, key := range []string{endpoint, wildcard(endpoint)} {
+		if bs := m.scripts[key]; len(bs) > 0 {
+			m.scripts[key] = bs[1:]
+			return bs[0]
+		}
+	}
+	for _, key := range []string{endpoint, wildcard(endpoint)} {
+		if b, ok := m.defaults[key]; ok {
+			return b
+		}
+	}
+	return Approve
+}
+
+func wildcard(endpoint string) string {
+	if strings.HasPrefix(endpoint, gameDataPre) && endpoint != HunterBox {
+		return gameDataPre + "*.php"
+	}
+	return endpoint
+}
+
+func (m *Server) handleApi(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	r.ParseForm()
+	params := make(map[string]string)
+	for k := range r.Form {
+		params[k] = r.Form.Get(k)
+	}
+	m.l.Lock()
+	b := m.nextBehavior(endpoint)
+	req := Request{endpoint, r.Method, params, b, false, time.Now()}
+	if key := params["idempotency_key"]; key != "" && b == Approve {
+		req.Duplicate = m.keys[key]
+		m.keys[key] = true
+	}
+	m.requests = append(m.requests, req)
+	ticketId := 0
+	if endpoint == TicketGame && b == Approve {
+		ticketKey := params["card_Uid"] + ":" + params["game_ID"]
+		if ticketId = m.tickets[ticketKey]; ticketId == 0 {
+			m.ticketId++
+			ticketId = m.ticketId
+			m.tickets[ticketKey] = ticketId
+		}
+	}
+	if endpoint == TicketUpdate && b == Approve {
+		for k, id := range m.tickets {
+			if strconv.Itoa(id) == params["id"] {
+				delete(m.tickets, k)
+			}
+		}
+	}
+	closeCh := m.closeCh
+	m.l.Unlock()
+	log.Println("mockapi:", r.Method, endpoint, b, params)
+
+	switch b {
+	case Timeout:
+		select {
+		case <-time.After(m.TimeoutDelay):
+		case <-closeCh:
+		}
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	case Malformed:
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html><body>Fatal error</body></html>")
+		return
+	}
+
+	var res map[string]interface{}
+	switch {
+	case endpoint == TicketGame:
+		if b == Approve {
+			res = map[string]interface{}{"id": ticketId}
+		} else {
+			res = map[string]interface{}{"id": -1}
+		}
+	case endpoint == AuthorityList, endpoint == TicketUpdate, strings.HasPrefix(endpoint, gameDataPre):
+		res = map[string]interface{}{"return": b == Approve}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// POST /_mock/script?endpoint=ticket_game.php&behavior=deny&times=2
+// times 为 0 时设置为默认返回
+func (m *Server) handleScript(w http.ResponseWriter, r *http.Request) {
+	endpoint := r.FormValue("endpoint")
+	b := Behavior(r.FormValue("behavior"))
+	if endpoint == "" || (b != Approve && b != Deny && b != Timeout && b != Malformed) {
+		http.Error(w, "endpoint and behavior(approve|deny|timeout|malformed) required", http.StatusBadRequest)
+		return
+	}
+	times, _ := strconv.Atoi(r.FormValue("times"))
+	if times <= 0 {
+		m.SetDefault(endpoint, b)
+	} else {
+		for i := 0; i < times; i++ {
+			m.Script(endpoint, b)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"code": "0"})
+}
+
+func (m *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, m.Requests(r.FormValue("endpoint")))
+}
+
+func (m *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	m.Reset()
+	writeJSON(w, map[string]interface{}{"code": "0"})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,59 @@
+// Package protocol 定义 arduino 通过 tcp 发送的 [K]V 帧，每种 TYPE 对应一个结构体。
+//
+// 帧的格式为 <[ID]G-1-1[TYPE]2[GAME]3>，尖括号由连接负责去掉，这里只处理中间的部分。
+// 字段说明见 PROTOCOL.md，修改结构体后运行 go generate 重新生成。
+package protocol
+
+//go:generate go run gen_reference.go
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Frame 是一个解析后的 [K]V 帧
+type Frame map[string]string
+
+// ParseFrame 解析 [key1]value1[key2]value2 格式的帧，不在 [] 中的key或重复的key都视为错误
+func ParseFrame(s string) (Frame, error) {
+	f := make(Frame)
+	if s == "" {
+		return f, nil
+	}
+	if !strings.HasPrefix(s, "[") {
+		return nil, errors.New("frame must start with '['")
+	}
+	for _, kv := range strings.Split(s[1:], "[") {
+		parts := strings.Split(kv, "]")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("bad key in frame: " + kv)
+		}
+		if _, ok := f[parts[0]]; ok {
+			return nil, errors.New("duplicate key in frame: " + parts[0])
+		}
+		f[parts[0]] = parts[1]
+	}
+	return f, nil
+}
+
+// String 按 ID TYPE 在前、其他字段按key排序的顺序编码，不包含尖括号
+func (f Frame) String() string {
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		if k != KeyID && k != KeyType {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	s := ""
+	for _, k := range []string{KeyID, KeyType} {
+		if v, ok := f[k]; ok {
+			s += "[" + k + "]" + v
+		}
+	}
+	for _, k := range keys {
+		s += "[" + k + "]" + f[k]
+	}
+	return s
+}
@@ -0,0 +1,17 @@
+// +build ignore
+
+// 生成 PROTOCOL.md: go generate ./protocol
+package main
+
+import (
+	"io/ioutil"
+	"log"
+
+	"challenger/server/protocol"
+)
+
+func main() {
+	if err := ioutil.WriteFile("PROTOCOL.md", []byte(protocol.Reference()), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	KeyID   = "ID"
+	KeyType = "TYPE"
+)
+
+// Message 是一种 TYPE 的帧，字段通过 frame tag 与帧中的key对应：
+//
+//	`frame:"GAME,required"` 帧中必须有 GAME
+//	`frame:"*"`             map[string]string，收集其他没有声明的字段
+//
+// 字段类型只能是 string 或 int，int 字段的值不是整数时解码失败。
+type Message interface {
+	Type() string
+	// Validate 在解码后检查字段的取值范围
+	Validate() error
+}
+
+// FieldError 说明帧中哪个字段有问题
+type FieldError struct {
+	Type   string
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *FieldError) Error() string {
+	s := "field " + e.Field
+	if e.Type != "" {
+		s = "TYPE " + e.Type + " " + s
+	}
+	if e.Value != "" {
+		s += "=" + strconv.Quote(e.Value)
+	}
+	return s + ": " + e.Reason
+}
+
+func fieldError(t string, field string, value string, reason string) *FieldError {
+	return &FieldError{Type: t, Field: field, Value: value, Reason: reason}
+}
+
+// Decode 按 TYPE 找到对应的结构体并解码、检查
+func Decode(f Frame) (Message, error) {
+	t, ok := f[KeyType]
+	if !ok {
+		return nil, fieldError("", KeyType, "", "missing")
+	}
+	newMessage, ok := types[t]
+	if !ok {
+		return nil, fieldError(t, KeyType, t, "unknown type")
+	}
+	m := newMessage()
+	if err := decodeInto(f, m); err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Encode 把结构体编码为帧，值为空的可选字段不编码
+func Encode(m Message) Frame {
+	f := make(Frame)
+	f[KeyType] = m.Type()
+	v := reflect.ValueOf(m).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key, required := parseTag(v.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Map:
+			for _, k := range fv.MapKeys() {
+				f[k.String()] = fv.MapIndex(k).String()
+			}
+		case reflect.Int:
+			if fv.Int() != 0 || required {
+				f[key] = strconv.FormatInt(fv.Int(), 10)
+			}
+		case reflect.String:
+			if fv.String() != "" || required {
+				f[key] = fv.String()
+			}
+		}
+	}
+	return f
+}
+
+func decodeInto(f Frame, m Message) error {
+	v := reflect.ValueOf(m).Elem()
+	known := map[string]bool{KeyType: true}
+	var rest reflect.Value
+	for i := 0; i < v.NumField(); i++ {
+		key, required := parseTag(v.Type().Field(i))
+		if key == "" {
+			continue
+		}
+		fv := v.Field(i)
+		if key == "*" {
+			rest = fv
+			continue
+		}
+		known[key] = true
+		value, ok := f[key]
+		if !ok || value == "" {
+			if required {
+				return fieldError(m.Type(), key, "", "missing")
+			}
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fieldError(m.Type(), key, value, "not an integer")
+			}
+			fv.SetInt(int64(n))
+		case reflect.String:
+			fv.SetString(value)
+		}
+	}
+	if rest.IsValid() {
+		rest.Set(reflect.ValueOf(make(map[string]string)))
+		for k, value := range f {
+			if !known[k] {
+				rest.SetMapIndex(reflect.ValueOf(k), reflect.ValueOf(value))
+			}
+		}
+	}
+	return nil
+}
+
+func parseTag(field reflect.StructField) (string, bool) {
+	tag := field.Tag.Get("frame")
+	if tag == "" {
+		return "", false
+	}
+	parts := strings.Split(tag, ",")
+	return parts[0], len(parts) > 1 && parts[1] == "required"
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"reflect"
+	"testing"
+)
+
+// 每种 TYPE 解码后再编码得到原来的帧，帧中的 key 按 Frame.String 的顺序排列
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  Message
+	}{
+		{"[ID]G-1-1[TYPE]0[VER]2", &Heartbeat{ID: "G-1-1", Extra: map[string]string{"VER": "2"}}},
+		{"[ID]G-11-0[TYPE]1[ARDUINO]G-11-2[GAME]11[P]3", &GameStartForward{ID: "G-11-0", Game: 11, Arduino: "G-11-2", P: 3}},
+		{"[ID]G-2-1[TYPE]2[ADMIN]staff-1[GAME]2[P]1", &GameStart{ID: "G-2-1", Admin: "staff-1", Game: 2, P: 1}},
+		{"[ID]G-11-0[TYPE]3[ARDUINO]G-11-2[GAME]11", &GameEndForward{ID: "G-11-0", Game: 11, Arduino: "G-11-2"}},
+		{"[ID]G-2-1[TYPE]4[GAME]2[LR]3[PR1]1.5", &GameEnd{ID: "G-2-1", Game: 2, Data: map[string]string{"LR": "3", "PR1": "1.5"}}},
+		{"[ID]G-2-1[TYPE]5[GAME]2[R3P2]", &GameData{ID: "G-2-1", Game: 2, Data: map[string]string{"R3P2": ""}}},
+		{"[ID]A-1[TYPE]6[AR]7[CARD_ID]card-1", &AuthorityCheck{ID: "A-1", CardId: "card-1", AR: "7"}},
+		{"[ID]G-2-1[TYPE]7[CARD_ID]card-1[GAME]2[P]4", &TicketGet{ID: "G-2-1", Game: 2, CardId: "card-1", P: 4}},
+		{"[ID]B-1[TYPE]8[BOX_ID]0[ST]0", &BoxStatus{ID: "B-1", BoxId: 0, ST: 0}},
+		{"[ID]G-2-1[TYPE]9[GAME]2", &ResetGame{ID: "G-2-1", Game: 2}},
+		{"[ID]E-1[TYPE]10[EVENT]3", &Event{ID: "E-1", Event: 3}},
+		{"[ID]D-1[TYPE]11[DJ]2", &DJControl{ID: "D-1", DJ: 2}},
+		{"[ID]G-9-1[TYPE]12[CTRL]go[M]1", &MineControl{ID: "G-9-1", M: "1", CTRL: "go"}},
+		{"[ID]G-9-1[TYPE]13", &BoxStatusGet{ID: "G-9-1"}},
+		{"[ID]G-11-0[TYPE]14[ARDUINO]G-11-1[GAME]11", &GameReset{ID: "G-11-0", Game: 11, Arduino: "G-11-1"}},
+		{"[ID]G-11-0[TYPE]15[ADMIN]staff-1[ARDUINO]G-11-1[GAME]11", &GameRealStart{ID: "G-11-0", Admin: "staff-1", Game: 11, Arduino: "G-11-1"}},
+		{"[ID]L-1[TYPE]16[LV]0[PLAYER]2", &ButtonPress{ID: "L-1", Player: 2, LV: 0}},
+		{"[ID]L-1[TYPE]17[PLAYER]4", &LaserHit{ID: "L-1", Player: 4}},
+	}
+	covered := make(map[string]bool)
+	for _, tt := range tests {
+		f, err := ParseFrame(tt.frame)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.frame, err)
+		}
+		m, err := Decode(f)
+		if err != nil {
+			t.Errorf("%v: %v", tt.frame, err)
+			continue
+		}
+		covered[m.Type()] = true
+		if !reflect.DeepEqual(m, tt.want) {
+			t.Errorf("%v decoded to %+v, want %+v", tt.frame, m, tt.want)
+		}
+		if s := Encode(m).String(); s != tt.frame {
+			t.Errorf("%v encoded to %v", tt.frame, s)
+		}
+	}
+	for _, s := range specs {
+		if !covered[s.Type] {
+			t.Errorf("TYPE %v has no round trip case", s.Type)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		frame string
+		want  FieldError
+	}{
+		{"[ID]G-2-1", FieldError{Field: "TYPE", Reason: "missing"}},
+		{"[ID]G-2-1[TYPE]99", FieldError{Type: "99", Field: "TYPE", Value: "99", Reason: "unknown type"}},
+		{"[TYPE]2[GAME]2", FieldError{Type: "2", Field: "ID", Reason: "missing"}},
+		{"[ID]G-2-1[TYPE]7[GAME]2", FieldError{Type: "7", Field: "CARD_ID", Reason: "missing"}},
+		{"[ID]G-2-1[TYPE]7[GAME]2[CARD_ID]", FieldError{Type: "7", Field: "CARD_ID", Reason: "missing"}},
+		{"[ID]G-2-1[TYPE]2[GAME]two", FieldError{Type: "2", Field: "GAME", Value: "two", Reason: "not an integer"}},
+		{"[ID]G-2-1[TYPE]2[GAME]2[P]1.5", FieldError{Type: "2", Field: "P", Value: "1.5", Reason: "not an integer"}},
+		{"[ID]L-1[TYPE]16[PLAYER]1[LV]x", FieldError{Type: "16", Field: "LV", Value: "x", Reason: "not an integer"}},
+		{"[ID]G-2-1[TYPE]2[GAME]0", FieldError{Type: "2", Field: "GAME", Value: "0", Reason: "must be positive"}},
+		{"[ID]G-2-1[TYPE]7[GAME]2[CARD_ID]c[P]5", FieldError{Type: "7", Field: "P", Value: "5", Reason: "must be 1-4"}},
+		{"[ID]L-1[TYPE]16[PLAYER]1[LV]4", FieldError{Type: "16", Field: "LV", Value: "4", Reason: "must be 0-3"}},
+		{"[ID]L-1[TYPE]17[PLAYER]0", FieldError{Type: "17", Field: "PLAYER", Value: "0", Reason: "must be 1-4"}},
+		{"[ID]L-1[TYPE]17[PLAYER]5", FieldError{Type: "17", Field: "PLAYER", Value: "5", Reason: "must be 1-4"}},
+		{"[ID]B-1[TYPE]8[BOX_ID]1[ST]3", FieldError{Type: "8", Field: "ST", Value: "3", Reason: "must be 0, 1 or 2"}},
+	}
+	for _, tt := range tests {
+		f, err := ParseFrame(tt.frame)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.frame, err)
+		}
+		m, err := Decode(f)
+		fe, ok := err.(*FieldError)
+		if !ok || *fe != tt.want {
+			t.Errorf("%v decoded to %+v, %v, want %v", tt.frame, m, err, &tt.want)
+		}
+	}
+}
+
+// GameEnd 和 GameData 中不是数字的字段丢弃，其他字段和帧照常处理
+func TestDecodeDropsBadGameData(t *testing.T) {
+	for _, typ := range []string{TypeGameEnd, TypeGameData} {
+		f := Frame{KeyID: "G-2-1", KeyType: typ, "GAME": "2", "LR": "7?", "PR1": "3", "FB": "", "BT": "abc"}
+		m, err := Decode(f)
+		if err != nil {
+			t.Fatalf("TYPE %v: %v", typ, err)
+		}
+		var data map[string]string
+		var dropped []*FieldError
+		switch m := m.(type) {
+		case *GameEnd:
+			data, dropped = m.Data, m.Dropped
+		case *GameData:
+			data, dropped = m.Data, m.Dropped
+		}
+		if want := map[string]string{"PR1": "3", "FB": ""}; !reflect.DeepEqual(data, want) {
+			t.Errorf("TYPE %v data = %v, want %v", typ, data, want)
+		}
+		want := []*FieldError{
+			{Type: typ, Field: "BT", Value: "abc", Reason: "not a number"},
+			{Type: typ, Field: "LR", Value: "7?", Reason: "not a number"},
+		}
+		if !reflect.DeepEqual(dropped, want) {
+			t.Errorf("TYPE %v dropped = %v, want %v", typ, dropped, want)
+		}
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Frame
+		ok   bool
+	}{
+		{"", Frame{}, true},
+		{"[ID]G-1-1[TYPE]0", Frame{"ID": "G-1-1", "TYPE": "0"}, true},
+		{"[ID]G-1-1[GAME]", Frame{"ID": "G-1-1", "GAME": ""}, true},
+		{"ID]G-1-1", nil, false},
+		{"[ID]G-1-1[]2", nil, false},
+		{"[ID]G-1-1[TYPE", nil, false},
+		{"[ID]G-1-1[ID]G-1-2", nil, false},
+	}
+	for _, tt := range tests {
+		f, err := ParseFrame(tt.s)
+		if (err == nil) != tt.ok || !reflect.DeepEqual(f, tt.want) {
+			t.Errorf("ParseFrame(%q) = %v, %v", tt.s, f, err)
+		}
+	}
+}
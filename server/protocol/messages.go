@@ -0,0 +1,339 @@
+package protocol
+
+import (
+	"sort"
+	"strconv"
+)
+
+const (
+	TypeHeartbeat        = "0"
+	TypeGameStartForward = "1"
+	TypeGameStart        = "2"
+	TypeGameEndForward   = "3"
+	TypeGameEnd          = "4"
+	TypeGameData         = "5"
+	TypeAuthorityCheck   = "6"
+	TypeTicketGet        = "7"
+	TypeBoxStatus        = "8"
+	TypeResetGame        = "9"
+	TypeEvent            = "10"
+	TypeDJControl        = "11"
+	TypeMineControl      = "12"
+	TypeBoxStatusGet     = "13"
+	TypeGameReset        = "14"
+	TypeGameRealStart    = "15"
+	TypeButtonPress      = "16"
+	TypeLaserHit         = "17"
+)
+
+// MaxPlayers 是 P 字段允许的最大人数
+const MaxPlayers = 4
+
+type spec struct {
+	Type string
+	Doc  string
+	New  func() Message
+}
+
+// specs 按 TYPE 排列，同时用于生成 PROTOCOL.md
+var specs = []spec{
+	{TypeHeartbeat, "心跳，服务器据此识别设备", func() Message { return &Heartbeat{} }},
+	{TypeGameStartForward, "主控开始游戏并转发给游戏设备", func() Message { return &GameStartForward{} }},
+	{TypeGameStart, "游戏开始，核销已登录玩家的门票", func() Message { return &GameStart{} }},
+	{TypeGameEndForward, "主控结束游戏并转发给游戏设备", func() Message { return &GameEndForward{} }},
+	{TypeGameEnd, "游戏结束，带最终的游戏数据", func() Message { return &GameEnd{} }},
+	{TypeGameData, "游戏进行中的数据", func() Message { return &GameData{} }},
+	{TypeAuthorityCheck, "刷卡检查员工权限", func() Message { return &AuthorityCheck{} }},
+	{TypeTicketGet, "玩家刷卡检查门票", func() Message { return &TicketGet{} }},
+	{TypeBoxStatus, "寻宝宝箱状态变化", func() Message { return &BoxStatus{} }},
+	{TypeResetGame, "管理员重置游戏", func() Message { return &ResetGame{} }},
+	{TypeEvent, "触发场馆事件(show)", func() Message { return &Event{} }},
+	{TypeDJControl, "DJ台触发事件(show)", func() Message { return &DJControl{} }},
+	{TypeMineControl, "矿工游戏控制矿车", func() Message { return &MineControl{} }},
+	{TypeBoxStatusGet, "查询所有宝箱的分配情况", func() Message { return &BoxStatusGet{} }},
+	{TypeGameReset, "重置游戏并转发给游戏设备", func() Message { return &GameReset{} }},
+	{TypeGameRealStart, "开始计时并转发给游戏设备", func() Message { return &GameRealStart{} }},
+	{TypeButtonPress, "激光房间主控: 玩家松开按钮", func() Message { return &ButtonPress{} }},
+	{TypeLaserHit, "激光房间主控: 玩家碰到激光", func() Message { return &LaserHit{} }},
+}
+
+var types = make(map[string]func() Message)
+
+func init() {
+	for _, s := range specs {
+		types[s.Type] = s.New
+	}
+}
+
+type Heartbeat struct {
+	ID    string            `frame:"ID,required" doc:"设备ID"`
+	Extra map[string]string `frame:"*" doc:"设备附带的其他状态，不做检查"`
+}
+
+type GameStartForward struct {
+	ID      string `frame:"ID,required" doc:"主控设备ID"`
+	Admin   string `frame:"ADMIN" doc:"操作员"`
+	Game    int    `frame:"GAME,required" doc:"游戏ID"`
+	Arduino string `frame:"ARDUINO,required" doc:"转发的目标设备ID"`
+	P       int    `frame:"P" doc:"人数 1-4，没有时按1人转发"`
+}
+
+type GameStart struct {
+	ID    string `frame:"ID,required" doc:"设备ID"`
+	Admin string `frame:"ADMIN" doc:"操作员，核销门票时上传"`
+	Game  int    `frame:"GAME,required" doc:"游戏ID"`
+	P     int    `frame:"P" doc:"人数 1-4，登录人数超过时拒绝开始"`
+}
+
+type GameEndForward struct {
+	ID      string `frame:"ID,required" doc:"主控设备ID"`
+	Admin   string `frame:"ADMIN" doc:"操作员"`
+	Game    int    `frame:"GAME,required" doc:"游戏ID"`
+	Arduino string `frame:"ARDUINO,required" doc:"转发的目标设备ID"`
+}
+
+type GameEnd struct {
+	ID    string            `frame:"ID,required" doc:"设备ID"`
+	Admin string            `frame:"ADMIN" doc:"操作员"`
+	Game  int               `frame:"GAME,required" doc:"游戏ID"`
+	Data  map[string]string `frame:"*" doc:"游戏数据，如 PR1 LR R3P2 FB PL NQ BT DN，不是数字的字段丢弃，其他字段照常处理"`
+
+	Dropped []*FieldError // 从 Data 中丢弃的字段
+}
+
+type GameData struct {
+	ID    string            `frame:"ID,required" doc:"设备ID"`
+	Admin string            `frame:"ADMIN" doc:"操作员"`
+	Game  int               `frame:"GAME,required" doc:"游戏ID"`
+	Data  map[string]string `frame:"*" doc:"游戏数据，同 GameEnd"`
+
+	Dropped []*FieldError // 从 Data 中丢弃的字段
+}
+
+type AuthorityCheck struct {
+	ID     string `frame:"ID,required" doc:"设备ID"`
+	CardId string `frame:"CARD_ID,required" doc:"卡号"`
+	AR     string `frame:"AR,required" doc:"权限ID"`
+}
+
+type TicketGet struct {
+	ID     string `frame:"ID,required" doc:"设备ID"`
+	Admin  string `frame:"ADMIN" doc:"操作员"`
+	Game   int    `frame:"GAME,required" doc:"游戏ID"`
+	CardId string `frame:"CARD_ID,required" doc:"卡号"`
+	P      int    `frame:"P" doc:"这一局的人数 1-4，第一个刷卡的玩家决定，没有时为2人"`
+}
+
+type BoxStatus struct {
+	ID    string `frame:"ID,required" doc:"宝箱设备ID"`
+	BoxId int    `frame:"BOX_ID,required" doc:"宝箱编号，从0开始"`
+	ST    int    `frame:"ST,required" doc:"0 关闭未打开 1 玩家打开 2 管理员重置"`
+}
+
+type ResetGame struct {
+	ID    string `frame:"ID,required" doc:"设备ID"`
+	Admin string `frame:"ADMIN" doc:"操作员"`
+	Game  int    `frame:"GAME,required" doc:"游戏ID"`
+}
+
+type Event struct {
+	ID    string `frame:"ID,required" doc:"设备ID"`
+	Event int    `frame:"EVENT,required" doc:"事件编号，见 shows.toml"`
+}
+
+type DJControl struct {
+	ID string `frame:"ID,required" doc:"DJ设备ID"`
+	DJ int    `frame:"DJ,required" doc:"事件编号，见 shows.toml"`
+}
+
+type MineControl struct {
+	ID   string `frame:"ID,required" doc:"设备ID"`
+	M    string `frame:"M,required" doc:"矿车编号"`
+	CTRL string `frame:"CTRL,required" doc:"控制命令，原样转发给 G-9-2"`
+}
+
+type BoxStatusGet struct {
+	ID string `frame:"ID,required" doc:"设备ID，结果发回这个设备"`
+}
+
+type GameReset struct {
+	ID      string `frame:"ID,required" doc:"主控设备ID"`
+	Admin   string `frame:"ADMIN" doc:"操作员"`
+	Game    int    `frame:"GAME,required" doc:"游戏ID"`
+	Arduino string `frame:"ARDUINO,required" doc:"转发的目标设备ID"`
+}
+
+type GameRealStart struct {
+	ID      string `frame:"ID,required" doc:"主控设备ID"`
+	Admin   string `frame:"ADMIN" doc:"操作员"`
+	Game    int    `frame:"GAME,required" doc:"游戏ID"`
+	Arduino string `frame:"ARDUINO,required" doc:"转发的目标设备ID"`
+}
+
+type ButtonPress struct {
+	ID     string `frame:"ID,required" doc:"主控设备ID，即按钮ID"`
+	Player int    `frame:"PLAYER,required" doc:"玩家 1-4，按手环区分"`
+	LV     int    `frame:"LV,required" doc:"松开时的读条档位 0-3，对应 t1 t2 t3，暴走时按住 tRampage 为3"`
+}
+
+type LaserHit struct {
+	ID     string `frame:"ID,required" doc:"主控设备ID"`
+	Player int    `frame:"PLAYER,required" doc:"玩家 1-4，按手环区分"`
+}
+
+func (m *Heartbeat) Type() string        { return TypeHeartbeat }
+func (m *GameStartForward) Type() string { return TypeGameStartForward }
+func (m *GameStart) Type() string        { return TypeGameStart }
+func (m *GameEndForward) Type() string   { return TypeGameEndForward }
+func (m *GameEnd) Type() string          { return TypeGameEnd }
+func (m *GameData) Type() string         { return TypeGameData }
+func (m *AuthorityCheck) Type() string   { return TypeAuthorityCheck }
+func (m *TicketGet) Type() string        { return TypeTicketGet }
+func (m *BoxStatus) Type() string        { return TypeBoxStatus }
+func (m *ResetGame) Type() string        { return TypeResetGame }
+func (m *Event) Type() string            { return TypeEvent }
+func (m *DJControl) Type() string        { return TypeDJControl }
+func (m *MineControl) Type() string      { return TypeMineControl }
+func (m *BoxStatusGet) Type() string     { return TypeBoxStatusGet }
+func (m *GameReset) Type() string        { return TypeGameReset }
+func (m *GameRealStart) Type() string    { return TypeGameRealStart }
+func (m *ButtonPress) Type() string      { return TypeButtonPress }
+func (m *LaserHit) Type() string         { return TypeLaserHit }
+
+func (m *Heartbeat) Validate() error      { return nil }
+func (m *AuthorityCheck) Validate() error { return nil }
+func (m *MineControl) Validate() error    { return nil }
+func (m *BoxStatusGet) Validate() error   { return nil }
+
+func (m *GameStartForward) Validate() error {
+	if err := checkGame(m.Type(), m.Game); err != nil {
+		return err
+	}
+	return checkPlayers(m.Type(), m.P)
+}
+
+func (m *GameStart) Validate() error {
+	if err := checkGame(m.Type(), m.Game); err != nil {
+		return err
+	}
+	return checkPlayers(m.Type(), m.P)
+}
+
+func (m *GameEndForward) Validate() error {
+	return checkGame(m.Type(), m.Game)
+}
+
+func (m *GameEnd) Validate() error {
+	if err := checkGame(m.Type(), m.Game); err != nil {
+		return err
+	}
+	m.Dropped = dropBadGameData(m.Type(), m.Data)
+	return nil
+}
+
+func (m *GameData) Validate() error {
+	if err := checkGame(m.Type(), m.Game); err != nil {
+		return err
+	}
+	m.Dropped = dropBadGameData(m.Type(), m.Data)
+	return nil
+}
+
+func (m *TicketGet) Validate() error {
+	if err := checkGame(m.Type(), m.Game); err != nil {
+		return err
+	}
+	return checkPlayers(m.Type(), m.P)
+}
+
+func (m *BoxStatus) Validate() error {
+	if m.BoxId < 0 {
+		return fieldError(m.Type(), "BOX_ID", strconv.Itoa(m.BoxId), "must not be negative")
+	}
+	if m.ST < 0 || m.ST > 2 {
+		return fieldError(m.Type(), "ST", strconv.Itoa(m.ST), "must be 0, 1 or 2")
+	}
+	return nil
+}
+
+func (m *ResetGame) Validate() error {
+	return checkGame(m.Type(), m.Game)
+}
+
+func (m *Event) Validate() error {
+	if m.Event < 0 {
+		return fieldError(m.Type(), "EVENT", strconv.Itoa(m.Event), "must not be negative")
+	}
+	return nil
+}
+
+func (m *DJControl) Validate() error {
+	if m.DJ < 0 {
+		return fieldError(m.Type(), "DJ", strconv.Itoa(m.DJ), "must not be negative")
+	}
+	return nil
+}
+
+func (m *GameReset) Validate() error {
+	return checkGame(m.Type(), m.Game)
+}
+
+func (m *GameRealStart) Validate() error {
+	return checkGame(m.Type(), m.Game)
+}
+
+func (m *ButtonPress) Validate() error {
+	if err := checkPlayer(m.Type(), m.Player); err != nil {
+		return err
+	}
+	if m.LV < 0 || m.LV > 3 {
+		return fieldError(m.Type(), "LV", strconv.Itoa(m.LV), "must be 0-3")
+	}
+	return nil
+}
+
+func (m *LaserHit) Validate() error {
+	return checkPlayer(m.Type(), m.Player)
+}
+
+func checkGame(t string, game int) error {
+	if game <= 0 {
+		return fieldError(t, "GAME", strconv.Itoa(game), "must be positive")
+	}
+	return nil
+}
+
+// checkPlayers P 为0表示帧中没有 P
+func checkPlayers(t string, p int) error {
+	if p < 0 || p > MaxPlayers {
+		return fieldError(t, "P", strconv.Itoa(p), "must be 1-"+strconv.Itoa(MaxPlayers))
+	}
+	return nil
+}
+
+// checkPlayer 激光房间上报的玩家编号
+func checkPlayer(t string, p int) error {
+	if p < 1 || p > MaxPlayers {
+		return fieldError(t, "PLAYER", strconv.Itoa(p), "must be 1-"+strconv.Itoa(MaxPlayers))
+	}
+	return nil
+}
+
+// dropBadGameData 游戏数据都是分数、次数或时间，空值仍按0处理，不是数字的字段从 data 中删除并返回，
+// 一个字段出错时其他数据仍然有效
+func dropBadGameData(t string, data map[string]string) []*FieldError {
+	var ret []*FieldError
+	for k, v := range data {
+		if v == "" {
+			continue
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			ret = append(ret, fieldError(t, k, v, "not a number"))
+			delete(data, k)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Field < ret[j].Field
+	})
+	return ret
+}
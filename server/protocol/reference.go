@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Reference 返回 markdown 格式的字段说明表，PROTOCOL.md 由它生成
+func Reference() string {
+	lines := []string{
+		"# Arduino TCP protocol",
+		"",
+		"由 `go generate ./protocol` 根据 protocol/messages.go 生成，请勿手工修改。",
+		"",
+		"帧格式为 `<[ID]G-1-1[TYPE]2[GAME]3>`，int 字段必须是整数，缺少 required 字段或取值不合法的帧会被服务器拒绝并记录原因。",
+		"",
+	}
+	for _, s := range specs {
+		m := s.New()
+		t := reflect.TypeOf(m).Elem()
+		lines = append(lines,
+			"## TYPE "+s.Type+" "+t.Name(),
+			"",
+			s.Doc,
+			"",
+			"| 字段 | 类型 | 必须 | 说明 |",
+			"| --- | --- | --- | --- |",
+		)
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key, required := parseTag(f)
+			if key == "" {
+				continue
+			}
+			kind := f.Type.Kind().String()
+			if key == "*" {
+				key, kind = "其他字段", "string"
+			}
+			req := ""
+			if required {
+				req = "是"
+			}
+			lines = append(lines, "| "+key+" | "+kind+" | "+req+" | "+f.Tag.Get("doc")+" |")
+		}
+		lines = append(lines, "")
+	}
+	return strings.Join(lines, "\n")
+}
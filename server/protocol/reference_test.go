@@ -0,0 +1,17 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+// 修改结构体后忘记运行 go generate 时失败
+func TestProtocolDocUpToDate(t *testing.T) {
+	b, err := ioutil.ReadFile("PROTOCOL.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != Reference() {
+		t.Error("PROTOCOL.md is out of date, run go generate ./protocol")
+	}
+}
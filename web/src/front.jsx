@@ -8,11 +8,42 @@ import styles from '~/styles/front.css'
 
 class Front {
 	@observable number
+	@observable token = window.sessionStorage.getItem('adminToken')
+}
+
+// adminPost 取号和重置都要操作员登录，token 放在 X-Admin-Token 头中
+function adminPost(front, url, param, success) {
+	$.ajax({
+		type: 'POST',
+		url: url,
+		contentType: 'application/json',
+		data: JSON.stringify(param),
+		headers: { 'X-Admin-Token': front.token },
+		success: success,
+		error: function(xhr) {
+			if (xhr.status == 401) {
+				window.sessionStorage.removeItem('adminToken')
+				front.token = null
+			}
+		}
+	})
 }
 
 const FrontView = CSSModules(observer(React.createClass({
 	render() {
 		let number = this.props.front.number
+		if (!this.props.front.token) {
+			return (
+				<div styleName='root'>
+					<div styleName='title'>暴走的金币</div>
+					<label>操作员</label><br/>
+					<input type='text' ref='name' /><br/>
+					<label>密码</label><br/>
+					<input type='password' ref='password' /><br/>
+					<button styleName='add' onClick={this.login}>登录</button>
+				</div>
+			)
+		}
 		return (
 			<div styleName='root'>
 				<div styleName='title'>暴走的金币</div>
@@ -31,6 +62,26 @@ const FrontView = CSSModules(observer(React.createClass({
 			</div>
 		)
 	},
+	login: function(e) {
+		let front = this.props.front
+		let param = {
+			name: this.refs.name.value,
+			password: this.refs.password.value
+		}
+		$.ajax({
+			type: 'POST',
+			url: '/api/admin/login',
+			contentType: 'application/json',
+			data: JSON.stringify(param),
+			success: function(data) {
+				window.sessionStorage.setItem('adminToken', data.data.token)
+				front.token = data.data.token
+			},
+			error: function(xhr) {
+				window.alert('登录失败')
+			}
+		})
+	},
 	addTeam: function(e) {
 		let front = this.props.front
 		var c = 1
@@ -47,9 +98,9 @@ const FrontView = CSSModules(observer(React.createClass({
 			count: c,
 			mode: this.refs.gold.checked ? 'g' : 's'
 		}
-		$.post('/api/addteam', param, function(data) {
+		adminPost(front, '/api/admin/team/add', param, function(data) {
 			if (data) {
-				front.number = data.id
+				front.number = data.data.id
 			}
 		})
 	},
@@ -57,7 +108,7 @@ const FrontView = CSSModules(observer(React.createClass({
 		var r = window.confirm('确定要重置吗？')
 		if (r == true) {
 			let front = this.props.front
-			$.post('/api/resetqueue', function(data) {
+			adminPost(front, '/api/admin/queue/reset', {}, function(data) {
 				front.number = null
 			})
 		}
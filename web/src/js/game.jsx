@@ -62,7 +62,7 @@ class Game {
       let data = {
         cmd: 'init',
         ID: playerName,
-        TYPE: '2'
+        TYPE: '10'
       }
       this.sock.send(JSON.stringify(data))
     }
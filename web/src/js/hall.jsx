@@ -16,7 +16,7 @@ const MatchView = observer(React.createClass({
   render: function() {
     let controllers = this.props.game.controllers
     let mm = controllers.filter((c) => {
-      return c.status == 1 && c.address.type == 2
+      return c.status == 1 && c.address.type == 10
     })
     return (
       <div>
@@ -59,6 +59,7 @@ class Queue {
 				break
 			case 'matchStop':
 				this.match = null
+				break
 			case 'updateMatch':
 				if (json.data != null && this.connected) {
 					this.match = JSON.parse(json.data)